@@ -5,6 +5,7 @@ const cors = require('cors');
 const morgan = require('morgan');
 
 const pool = require('./config/db');
+const { usersChangedMiddleware } = require('./nodeEvents');
 
 const authRoutes = require('./routes/auth');
 // 这里的 plans 路由实际文件仍然叫 products.js，为了兼容直接复用
@@ -23,6 +24,8 @@ const app = express();
 app.use(cors());
 app.use(express.json());
 app.use(morgan('dev'));
+// 影响节点允许列表的写操作成功后通知 connector（/api/internal/events）
+app.use(usersChangedMiddleware);
 
 // 健康检查
 app.get('/api/health', async (req, res) => {
@@ -0,0 +1,86 @@
+const { EventEmitter } = require('events');
+
+// 节点变更事件（进程内）：
+// 管理员封禁用户、退订、取消订单、改套餐/节点绑定、用户下单等操作成功后发布 users_changed，
+// /api/internal/events 把事件实时推给订阅的 connector，connector 收到后立即同步对应节点，
+// 不必等下一轮 INTERVAL_SECONDS 轮询。多实例部署时事件不跨实例（connector 仍有轮询兜底）。
+// 节点增删改（含脚本注册）另发 nodes_changed，按 HOST_ID 领取节点的 connector 收到后重新查询分配给本机的节点。
+const emitter = new EventEmitter();
+emitter.setMaxListeners(0);
+
+let seq = 0;
+
+// publishUsersChanged 发布用户变更；nodeIds 为空表示可能影响所有节点
+function publishUsersChanged({ reason = '', userId = null, nodeIds = null } = {}) {
+  seq += 1;
+  const event = {
+    id: seq,
+    type: 'users_changed',
+    reason,
+    user_id: userId,
+    node_ids: Array.isArray(nodeIds) && nodeIds.length > 0 ? nodeIds : null,
+    ts: Math.floor(Date.now() / 1000)
+  };
+  emitter.emit('event', event);
+  return event;
+}
+
+// publishNodesChanged 发布节点增删改；不限节点，所有订阅者都会收到
+function publishNodesChanged({ reason = '', nodeId = null } = {}) {
+  seq += 1;
+  const event = {
+    id: seq,
+    type: 'nodes_changed',
+    reason,
+    node_id: nodeId,
+    node_ids: null,
+    ts: Math.floor(Date.now() / 1000)
+  };
+  emitter.emit('event', event);
+  return event;
+}
+
+function subscribe(fn) {
+  emitter.on('event', fn);
+  return () => emitter.off('event', fn);
+}
+
+// 会影响节点允许列表的写操作（方法 + 路径前缀）
+const USER_CHANGE_ROUTES = [
+  /^\/api\/admin\/users(\/|$)/,
+  /^\/api\/admin\/plan-groups(\/|$)/,
+  /^\/api\/admin\/plans(\/|$)/,
+  /^\/api\/admin\/orders(\/|$)/,
+  /^\/api\/admin\/nodes(\/|$)/,
+  /^\/api\/orders(\/|$)/
+];
+
+// 会改变节点本身（增删、config 中的 host_id / inbound_tag）的写操作
+const NODE_CHANGE_ROUTES = [/^\/api\/admin\/nodes(\/|$)/, /^\/api\/admin\/node-agent\/import$/];
+
+// usersChangedMiddleware 写操作成功（2xx）后发布事件
+function usersChangedMiddleware(req, res, next) {
+  if (req.method === 'GET' || req.method === 'HEAD' || req.method === 'OPTIONS') return next();
+  const path = req.originalUrl.split('?')[0];
+  const usersChanged = USER_CHANGE_ROUTES.some((re) => re.test(path));
+  const nodesChanged = NODE_CHANGE_ROUTES.some((re) => re.test(path));
+  if (!usersChanged && !nodesChanged) return next();
+
+  res.on('finish', () => {
+    if (res.statusCode < 200 || res.statusCode >= 300) return;
+    const nodeMatch = path.match(/^\/api\/admin\/nodes\/(\d+)/);
+    if (nodesChanged) {
+      publishNodesChanged({ reason: `${req.method} ${path}`, nodeId: nodeMatch ? Number(nodeMatch[1]) : null });
+    }
+    if (!usersChanged) return;
+    const userMatch = path.match(/^\/api\/admin\/users\/(\d+)/);
+    publishUsersChanged({
+      reason: `${req.method} ${path}`,
+      userId: userMatch ? Number(userMatch[1]) : null,
+      nodeIds: nodeMatch ? [Number(nodeMatch[1])] : null
+    });
+  });
+  next();
+}
+
+module.exports = { publishUsersChanged, publishNodesChanged, subscribe, usersChangedMiddleware };
@@ -1749,7 +1749,7 @@ router.put('/settings/panel', async (req, res, next) => {
  * 5. 节点管理 /api/admin/nodes
  * ====================== */
 
-// GET /api/admin/nodes 列出所有节点及其绑定的总套餐ID（group_ids）
+// GET /api/admin/nodes 列出所有节点及其绑定的总套餐ID（group_ids）、在线人数与最近一次心跳状态
 router.get('/nodes', async (req, res, next) => {
   try {
     const [rows] = await pool.query(
@@ -1764,11 +1764,27 @@ router.get('/nodes', async (req, res, next) => {
          n.sort_order,
          n.created_at,
          n.updated_at,
-         GROUP_CONCAT(DISTINCT p.group_id ORDER BY p.group_id) AS group_ids
+         GROUP_CONCAT(DISTINCT p.group_id ORDER BY p.group_id) AS group_ids,
+         (SELECT COUNT(DISTINCT nc.user_id) FROM node_connections nc
+           WHERE nc.node_id = n.id AND nc.status = 'active') AS online_users,
+         ns.connector_version,
+         ns.xray_version,
+         ns.xray_uptime,
+         ns.load1,
+         ns.cpu_percent,
+         ns.mem_total,
+         ns.mem_available,
+         ns.applied_users,
+         ns.last_sync_at,
+         ns.last_sync_error,
+         ns.last_report_error,
+         ns.last_heartbeat_at,
+         TIMESTAMPDIFF(SECOND, ns.last_heartbeat_at, NOW()) AS heartbeat_age
        FROM nodes n
        LEFT JOIN plan_nodes pn ON pn.node_id = n.id
        LEFT JOIN plans p ON p.id = pn.plan_id
-       GROUP BY n.id
+       LEFT JOIN node_status ns ON ns.node_id = n.id
+       GROUP BY n.id, ns.node_id
        ORDER BY n.sort_order ASC, n.id DESC`
     );
 
@@ -1787,6 +1803,33 @@ router.get('/nodes', async (req, res, next) => {
   }
 });
 
+// GET /api/admin/nodes/:id/online 节点当前在线会话（connector 上报的在线用户与来源 IP）
+router.get('/nodes/:id/online', async (req, res, next) => {
+  try {
+    const id = Number(req.params.id);
+    if (!id) {
+      return res.status(400).json({ code: 400, message: 'ID 无效', data: null });
+    }
+
+    const [rows] = await pool.query(
+      `SELECT nc.id, nc.user_id, u.username, u.email, nc.ip, nc.start_time
+       FROM node_connections nc
+       JOIN users u ON u.id = nc.user_id
+       WHERE nc.node_id = ? AND nc.status = 'active'
+       ORDER BY nc.user_id ASC, nc.start_time ASC`,
+      [id]
+    );
+
+    res.json({
+      code: 200,
+      message: 'success',
+      data: rows
+    });
+  } catch (err) {
+    next(err);
+  }
+});
+
 // POST /api/admin/nodes 新增节点（绑定总套餐 group_ids，自动展开为该总套餐下所有子套餐）
 router.post('/nodes', async (req, res, next) => {
   const connection = await pool.getConnection();
@@ -1,6 +1,7 @@
 const express = require('express');
 const crypto = require('crypto');
 const pool = require('../config/db');
+const nodeEvents = require('../nodeEvents');
 
 const router = express.Router();
 
@@ -183,8 +184,187 @@ router.get('/auth', requireInternalToken, async (req, res, next) => {
   }
 });
 
-// GET /api/internal/nodes/:nodeId/allowed-uuids
+// computeAllowedUsers 计算某节点当前允许的用户（逐用户校验，代价与用户数成正比）
+async function computeAllowedUsers(nodeId) {
+  // 先找能用该节点的所有用户（具备 paid 订单；再在 JS 里按周期叠加计算是否仍有效）
+  const [userRows] = await pool.query(
+    `SELECT DISTINCT o.user_id
+     FROM orders o
+     JOIN plan_nodes pn ON pn.plan_id = o.plan_id
+     JOIN users u ON u.id = o.user_id
+     WHERE o.status = 'paid'
+       AND pn.node_id = ?
+       AND u.status = 'active'`,
+    [nodeId]
+  );
+
+  const users = [];
+  for (const ur of userRows) {
+    const userId = ur.user_id;
+    const activePlanIds = await getActivePlanIdsForUser(userId);
+    if (activePlanIds.length === 0) continue;
+    const allowedNodeIds = await getAllowedNodeIdsForUser(userId, activePlanIds);
+    if (!allowedNodeIds.includes(nodeId)) continue;
+
+    // 流量检查：从 entitlements 检查是否有可用权益
+    const [entitlementCheck] = await pool.query(
+      `SELECT COUNT(*) AS count
+       FROM user_entitlements
+       WHERE user_id = ?
+         AND status = 'active'
+         AND service_expire_at > NOW()
+         AND (traffic_total_bytes < 0 OR traffic_used_bytes < traffic_total_bytes)
+       LIMIT 1`,
+      [userId]
+    );
+
+    if (entitlementCheck.length === 0 || Number(entitlementCheck[0].count) === 0) continue;
+
+    // 设备数限制：取该用户在本节点可用的有效权益所属总套餐 connections 的最大值
+    // 剩余流量：这些权益的剩余字节数之和（与 report-traffic 的扣量范围一致），任一权益不限流量时为 -1
+    // 到期时间：这些权益中最晚的 service_expire_at（Unix 秒），connector 离线时据此在本地移除到期用户
+    const [limitRows] = await pool.query(
+      `SELECT MAX(COALESCE(pg.connections, 1)) AS device_limit,
+              MAX(e.traffic_total_bytes < 0) AS unlimited,
+              SUM(GREATEST(e.traffic_total_bytes - e.traffic_used_bytes, 0)) AS remaining_bytes,
+              UNIX_TIMESTAMP(MAX(e.service_expire_at)) AS expire_at
+       FROM user_entitlements e
+       JOIN plan_nodes pn ON pn.plan_id = e.plan_id AND pn.node_id = ?
+       JOIN plan_groups pg ON pg.id = e.group_id
+       WHERE e.user_id = ?
+         AND e.status = 'active'
+         AND e.service_expire_at > NOW()`,
+      [nodeId, userId]
+    );
+    const limitRow = limitRows[0] || {};
+    const deviceLimit = Number(limitRow.device_limit) || 0;
+    // 没有匹配到本节点可用的权益（理论上不会出现）时不下发剩余流量，connector 不做本地限额
+    let remainingBytes = null;
+    if (limitRow.device_limit != null) {
+      remainingBytes = Number(limitRow.unlimited) ? -1 : Number(limitRow.remaining_bytes) || 0;
+    }
+    const expireAt = limitRow.expire_at != null ? Math.floor(Number(limitRow.expire_at)) : null;
+
+    const uuid = await getOrCreateUserUuid(userId);
+    users.push({ uuid, device_limit: deviceLimit, remaining_bytes: remainingBytes, expire_at: expireAt });
+  }
+  return users;
+}
+
+// allowed-uuids 缓存与版本：
+// - 先用一条聚合查询取相关表的“指纹”（行数 + 最近更新时间 + 当前未到期权益数），指纹不变就直接复用上次计算结果，
+//   不再逐用户查库；为兜底按时间到期等指纹覆盖不到的变化，结果最多复用 ALLOWED_CACHE_MAX_AGE_MS
+// - 每个节点的列表内容变化一次，version 加一（单调递增；面板重启后从当前毫秒时间戳重新开始），ETag 即节点 + version
+// - 保留最近 ALLOWED_DELTA_HISTORY 次变化的增量，connector 带 since=<version> 时只返回增量
+// - 缓存只在进程内存中，多实例部署时各实例独立计算（version 不互通，connector 会收到全量）
+const ALLOWED_FINGERPRINT_TTL_MS = 5 * 1000;
+const ALLOWED_CACHE_MAX_AGE_MS = 60 * 1000;
+const ALLOWED_DELTA_HISTORY = 50;
+let allowedVersionSeq = Date.now();
+const allowedCache = new Map(); // nodeId -> { fingerprint, computedAt, version, users: Map(uuid -> user), history }
+const allowedInflight = new Map(); // nodeId -> Promise（同一节点并发请求只计算一次）
+let allowedFingerprintCache = { value: null, at: 0 };
+
+async function allowedFingerprint() {
+  const now = Date.now();
+  if (allowedFingerprintCache.value && now - allowedFingerprintCache.at < ALLOWED_FINGERPRINT_TTL_MS) {
+    return allowedFingerprintCache.value;
+  }
+  const [rows] = await pool.query(
+    `SELECT
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM users) AS u,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM orders) AS o,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM user_entitlements) AS e,
+       (SELECT COUNT(*) FROM user_entitlements WHERE status = 'active' AND service_expire_at > NOW()) AS ea,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM plans) AS p,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM plan_groups) AS pg,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(SUM(plan_id * 65537 + node_id), 0)) FROM plan_nodes) AS pn,
+       (SELECT CONCAT(COUNT(*), '/', COALESCE(MAX(updated_at), '')) FROM user_clients) AS uc`
+  );
+  const r = rows[0] || {};
+  const value = [r.u, r.o, r.e, r.ea, r.p, r.pg, r.pn, r.uc].join('|');
+  allowedFingerprintCache = { value, at: now };
+  return value;
+}
+
+// 收到变更事件时让缓存立即失效，connector 随后拉取就能拿到新列表（不受指纹 TTL 和 updated_at 秒级精度影响）
+nodeEvents.subscribe((event) => {
+  allowedFingerprintCache = { value: null, at: 0 };
+  for (const [nodeId, entry] of allowedCache) {
+    if (!event.node_ids || event.node_ids.includes(nodeId)) entry.computedAt = 0;
+  }
+});
+
+function sameAllowedUser(a, b) {
+  return a.device_limit === b.device_limit && a.remaining_bytes === b.remaining_bytes && a.expire_at === b.expire_at;
+}
+
+async function refreshAllowedCache(nodeId) {
+  const fingerprint = await allowedFingerprint();
+  const cached = allowedCache.get(nodeId);
+  if (cached && cached.fingerprint === fingerprint && Date.now() - cached.computedAt < ALLOWED_CACHE_MAX_AGE_MS) {
+    return cached;
+  }
+
+  const list = await computeAllowedUsers(nodeId);
+  const users = new Map(list.map((u) => [u.uuid, u]));
+  if (!cached) {
+    const entry = { fingerprint, computedAt: Date.now(), version: ++allowedVersionSeq, users, history: [] };
+    allowedCache.set(nodeId, entry);
+    return entry;
+  }
+
+  const added = [];
+  const removed = [];
+  for (const [uuid, u] of users) {
+    const prev = cached.users.get(uuid);
+    if (!prev || !sameAllowedUser(prev, u)) added.push(u);
+  }
+  for (const uuid of cached.users.keys()) {
+    if (!users.has(uuid)) removed.push(uuid);
+  }
+  if (added.length > 0 || removed.length > 0) {
+    const version = ++allowedVersionSeq;
+    cached.history.push({ since: cached.version, version, added, removed });
+    if (cached.history.length > ALLOWED_DELTA_HISTORY) cached.history.shift();
+    cached.version = version;
+    cached.users = users;
+  }
+  cached.fingerprint = fingerprint;
+  cached.computedAt = Date.now();
+  return cached;
+}
+
+async function getAllowedCache(nodeId) {
+  if (allowedInflight.has(nodeId)) return allowedInflight.get(nodeId);
+  const p = refreshAllowedCache(nodeId).finally(() => allowedInflight.delete(nodeId));
+  allowedInflight.set(nodeId, p);
+  return p;
+}
+
+// allowedDeltaSince 合并 since 之后的所有变化；since 太旧/未知时返回 null（需要全量）
+function allowedDeltaSince(entry, since) {
+  const start = entry.history.findIndex((h) => h.since === since);
+  if (start < 0) return null;
+  const added = new Map();
+  const removed = new Set();
+  for (const h of entry.history.slice(start)) {
+    for (const u of h.added) {
+      added.set(u.uuid, u);
+      removed.delete(u.uuid);
+    }
+    for (const uuid of h.removed) {
+      added.delete(uuid);
+      removed.add(uuid);
+    }
+  }
+  return { added: [...added.values()], removed: [...removed] };
+}
+
+// GET /api/internal/nodes/:nodeId/allowed-uuids[?since=<version>]
 // 供“对接程序”周期性同步 Xray inbound users：只下发允许的 UUID 列表
+// - 响应带 ETag，请求带 If-None-Match 且列表未变化时返回 304（无响应体）
+// - 带 since 且面板还保留从该版本起的变化时，只返回增量 { version, since, delta: { added, removed } }
 router.get('/nodes/:nodeId/allowed-uuids', requireInternalToken, async (req, res, next) => {
   try {
     const nodeId = Number(req.params.nodeId);
@@ -192,50 +372,34 @@ router.get('/nodes/:nodeId/allowed-uuids', requireInternalToken, async (req, res
       return res.status(400).json({ code: 400, message: 'nodeId invalid', data: null });
     }
 
-    // 先找能用该节点的所有用户（具备 paid 订单；再在 JS 里按周期叠加计算是否仍有效）
-    const [userRows] = await pool.query(
-      `SELECT DISTINCT o.user_id
-       FROM orders o
-       JOIN plan_nodes pn ON pn.plan_id = o.plan_id
-       JOIN users u ON u.id = o.user_id
-       WHERE o.status = 'paid'
-         AND pn.node_id = ?
-         AND u.status = 'active'`,
-      [nodeId]
-    );
-
-    const allowed = [];
-    for (const ur of userRows) {
-      const userId = ur.user_id;
-      const activePlanIds = await getActivePlanIdsForUser(userId);
-      if (activePlanIds.length === 0) continue;
-      const allowedNodeIds = await getAllowedNodeIdsForUser(userId, activePlanIds);
-      if (!allowedNodeIds.includes(nodeId)) continue;
-
-      // 流量检查：从 entitlements 检查是否有可用权益
-      const [entitlementCheck] = await pool.query(
-        `SELECT COUNT(*) AS count
-         FROM user_entitlements
-         WHERE user_id = ?
-           AND status = 'active'
-           AND service_expire_at > NOW()
-           AND (traffic_total_bytes < 0 OR traffic_used_bytes < traffic_total_bytes)
-         LIMIT 1`,
-        [userId]
-      );
-      
-      if (entitlementCheck.length === 0 || Number(entitlementCheck[0].count) === 0) continue;
+    const entry = await getAllowedCache(nodeId);
+    const etag = `"${nodeId}-${entry.version}"`;
+    res.set('ETag', etag);
+    if (req.headers['if-none-match'] === etag) {
+      return res.status(304).end();
+    }
 
-      const uuid = await getOrCreateUserUuid(userId);
-      allowed.push(uuid);
+    const since = Number(req.query.since);
+    if (since > 0) {
+      const delta = since === entry.version ? { added: [], removed: [] } : allowedDeltaSince(entry, since);
+      if (delta) {
+        return res.json({
+          code: 200,
+          message: 'success',
+          data: { node_id: nodeId, version: entry.version, since, delta }
+        });
+      }
     }
 
+    const users = [...entry.users.values()];
     res.json({
       code: 200,
       message: 'success',
       data: {
         node_id: nodeId,
-        uuids: allowed
+        version: entry.version,
+        uuids: users.map((u) => u.uuid),
+        users
       }
     });
   } catch (err) {
@@ -243,123 +407,579 @@ router.get('/nodes/:nodeId/allowed-uuids', requireInternalToken, async (req, res
   }
 });
 
+// GET /api/internal/events?node_ids=1,2
+// Server-Sent Events：connector 长连接订阅节点变更事件
+// - 连接建立后先发 hello；之后每个相关变更发一条 users_changed（data 为 JSON：{ id, type, reason, user_id, node_ids, ts }）
+// - node_ids 为 null 表示可能影响所有节点；订阅时不带 node_ids 则接收全部事件
+// - 每 25 秒发一行注释保活，connector 据此判断连接是否还活着
+const EVENTS_PING_MS = 25 * 1000;
+router.get('/events', requireInternalToken, (req, res) => {
+  const wanted = String(req.query.node_ids || '')
+    .split(',')
+    .map((v) => Number(v))
+    .filter(Boolean);
+
+  res.set({
+    'Content-Type': 'text/event-stream; charset=utf-8',
+    'Cache-Control': 'no-cache',
+    Connection: 'keep-alive',
+    'X-Accel-Buffering': 'no' // 反向代理（nginx）不要缓冲
+  });
+  res.flushHeaders();
+
+  const send = (event, data, id) => {
+    let msg = '';
+    if (id) msg += `id: ${id}\n`;
+    msg += `event: ${event}\ndata: ${JSON.stringify(data)}\n\n`;
+    res.write(msg);
+  };
+  send('hello', { node_ids: wanted, ts: Math.floor(Date.now() / 1000) });
+
+  const unsubscribe = nodeEvents.subscribe((event) => {
+    if (wanted.length > 0 && event.node_ids && !event.node_ids.some((id) => wanted.includes(id))) return;
+    send(event.type, event, event.id);
+  });
+  const ping = setInterval(() => res.write(': ping\n\n'), EVENTS_PING_MS);
+
+  req.on('close', () => {
+    clearInterval(ping);
+    unsubscribe();
+  });
+});
+
+// GET /api/internal/host-nodes
+// 供 connector（设置了 HOST_ID）查询分配给本机的节点，请求头 x-host-id 为主机标识
+// - 返回 nodes.config.host_id 等于该标识的节点（含停用的），管理员在后台给节点 config 写上 host_id 即完成分配
+// - inbound_tag 取 nodes.config.inbound_tag，为空时 connector 按端口与协议匹配本机 inbound
+// - 节点增删改后面板推送 nodes_changed 事件，connector 收到后重新查询
+router.get('/host-nodes', requireInternalToken, async (req, res, next) => {
+  try {
+    const hostId = String(req.headers['x-host-id'] || '').trim();
+    if (!hostId) {
+      return res.status(400).json({ code: 400, message: 'x-host-id required', data: null });
+    }
+
+    const [rows] = await pool.query(
+      'SELECT id, name, port, protocol, config, status FROM nodes ORDER BY sort_order ASC, id ASC'
+    );
+    const nodes = [];
+    for (const r of rows) {
+      let config;
+      try {
+        config = JSON.parse(r.config || '{}');
+      } catch (e) {
+        continue;
+      }
+      if (!config || String(config.host_id || '').trim() !== hostId) continue;
+      nodes.push({
+        node_id: r.id,
+        name: r.name,
+        protocol: r.protocol,
+        port: r.port,
+        status: r.status,
+        inbound_tag: config.inbound_tag ? String(config.inbound_tag) : ''
+      });
+    }
+
+    res.json({ code: 200, message: 'success', data: { host_id: hostId, nodes } });
+  } catch (err) {
+    next(err);
+  }
+});
+
+// 解析上报中的 ts（增量产生时间，unix 秒）：缺省/非法/超出合理范围时按当前时间处理
+// connector 在面板不可用时会把增量留在本地 outbox，恢复后补报，ts 保证补报流量仍记在原来的分钟
+const REPORT_TS_MAX_AGE_SECONDS = 30 * 24 * 60 * 60;
+function parseReportTs(raw) {
+  const now = Math.floor(Date.now() / 1000);
+  const ts = Math.floor(Number(raw));
+  if (!Number.isFinite(ts) || ts <= 0) return now;
+  if (ts > now + 300 || ts < now - REPORT_TS_MAX_AGE_SECONDS) return now;
+  return ts;
+}
+
+// traffic_reports 表不存在（旧库未执行迁移）时退化为不去重，只提示一次
+let trafficReportsTableMissingWarned = false;
+
+// traffic_reports 保留期：connector 补报的 ts 最多早于当前 REPORT_TS_MAX_AGE_SECONDS，
+// 再多留一天余量；更早的记录不会再被补报，按 created_at 分批删除（挂在登记路径上，每小时最多触发一次）
+const TRAFFIC_REPORTS_RETENTION_SECONDS = REPORT_TS_MAX_AGE_SECONDS + 24 * 60 * 60;
+const TRAFFIC_REPORTS_PRUNE_INTERVAL_MS = 60 * 60 * 1000;
+const TRAFFIC_REPORTS_PRUNE_BATCH = 5000;
+let trafficReportsLastPrune = 0;
+let trafficReportsPruning = false;
+
+function maybePruneTrafficReports() {
+  const now = Date.now();
+  if (trafficReportsPruning || now - trafficReportsLastPrune < TRAFFIC_REPORTS_PRUNE_INTERVAL_MS) return;
+  trafficReportsLastPrune = now;
+  trafficReportsPruning = true;
+  (async () => {
+    let deleted = 0;
+    for (;;) {
+      const [result] = await pool.query(
+        `DELETE FROM traffic_reports
+         WHERE created_at < DATE_SUB(NOW(), INTERVAL ? SECOND)
+         LIMIT ?`,
+        [TRAFFIC_REPORTS_RETENTION_SECONDS, TRAFFIC_REPORTS_PRUNE_BATCH]
+      );
+      deleted += result.affectedRows;
+      if (result.affectedRows < TRAFFIC_REPORTS_PRUNE_BATCH) break;
+    }
+    if (deleted > 0) console.log(`[internal] traffic_reports 清理过期记录 ${deleted} 条`);
+  })()
+    .catch((err) => console.warn('[internal] traffic_reports 清理失败:', err.message))
+    .finally(() => {
+      trafficReportsPruning = false;
+    });
+}
+
+// claimTrafficReportId 在事务内登记 report_id：返回 false 表示该 report_id 已记过账（重复上报）
+async function claimTrafficReportId(conn, reportId, nodeId, userId, upload, download) {
+  try {
+    const [result] = await conn.query(
+      `INSERT IGNORE INTO traffic_reports (report_id, node_id, user_id, upload, download)
+       VALUES (?, ?, ?, ?, ?)`,
+      [reportId, nodeId, userId, upload, download]
+    );
+    maybePruneTrafficReports();
+    return result.affectedRows > 0;
+  } catch (err) {
+    if (err && err.code === 'ER_NO_SUCH_TABLE') {
+      if (!trafficReportsTableMissingWarned) {
+        trafficReportsTableMissingWarned = true;
+        console.warn('[internal] traffic_reports 表不存在，流量上报无法去重，请执行 db_example_basic.sql 中的建表语句');
+      }
+      return true;
+    }
+    throw err;
+  }
+}
+
+// applyTrafficReport 记一条流量增量（单条上报与批量上报共用）
+// item: { uuid, node_id, upload, download, ts?, report_id? }
+// 返回 { status, message }：status=200 表示已记账，其它为拒绝原因（与单条接口的 HTTP 状态码一致）
+// 带 report_id 时整条记账在一个事务里完成，同一 report_id 重复上报只记一次（message=duplicate）
+async function applyTrafficReport(item) {
+  const conn = await pool.getConnection();
+  try {
+    await conn.beginTransaction();
+    const result = await applyTrafficReportTx(conn, item);
+    if (result.status === 200 && result.message !== 'duplicate') {
+      await conn.commit();
+    } else {
+      await conn.rollback();
+    }
+    return result;
+  } catch (err) {
+    await conn.rollback();
+    throw err;
+  } finally {
+    conn.release();
+  }
+}
+
+async function applyTrafficReportTx(conn, item) {
+  const uuid = String(item.uuid || '').trim();
+  const nodeId = item.node_id ? Number(item.node_id) : null;
+  const upload = Number(item.upload || 0);
+  const download = Number(item.download || 0);
+  const total = Math.max(0, upload) + Math.max(0, download);
+  const ts = parseReportTs(item.ts);
+  const reportId = item.report_id ? String(item.report_id).trim().slice(0, 191) : '';
+
+  if (!uuid || !nodeId) {
+    return { status: 400, message: 'uuid and node_id required' };
+  }
+  if (!Number.isFinite(total) || total <= 0) {
+    return { status: 400, message: 'upload/download invalid' };
+  }
+
+  const [rows] = await conn.query(
+    'SELECT user_id FROM user_clients WHERE uuid = ? AND enabled = 1 LIMIT 1',
+    [uuid]
+  );
+  if (rows.length === 0) {
+    return { status: 404, message: 'uuid not found' };
+  }
+
+  const userId = rows[0].user_id;
+
+  // 0) 幂等：connector 超时重试 / 崩溃后补报时会带着同一个 report_id 再发一次
+  if (reportId && !(await claimTrafficReportId(conn, reportId, nodeId, userId, Math.max(0, upload), Math.max(0, download)))) {
+    return { status: 200, message: 'duplicate' };
+  }
+
+  // 1) 累加用户已用流量（用于统计）
+  await conn.query(
+    'UPDATE users SET traffic_used = traffic_used + ? WHERE id = ?',
+    [total, userId]
+  );
+
+  // 1.1) 按策略分摊流量到 entitlements（仅扣“当前节点允许的权益”，优先消耗最早 service_expire_at）
+  const [entitlementRows] = await conn.query(
+    `SELECT e.id, e.plan_id, e.traffic_total_bytes, e.traffic_used_bytes, e.service_expire_at
+     FROM user_entitlements e
+     JOIN plan_nodes pn ON pn.plan_id = e.plan_id AND pn.node_id = ?
+     WHERE e.user_id = ? AND e.status = 'active'
+       AND e.service_expire_at > NOW()
+       AND (e.traffic_total_bytes < 0 OR e.traffic_used_bytes < e.traffic_total_bytes)
+     ORDER BY e.service_expire_at ASC, e.id ASC`,
+    [nodeId, userId]
+  );
+
+  if (entitlementRows.length === 0) {
+    // 没有任何可用于该节点的权益：直接拒绝（避免把流量扣到其他套餐上）
+    return { status: 403, message: 'no_entitlement_for_node' };
+  }
+
+  let remainingTraffic = total;
+  for (const e of entitlementRows) {
+    if (remainingTraffic <= 0) break;
+    
+    // 计算该权益的可用流量
+    const availableTraffic = e.traffic_total_bytes < 0 
+      ? Number.MAX_SAFE_INTEGER 
+      : Math.max(0, Number(e.traffic_total_bytes || 0) - Number(e.traffic_used_bytes || 0));
+    
+    if (availableTraffic <= 0) continue;
+    
+    // 消耗该权益的流量
+    const consumeAmount = Math.min(remainingTraffic, availableTraffic);
+    await conn.query(
+      'UPDATE user_entitlements SET traffic_used_bytes = traffic_used_bytes + ? WHERE id = ?',
+      [consumeAmount, e.id]
+    );
+    
+    remainingTraffic -= consumeAmount;
+    
+    // 检查是否已耗尽，如果是则更新状态为 exhausted
+    if (e.traffic_total_bytes >= 0) {
+      const [updated] = await conn.query(
+        `SELECT traffic_used_bytes, traffic_total_bytes 
+         FROM user_entitlements 
+         WHERE id = ?`,
+        [e.id]
+      );
+      if (updated.length > 0 && updated[0].traffic_used_bytes >= updated[0].traffic_total_bytes) {
+        await conn.query(
+          'UPDATE user_entitlements SET status = ? WHERE id = ?',
+          ['exhausted', e.id]
+        );
+      }
+    }
+  }
+
+  // 2) 累加节点每日流量
+  await conn.query(
+    `INSERT INTO node_traffic (node_id, date, upload, download, connections)
+     VALUES (?, DATE(FROM_UNIXTIME(?)), ?, ?, 1)
+     ON DUPLICATE KEY UPDATE
+       upload = upload + VALUES(upload),
+       download = download + VALUES(download),
+       connections = connections + 1`,
+    [nodeId, ts, Math.max(0, upload), Math.max(0, download)]
+  );
+
+  // 3) 记录用户分钟级流量（按 ts 所在分钟聚合）
+  //    分钟起始时间：FROM_UNIXTIME(FLOOR(ts/60)*60)
+  await conn.query(
+    `INSERT INTO user_traffic_minute (user_id, ts_minute, upload, download)
+     VALUES (?, FROM_UNIXTIME(FLOOR(?/60)*60), ?, ?)
+     ON DUPLICATE KEY UPDATE
+       upload = upload + VALUES(upload),
+       download = download + VALUES(download)`,
+    [userId, ts, Math.max(0, upload), Math.max(0, download)]
+  );
+
+  return { status: 200, message: 'success' };
+}
+
 // POST /api/internal/report-traffic
-// body: { uuid, node_id, upload, download }
+// body: { uuid, node_id, upload, download, ts?, report_id? }
 // 说明：
 // - 节点侧建议每 60 秒上报一次“增量流量”（该分钟内的 upload/download 字节数）
+// - ts：可选，增量产生时间（unix 秒），用于补报；缺省为当前时间
+// - report_id：可选，幂等键；同一 report_id 重复上报时不再记账，返回 message=duplicate
 // - 面板会：
 //   1) 累加到 users.traffic_used
 //   2) 写入 node_traffic（按天聚合）
 //   3) 写入 user_traffic_minute（按分钟聚合，供总览图表/近24小时查询使用）
 router.post('/report-traffic', requireInternalToken, async (req, res, next) => {
   try {
-    const uuid = (req.body.uuid || '').trim();
-    const nodeId = req.body.node_id ? Number(req.body.node_id) : null;
-    const upload = Number(req.body.upload || 0);
-    const download = Number(req.body.download || 0);
-    const total = Math.max(0, upload) + Math.max(0, download);
+    const result = await applyTrafficReport(req.body || {});
+    if (result.status !== 200) {
+      return res.status(result.status).json({ code: result.status, message: result.message, data: null });
+    }
+    res.json({ code: 200, message: result.message, data: null });
+  } catch (err) {
+    next(err);
+  }
+});
 
-    if (!uuid || !nodeId) {
-      return res.status(400).json({ code: 400, message: 'uuid and node_id required', data: null });
+// POST /api/internal/report-traffic/bulk
+// body: { report_id, node_id, window_start, window_end, items: [{ uuid, upload, download, ts?, report_id? }] }
+// 说明：
+// - 一个请求携带某节点一个时间窗口内的全部增量，替代逐 UUID 的单条上报（数千用户时单条上报会压垮后端）
+// - 条目未带 ts 时按 window_end 记账
+// - 条目的 report_id 为幂等键：重试整批时已记过账的条目计入 duplicates，不会重复扣流量
+// - 单条被拒绝（uuid 不存在、无可用权益等）不影响其它条目，结果在 rejected 中返回
+const BULK_REPORT_MAX_ITEMS = 5000;
+router.post('/report-traffic/bulk', requireInternalToken, async (req, res, next) => {
+  try {
+    const { report_id, node_id, window_start, window_end, items } = req.body || {};
+    const nodeId = Number(node_id);
+    if (!nodeId || !Array.isArray(items)) {
+      return res.status(400).json({ code: 400, message: 'node_id and items required', data: null });
     }
-    if (!Number.isFinite(total) || total <= 0) {
-      return res.status(400).json({ code: 400, message: 'upload/download invalid', data: null });
+    if (items.length > BULK_REPORT_MAX_ITEMS) {
+      return res.status(413).json({ code: 413, message: `too many items (max ${BULK_REPORT_MAX_ITEMS})`, data: null });
     }
 
-    const [rows] = await pool.query(
-      'SELECT user_id FROM user_clients WHERE uuid = ? AND enabled = 1 LIMIT 1',
-      [uuid]
-    );
-    if (rows.length === 0) {
-      return res.status(404).json({ code: 404, message: 'uuid not found', data: null });
+    let accepted = 0;
+    let duplicates = 0;
+    const rejected = [];
+    for (const it of items) {
+      const result = await applyTrafficReport({
+        uuid: it?.uuid,
+        node_id: nodeId,
+        upload: it?.upload,
+        download: it?.download,
+        ts: it?.ts ?? window_end,
+        report_id: it?.report_id
+      });
+      if (result.status === 200) {
+        accepted += 1;
+        if (result.message === 'duplicate') duplicates += 1;
+      } else {
+        rejected.push({ uuid: it?.uuid || '', status: result.status, message: result.message });
+      }
     }
 
-    const userId = rows[0].user_id;
-
-    // 1) 累加用户已用流量（用于统计）
-    await pool.query(
-      'UPDATE users SET traffic_used = traffic_used + ? WHERE id = ?',
-      [total, userId]
-    );
+    res.json({
+      code: 200,
+      message: 'success',
+      data: {
+        report_id: report_id || null,
+        node_id: nodeId,
+        window_start: window_start ?? null,
+        window_end: window_end ?? null,
+        accepted,
+        duplicates,
+        rejected
+      }
+    });
+  } catch (err) {
+    next(err);
+  }
+});
 
-    // 1.1) 按策略分摊流量到 entitlements（仅扣“当前节点允许的权益”，优先消耗最早 service_expire_at）
-    const [entitlementRows] = await pool.query(
-      `SELECT e.id, e.plan_id, e.traffic_total_bytes, e.traffic_used_bytes, e.service_expire_at
-       FROM user_entitlements e
-       JOIN plan_nodes pn ON pn.plan_id = e.plan_id AND pn.node_id = ?
-       WHERE e.user_id = ? AND e.status = 'active'
-         AND e.service_expire_at > NOW()
-         AND (e.traffic_total_bytes < 0 OR e.traffic_used_bytes < e.traffic_total_bytes)
-       ORDER BY e.service_expire_at ASC, e.id ASC`,
-      [nodeId, userId]
-    );
+// POST /api/internal/report-online
+// body: { node_id, ts?, users: [{ uuid, ips: [{ ip, last_seen? }] }] }
+// 说明：
+// - connector 定期上报该节点当前在线的用户及来源 IP（来自 Xray 在线统计），每次都是全量快照
+// - 面板据此维护 node_connections：新出现的 (用户, IP) 插入 active 记录；快照中已不存在的 active 记录置为 closed 并写 end_time
+// - users 为空数组表示该节点当前无人在线（会关闭该节点全部 active 记录）
+const ONLINE_REPORT_MAX_USERS = 10000;
+router.post('/report-online', requireInternalToken, async (req, res, next) => {
+  const { node_id, users } = req.body || {};
+  const nodeId = Number(node_id);
+  if (!nodeId || !Array.isArray(users)) {
+    return res.status(400).json({ code: 400, message: 'node_id and users required', data: null });
+  }
+  if (users.length > ONLINE_REPORT_MAX_USERS) {
+    return res.status(413).json({ code: 413, message: `too many users (max ${ONLINE_REPORT_MAX_USERS})`, data: null });
+  }
 
-    if (entitlementRows.length === 0) {
-      // 没有任何可用于该节点的权益：直接拒绝（避免把流量扣到其他套餐上）
-      return res.status(403).json({ code: 403, message: 'no_entitlement_for_node', data: null });
-    }
-
-    let remainingTraffic = total;
-    for (const e of entitlementRows) {
-      if (remainingTraffic <= 0) break;
-      
-      // 计算该权益的可用流量
-      const availableTraffic = e.traffic_total_bytes < 0 
-        ? Number.MAX_SAFE_INTEGER 
-        : Math.max(0, Number(e.traffic_total_bytes || 0) - Number(e.traffic_used_bytes || 0));
-      
-      if (availableTraffic <= 0) continue;
-      
-      // 消耗该权益的流量
-      const consumeAmount = Math.min(remainingTraffic, availableTraffic);
-      await pool.query(
-        'UPDATE user_entitlements SET traffic_used_bytes = traffic_used_bytes + ? WHERE id = ?',
-        [consumeAmount, e.id]
+  const connection = await pool.getConnection();
+  try {
+    // uuid -> user_id
+    const uuids = [...new Set(users.map((u) => String(u?.uuid || '').trim()).filter(Boolean))];
+    const userIdByUuid = new Map();
+    if (uuids.length > 0) {
+      const [rows] = await connection.query(
+        'SELECT uuid, user_id FROM user_clients WHERE uuid IN (?) AND enabled = 1',
+        [uuids]
       );
-      
-      remainingTraffic -= consumeAmount;
-      
-      // 检查是否已耗尽，如果是则更新状态为 exhausted
-      if (e.traffic_total_bytes >= 0) {
-        const [updated] = await pool.query(
-          `SELECT traffic_used_bytes, traffic_total_bytes 
-           FROM user_entitlements 
-           WHERE id = ?`,
-          [e.id]
-        );
-        if (updated.length > 0 && updated[0].traffic_used_bytes >= updated[0].traffic_total_bytes) {
-          await pool.query(
-            'UPDATE user_entitlements SET status = ? WHERE id = ?',
-            ['exhausted', e.id]
-          );
-        }
+      for (const r of rows) userIdByUuid.set(r.uuid, r.user_id);
+    }
+
+    // 本次快照中的 (user_id, ip)
+    const current = new Map();
+    let unknown = 0;
+    for (const u of users) {
+      const userId = userIdByUuid.get(String(u?.uuid || '').trim());
+      if (!userId) {
+        unknown += 1;
+        continue;
+      }
+      for (const item of Array.isArray(u.ips) ? u.ips : []) {
+        const ip = String(item?.ip || '').trim().slice(0, 45);
+        if (!ip) continue;
+        current.set(`${userId}|${ip}`, { userId, ip });
       }
     }
 
-    // 2) 累加节点每日流量
-    await pool.query(
-      `INSERT INTO node_traffic (node_id, date, upload, download, connections)
-       VALUES (?, CURDATE(), ?, ?, 1)
-       ON DUPLICATE KEY UPDATE
-         upload = upload + VALUES(upload),
-         download = download + VALUES(download),
-         connections = connections + 1`,
-      [nodeId, Math.max(0, upload), Math.max(0, download)]
-    );
+    await connection.beginTransaction();
 
-    // 3) 记录用户分钟级流量（按当前时间所在分钟聚合）
-    //    使用 MySQL 计算当前分钟起始时间：FROM_UNIXTIME(FLOOR(UNIX_TIMESTAMP()/60)*60)
-    await pool.query(
-      `INSERT INTO user_traffic_minute (user_id, ts_minute, upload, download)
-       VALUES (?, FROM_UNIXTIME(FLOOR(UNIX_TIMESTAMP()/60)*60), ?, ?)
-       ON DUPLICATE KEY UPDATE
-         upload = upload + VALUES(upload),
-         download = download + VALUES(download)`,
-      [userId, Math.max(0, upload), Math.max(0, download)]
+    const [activeRows] = await connection.query(
+      `SELECT id, user_id, ip FROM node_connections
+       WHERE node_id = ? AND status = 'active'
+       FOR UPDATE`,
+      [nodeId]
     );
 
-    res.json({ code: 200, message: 'success', data: null });
+    const closeIds = [];
+    for (const r of activeRows) {
+      const key = `${r.user_id}|${r.ip}`;
+      if (current.has(key)) {
+        current.delete(key);
+      } else {
+        closeIds.push(r.id);
+      }
+    }
+
+    if (closeIds.length > 0) {
+      await connection.query(
+        `UPDATE node_connections SET status = 'closed', end_time = NOW() WHERE id IN (?)`,
+        [closeIds]
+      );
+    }
+    const opened = [...current.values()];
+    if (opened.length > 0) {
+      await connection.query(
+        'INSERT INTO node_connections (user_id, node_id, ip, start_time, status) VALUES ?',
+        [opened.map((o) => [o.userId, nodeId, o.ip, new Date(), 'active'])]
+      );
+    }
+
+    await connection.commit();
+
+    res.json({
+      code: 200,
+      message: 'success',
+      data: {
+        node_id: nodeId,
+        online_users: users.length - unknown,
+        opened: opened.length,
+        closed: closeIds.length,
+        unknown
+      }
+    });
+  } catch (err) {
+    await connection.rollback();
+    next(err);
+  } finally {
+    connection.release();
+  }
+});
+
+// POST /api/internal/heartbeat
+// body: {
+//   connector_version, apply_mode, ts,
+//   host: { uptime, load1, load5, load15, cpu_percent, mem_total, mem_available, net_rx_bytes, net_tx_bytes, net_rx_rate, net_tx_rate },
+//   xray?: { version, uptime, mem_alloc, mem_sys, num_goroutine, error? },
+//   nodes: [{ node_id, applied_users, xray?, last_sync_at?, last_sync_error?, last_report_at?, last_report_error? }]
+// }
+// 说明：
+// - connector 定期上报运行状态，面板按节点覆盖写 node_status（last_heartbeat_at 用面板时间）
+// - 一个 connector 管多个节点时，主机信息对这些节点相同；Xray 信息优先取节点自己的 nodes[].xray
+//   （节点可在不同的 Xray 上），旧版 connector 没有时用顶层 xray
+// - 未知 node_id 直接忽略
+let nodeStatusTableMissingWarned = false;
+router.post('/heartbeat', requireInternalToken, async (req, res, next) => {
+  const body = req.body || {};
+  const nodes = Array.isArray(body.nodes) ? body.nodes : [];
+  if (nodes.length === 0) {
+    return res.status(400).json({ code: 400, message: 'nodes required', data: null });
+  }
+
+  const num = (v) => (v === undefined || v === null || v === '' || !Number.isFinite(Number(v)) ? null : Number(v));
+  const str = (v, max) => (v ? String(v).slice(0, max) : null);
+  const unixToDate = (v) => (num(v) > 0 ? new Date(num(v) * 1000) : null);
+
+  const host = body.host || {};
+
+  try {
+    const nodeIds = [...new Set(nodes.map((n) => Number(n?.node_id)).filter(Boolean))];
+    const [rows] = nodeIds.length
+      ? await pool.query('SELECT id FROM nodes WHERE id IN (?)', [nodeIds])
+      : [[]];
+    const known = new Set(rows.map((r) => r.id));
+
+    let stored = 0;
+    for (const n of nodes) {
+      const nodeId = Number(n?.node_id);
+      if (!known.has(nodeId)) continue;
+      const xray = n.xray || body.xray || {};
+      const detail = JSON.stringify({
+        connector_version: body.connector_version || null,
+        apply_mode: body.apply_mode || null,
+        ts: body.ts || null,
+        host,
+        xray: n.xray || body.xray || null,
+        node: n
+      });
+      await pool.query(
+        `INSERT INTO node_status
+           (node_id, connector_version, apply_mode, xray_version, xray_uptime, xray_mem_bytes,
+            load1, cpu_percent, mem_total, mem_available, net_rx_bytes, net_tx_bytes,
+            applied_users, last_sync_at, last_sync_error, last_report_error, detail, last_heartbeat_at)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+         ON DUPLICATE KEY UPDATE
+           connector_version = VALUES(connector_version),
+           apply_mode = VALUES(apply_mode),
+           xray_version = VALUES(xray_version),
+           xray_uptime = VALUES(xray_uptime),
+           xray_mem_bytes = VALUES(xray_mem_bytes),
+           load1 = VALUES(load1),
+           cpu_percent = VALUES(cpu_percent),
+           mem_total = VALUES(mem_total),
+           mem_available = VALUES(mem_available),
+           net_rx_bytes = VALUES(net_rx_bytes),
+           net_tx_bytes = VALUES(net_tx_bytes),
+           applied_users = VALUES(applied_users),
+           last_sync_at = VALUES(last_sync_at),
+           last_sync_error = VALUES(last_sync_error),
+           last_report_error = VALUES(last_report_error),
+           detail = VALUES(detail),
+           last_heartbeat_at = NOW()`,
+        [
+          nodeId,
+          str(body.connector_version, 50),
+          str(body.apply_mode, 20),
+          str(xray.version, 50),
+          num(xray.uptime),
+          num(xray.mem_sys),
+          num(host.load1),
+          num(host.cpu_percent),
+          num(host.mem_total),
+          num(host.mem_available),
+          num(host.net_rx_bytes),
+          num(host.net_tx_bytes),
+          num(n.applied_users) || 0,
+          unixToDate(n.last_sync_at),
+          str(n.last_sync_error, 500),
+          str(n.last_report_error, 500),
+          detail
+        ]
+      );
+      stored += 1;
+    }
+
+    res.json({
+      code: 200,
+      message: 'success',
+      data: { stored, unknown: nodes.length - stored }
+    });
   } catch (err) {
+    if (err && err.code === 'ER_NO_SUCH_TABLE') {
+      if (!nodeStatusTableMissingWarned) {
+        nodeStatusTableMissingWarned = true;
+        console.warn('[internal] node_status 表不存在，心跳不会保存，请执行 db_example_basic.sql 中的建表语句');
+      }
+      return res.json({ code: 200, message: 'node_status table missing', data: { stored: 0, unknown: 0 } });
+    }
     next(err);
   }
 });
@@ -423,9 +1043,44 @@ router.get('/user-traffic', requireInternalToken, async (req, res, next) => {
   }
 });
 
+// 解析 nodes.config（TEXT 中的 JSON），不是对象时返回 null
+function parseNodeConfig(raw) {
+  if (raw && typeof raw === 'object') return raw;
+  try {
+    const config = JSON.parse(raw || '{}');
+    return config && typeof config === 'object' && !Array.isArray(config) ? config : null;
+  } catch (e) {
+    return null;
+  }
+}
+
+// 重新注册时合并 config：提交的键覆盖原值、值为 null 的键删除，其余（管理员补充的字段）保留；
+// 分配信息 host_id / inbound_tag 已有时以面板为准
+function mergeNodeConfig(existingRaw, posted) {
+  if (!posted || typeof posted !== 'object' || Array.isArray(posted)) {
+    return posted;
+  }
+  const existing = parseNodeConfig(existingRaw) || {};
+  const merged = { ...existing };
+  for (const [key, value] of Object.entries(posted)) {
+    if ((key === 'host_id' || key === 'inbound_tag') && existing[key]) continue;
+    if (value === null) {
+      delete merged[key];
+    } else {
+      merged[key] = value;
+    }
+  }
+  return merged;
+}
+
 // POST /api/internal/register-node
-// 供“一键开局脚本”注册节点到面板（无需登录后台，只需 internal token）
-// body: { name, address, port, protocol, config, status?, sort_order?, plan_ids? }
+// 供“一键开局脚本”与 connector register 注册节点到面板（无需登录后台，只需 internal token）
+// body: { name, address, port, protocol, config, status?, sort_order?, plan_ids?, merge? }
+// 已有节点：config 带 host_id 与 inbound_tag 时按这两项匹配（公网 IP 变化不会生成重复节点），否则按 address + port + protocol 匹配
+// 已有节点更新时默认覆盖名称与 config（一键脚本的原有行为）；merge: true（connector register）时保留名称
+// （管理员改过的名称不会被覆盖），config 与原值合并（见 mergeNodeConfig）
+// 不传 status / sort_order 则保留原值（管理员禁用的节点不会因重新注册被启用）
+// 返回 { id, created, inbound_tag }：inbound_tag 为节点最终生效的值（合并时可能保留了面板原有的 tag）
 router.post('/register-node', requireInternalToken, async (req, res, next) => {
   const connection = await pool.getConnection();
   try {
@@ -435,9 +1090,10 @@ router.post('/register-node', requireInternalToken, async (req, res, next) => {
       port,
       protocol,
       config,
-      status = 1,
-      sort_order = 0,
-      plan_ids
+      status,
+      sort_order,
+      plan_ids,
+      merge
     } = req.body || {};
 
     if (!name || !address || !port || !protocol || config === undefined) {
@@ -459,32 +1115,52 @@ router.post('/register-node', requireInternalToken, async (req, res, next) => {
       });
     }
 
-    const configStr = typeof config === 'string' ? config : JSON.stringify(config);
+    const postedConfig = typeof config === 'string' ? parseNodeConfig(config) || config : config;
+    const hostId = postedConfig && typeof postedConfig === 'object' ? String(postedConfig.host_id || '').trim() : '';
+    const inboundTag = postedConfig && typeof postedConfig === 'object' ? String(postedConfig.inbound_tag || '').trim() : '';
 
     await connection.beginTransaction();
 
-    // 简单幂等：address + port + protocol 相同则视为同一节点，进行更新
-    const [existing] = await connection.query(
-      'SELECT id FROM nodes WHERE address = ? AND port = ? AND protocol = ? LIMIT 1',
-      [address, portNum, protocol]
-    );
+    // 幂等：同一主机的同一 inbound（host_id + inbound_tag）视为同一节点，地址、端口变化时一并更新
+    let existing = [];
+    if (hostId && inboundTag) {
+      const [rows] = await connection.query('SELECT id, config FROM nodes ORDER BY id ASC');
+      existing = rows.filter((r) => {
+        const c = parseNodeConfig(r.config);
+        return c && String(c.host_id || '').trim() === hostId && String(c.inbound_tag || '').trim() === inboundTag;
+      });
+    }
+    // 否则 address + port + protocol 相同则视为同一节点
+    if (existing.length === 0) {
+      [existing] = await connection.query(
+        'SELECT id, config FROM nodes WHERE address = ? AND port = ? AND protocol = ? LIMIT 1',
+        [address, portNum, protocol]
+      );
+    }
 
     let nodeId;
     let created = false;
+    let finalConfig;
     if (existing.length > 0) {
       nodeId = existing[0].id;
+      // 不合并时按空的原值处理：整体替换，只去掉值为 null 的键
+      finalConfig = mergeNodeConfig(merge === true ? existing[0].config : null, postedConfig);
+      const configStr = typeof finalConfig === 'string' ? finalConfig : JSON.stringify(finalConfig);
       await connection.query(
         `UPDATE nodes
-         SET name = ?, config = ?, status = ?, sort_order = ?, updated_at = NOW()
+         SET name = COALESCE(?, name), address = ?, port = ?, protocol = ?, config = ?,
+             status = COALESCE(?, status), sort_order = COALESCE(?, sort_order), updated_at = NOW()
          WHERE id = ?`,
-        [name, configStr, status, sort_order, nodeId]
+        [merge === true ? null : name, address, portNum, protocol, configStr, status ?? null, sort_order ?? null, nodeId]
       );
     } else {
+      finalConfig = mergeNodeConfig(null, postedConfig); // 去掉值为 null 的键
+      const configStr = typeof finalConfig === 'string' ? finalConfig : JSON.stringify(finalConfig);
       const [result] = await connection.query(
         `INSERT INTO nodes
            (name, address, port, protocol, config, status, sort_order, created_at)
          VALUES (?, ?, ?, ?, ?, ?, ?, NOW())`,
-        [name, address, portNum, protocol, configStr, status, sort_order]
+        [name, address, portNum, protocol, configStr, status ?? 1, sort_order ?? 0]
       );
       nodeId = result.insertId;
       created = true;
@@ -505,13 +1181,15 @@ router.post('/register-node', requireInternalToken, async (req, res, next) => {
 
     await connection.commit();
     connection.release();
+    nodeEvents.publishNodesChanged({ reason: 'register-node', nodeId });
 
     res.json({
       code: 200,
       message: 'success',
       data: {
         id: nodeId,
-        created
+        created,
+        inbound_tag: String(parseNodeConfig(finalConfig)?.inbound_tag || '')
       }
     });
   } catch (err) {
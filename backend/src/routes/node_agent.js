@@ -242,7 +242,8 @@ router.post('/node-agent/push-uuids', async (req, res, next) => {
           'Content-Type': 'application/json',
           'x-agent-token': agent_token
         },
-        body: JSON.stringify({ uuids })
+        // node_id：connector 推送接口据此选择节点（node-agent.py 忽略该字段）
+        body: JSON.stringify({ uuids, node_id: nodeId })
       });
       text = await r.text();
       if (!r.ok) {
@@ -390,6 +390,20 @@ router.get('/:token', async (req, res, next) => {
   }
 });
 
+// 计算 Shadowsocks 每用户密码（与 connector/shadowsocks.go 的派生规则保持一致）
+function ssUserPassword(config, userUuid) {
+  const method = String(config.method || 'aes-256-gcm').toLowerCase();
+  if (!userUuid) return config.password || '';
+  let keyLen = 0;
+  if (method === '2022-blake3-aes-128-gcm') keyLen = 16;
+  else if (method === '2022-blake3-aes-256-gcm' || method === '2022-blake3-chacha20-poly1305') keyLen = 32;
+  if (keyLen > 0) {
+    const userKey = crypto.createHash('sha256').update(userUuid.trim()).digest().subarray(0, keyLen).toString('base64');
+    return config.password ? `${config.password}:${userKey}` : userKey;
+  }
+  return config.multi_user ? userUuid : (config.password || '');
+}
+
 // 生成 Clash 配置
 function generateClashConfig(nodes, userUuid) {
   const proxies = [];
@@ -445,7 +459,7 @@ function generateClashConfig(nodes, userUuid) {
             server: node.address,
             port: node.port,
             cipher: config.method || 'aes-256-gcm',
-            password: config.password || ''
+            password: ssUserPassword(config, userUuid)
           });
           break;
         case 'trojan':
@@ -607,7 +621,7 @@ function generateV2RayConfig(nodes, userUuid) {
           link = vlessLink;
           break;
         case 'shadowsocks':
-          const ssStr = `${config.method || 'aes-256-gcm'}:${config.password || ''}@${node.address}:${node.port}`;
+          const ssStr = `${config.method || 'aes-256-gcm'}:${ssUserPassword(config, userUuid)}@${node.address}:${node.port}`;
           const ssBase64 = Buffer.from(ssStr).toString('base64');
           link = `ss://${ssBase64}#${encodeURIComponent(node.name || '')}`;
           break;
@@ -704,7 +718,7 @@ function generateSingBoxConfig(nodes, userUuid) {
             server: node.address,
             server_port: node.port,
             method: config.method || 'aes-256-gcm',
-            password: config.password || ''
+            password: ssUserPassword(config, userUuid)
           });
           break;
         case 'trojan':
@@ -781,10 +795,10 @@ function generateSurgeConfig(nodes, userUuid) {
           lines.push(`VMess = ${node.address}, ${node.port}, username=${userUuid || config.id || config.v || ''}, ${name}`);
           break;
         case 'shadowsocks':
-          lines.push(`SS = ${node.address}, ${node.port}, encrypt-method=${config.method || 'aes-256-gcm'}, password=${config.password || ''}, ${name}`);
+          lines.push(`SS = ${node.address}, ${node.port}, encrypt-method=${config.method || 'aes-256-gcm'}, password=${ssUserPassword(config, userUuid)}, ${name}`);
           break;
         case 'trojan':
-          lines.push(`Trojan = ${node.address}, ${node.port}, password=${config.password || ''}${config.sni ? `, sni=${config.sni}` : ''}, ${name}`);
+          lines.push(`Trojan = ${node.address}, ${node.port}, password=${userUuid || config.password || ''}${config.sni ? `, sni=${config.sni}` : ''}, ${name}`);
           break;
       }
     } catch (e) {
@@ -828,12 +842,12 @@ function generateQuantumultConfig(nodes, userUuid) {
           lines.push(`vmess://${vmessStr}`);
           break;
         case 'shadowsocks':
-          const ssStr = `${config.method || 'aes-256-gcm'}:${config.password || ''}@${node.address}:${node.port}`;
+          const ssStr = `${config.method || 'aes-256-gcm'}:${ssUserPassword(config, userUuid)}@${node.address}:${node.port}`;
           const ssBase64 = Buffer.from(ssStr).toString('base64');
           lines.push(`ss://${ssBase64}#${encodeURIComponent(name)}`);
           break;
         case 'trojan':
-          lines.push(`trojan://${config.password || ''}@${node.address}:${node.port}?sni=${config.sni || node.address}#${encodeURIComponent(name)}`);
+          lines.push(`trojan://${userUuid || config.password || ''}@${node.address}:${node.port}?sni=${config.sni || node.address}#${encodeURIComponent(name)}`);
           break;
       }
     } catch (e) {
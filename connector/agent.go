@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 推送接口（可选，AGENT_LISTEN 非空时开启）：
+// 与 oneclick/node-agent.py 的协议兼容，面板「节点 agent」的导入 / 推送 UUID 可以直接对接 connector：
+//   GET  /health          无需鉴权，{"ok": true}
+//   GET  /v1/node-info    返回 {public_ip, nodes:[...]}，供面板导入节点
+//   POST /v1/apply-users  body {uuids, users?, node_id?}，立即按推送的列表下发
+// 鉴权头 x-agent-token（AGENT_TOKEN，兼容 NODE_AGENT_TOKEN）。
+// 推送的列表交给主循环，走与 syncOnce 相同的 diff / 下发流程（不再向面板拉取），
+// 封禁在管理员点击后立即生效；之后的定期同步照常以面板为准。
+
+// agentPush 一次推送（由 HTTP 处理协程交给主循环执行）
+type agentPush struct {
+	nodeID int
+	uuids  []string
+	users  []allowedUser
+	done   chan error
+}
+
+// agentApplyRequest /v1/apply-users 请求体
+type agentApplyRequest struct {
+	UUIDs  []string      `json:"uuids"`
+	Users  []allowedUser `json:"users"`   // 可选：每用户限制（node-agent.py 协议没有该字段）
+	NodeID int           `json:"node_id"` // 可选：connector 只管一个节点时可省略
+}
+
+// startAgentServer 启动推送接口；ctx 结束时关闭
+func startAgentServer(ctx context.Context, cfg config, pushC chan<- agentPush) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeAgentJSON(w, 200, map[string]any{"ok": true})
+	})
+	mux.HandleFunc("/v1/node-info", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAgentToken(w, r, cfg.AgentToken) {
+			return
+		}
+		info, err := agentNodeInfo(r.Context(), cfg)
+		if err != nil {
+			writeAgentJSON(w, 500, map[string]any{"error": err.Error()})
+			return
+		}
+		writeAgentJSON(w, 200, info)
+	})
+	mux.HandleFunc("/v1/apply-users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAgentToken(w, r, cfg.AgentToken) {
+			return
+		}
+		handleAgentApply(w, r, cfg, pushC)
+	})
+
+	srv := &http.Server{Addr: cfg.AgentListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		fmt.Printf("[INFO] agent listening on %s\n", cfg.AgentListen)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "[WARN] agent listener failed: %v\n", err)
+		}
+	}()
+}
+
+func requireAgentToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		http.Error(w, "AGENT_TOKEN not set", http.StatusInternalServerError)
+		return false
+	}
+	got := strings.TrimSpace(r.Header.Get("x-agent-token"))
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, v any) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func handleAgentApply(w http.ResponseWriter, r *http.Request, cfg config, pushC chan<- agentPush) {
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 32<<20))
+	if err != nil {
+		writeAgentJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	var req agentApplyRequest
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := json.Unmarshal(raw, &req); err != nil {
+			writeAgentJSON(w, 400, map[string]any{"error": "invalid json: " + err.Error()})
+			return
+		}
+	}
+	if req.UUIDs == nil {
+		writeAgentJSON(w, 400, map[string]any{"error": "uuids must be list"})
+		return
+	}
+
+	nodeID := req.NodeID
+	if nodeID == 0 {
+		if len(cfg.NodeIDs) != 1 {
+			writeAgentJSON(w, 400, map[string]any{"error": "node_id required (connector manages multiple nodes)"})
+			return
+		}
+		nodeID = cfg.NodeIDs[0]
+	}
+	// 是否本机节点由主循环按当前配置判断（配置重新加载、面板重新分配后节点列表会变）
+
+	p := agentPush{nodeID: nodeID, uuids: req.UUIDs, users: req.Users, done: make(chan error, 1)}
+	select {
+	case pushC <- p:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case err := <-p.done:
+		if err != nil {
+			writeAgentJSON(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+	case <-r.Context().Done():
+		return
+	}
+	writeAgentJSON(w, 200, map[string]any{"applied": len(req.UUIDs), "node_id": nodeID})
+}
+
+// applyAgentPush 在主循环中执行推送：构造允许列表后走 syncNodes 的下发流程；
+// 与面板拉取的列表一样经过批量移除保护，推送空列表（"uuids": []）不会直接清空节点
+func applyAgentPush(ctx context.Context, cfg config, st *syncState, p agentPush) error {
+	if !containsInt(cfg.NodeIDs, p.nodeID) {
+		return fmt.Errorf("node %d is not managed by this connector", p.nodeID)
+	}
+	al := newAllowedList(0, "", p.uuids, p.users)
+	// node-agent.py 协议只有 uuids：沿用上次拉取到的每用户限制，避免设备数限制 / 本地限额被清空
+	if len(p.users) == 0 {
+		if prev := st.allowedFor(p.nodeID); prev != nil {
+			for u := range al.uuids {
+				if v, ok := prev.users[u]; ok {
+					al.users[u] = v
+				}
+			}
+		}
+	}
+	fmt.Printf("[INFO] node %d received pushed uuids=%d via agent\n", p.nodeID, len(al.sorted))
+	return syncNodes(ctx, cfg, st, []int{p.nodeID}, map[int]*allowedList{p.nodeID: al})
+}
+
+// agentNodeInfo 返回供面板导入的节点信息：
+// 优先读取 AGENT_NODE_INFO_FILE（一键脚本写的 node.json，单个节点对象或 {public_ip, nodes}），
+// 否则在 singbox 模式下按 sing-box 配置的 inbounds 推导（与 node-agent.py 相同，每个协议/端口一条）
+func agentNodeInfo(ctx context.Context, cfg config) (map[string]any, error) {
+	if cfg.AgentNodeInfoFile != "" {
+		raw, err := os.ReadFile(cfg.AgentNodeInfoFile)
+		if err != nil {
+			return nil, err
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("decode %s failed: %w", cfg.AgentNodeInfoFile, err)
+		}
+		if _, ok := doc["nodes"]; ok {
+			return doc, nil
+		}
+		publicIP, _ := doc["address"].(string)
+		return map[string]any{"public_ip": publicIP, "nodes": []any{doc}}, nil
+	}
+	if cfg.ApplyMode != "singbox" {
+		return nil, errors.New("node info unavailable: set AGENT_NODE_INFO_FILE")
+	}
+
+	publicIP := detectPublicIP(ctx, cfg.NodePublicIP)
+	records, err := singboxNodeRecords(cfg, publicIP)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]any, 0, len(records))
+	for _, rec := range records {
+		rec.Config["managed"] = map[string]any{"provider": "node-agent", "mode": "push-users"}
+		nodes = append(nodes, map[string]any{
+			"name":       rec.Name,
+			"address":    rec.Address,
+			"port":       rec.Port,
+			"protocol":   rec.Protocol,
+			"config":     rec.Config,
+			"status":     1,
+			"sort_order": 0,
+		})
+	}
+	return map[string]any{"public_ip": publicIP, "nodes": nodes}, nil
+}
+
+// singboxNodeRecords 按 sing-box 配置的 inbounds 生成节点记录（与 node-agent.py 相同，每个协议/端口一条）
+func singboxNodeRecords(cfg config, publicIP string) ([]nodeRecord, error) {
+	raw, err := os.ReadFile(cfg.SingboxConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Inbounds []map[string]any `json:"inbounds"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("decode sing-box config failed: %w", err)
+	}
+
+	records := make([]nodeRecord, 0, len(doc.Inbounds))
+	for _, inbound := range doc.Inbounds {
+		typ, _ := inbound["type"].(string)
+		port, _ := inbound["listen_port"].(float64)
+		if typ == "" || port == 0 {
+			continue
+		}
+		switch typ {
+		case "vless", "vmess", "trojan", "hysteria2", "socks", "shadowsocks":
+		default:
+			continue
+		}
+		tag, _ := inbound["tag"].(string)
+		if tag == "" {
+			tag = typ
+		}
+
+		nodeCfg := map[string]any{}
+		switch typ {
+		case "vless":
+			tls, _ := inbound["tls"].(map[string]any)
+			reality, _ := tls["reality"].(map[string]any)
+			handshake, _ := reality["handshake"].(map[string]any)
+			sni, _ := handshake["server"].(string)
+			shortID := ""
+			if ids, ok := reality["short_id"].([]any); ok && len(ids) > 0 {
+				shortID, _ = ids[0].(string)
+			}
+			publicKey := os.Getenv("REALITY_PUBLIC_KEY")
+			if publicKey == "" {
+				privateKey, _ := reality["private_key"].(string)
+				publicKey = realityPublicKey(privateKey)
+			}
+			nodeCfg["security"] = "reality"
+			nodeCfg["sni"] = sni
+			nodeCfg["publicKey"] = publicKey
+			nodeCfg["shortId"] = shortID
+			nodeCfg["flow"] = cfg.XrayVlessFlow
+			nodeCfg["encryption"] = "none"
+		case "vmess", "trojan":
+			nodeCfg["tls"] = "tls"
+			nodeCfg["sni"] = publicIP
+			nodeCfg["insecure"] = true
+		case "hysteria2":
+			nodeCfg["sni"] = publicIP
+			nodeCfg["alpn"] = []string{"h3"}
+			nodeCfg["insecure"] = true
+		}
+
+		records = append(records, nodeRecord{
+			Tag:      tag,
+			Name:     fmt.Sprintf("%s %s %s", cfg.NodeName, typ, tag),
+			Address:  publicIP,
+			Port:     int(port),
+			Protocol: typ,
+			Config:   nodeCfg,
+		})
+	}
+	return records, nil
+}
+
+// detectPublicIP 节点公网地址：NODE_PUBLIC_IP，未设置时查询 api.ipify.org
+func detectPublicIP(ctx context.Context, configured string) string {
+	if ip := strings.TrimSpace(configured); ip != "" {
+		return ip
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.ipify.org", nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	return strings.TrimSpace(string(b))
+}
+
+// realityPublicKey 由 REALITY 私钥（base64url，无填充）推导公钥，失败时返回空
+func realityPublicKey(privateKey string) string {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil {
+		return ""
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// node-agent.py 协议推送空列表（"uuids": []）也要经过批量移除保护，不能直接清空节点
+func TestAgentPushEmptyListGuarded(t *testing.T) {
+	cfg := config{
+		ApplyMode:                "none",
+		OutputDir:                t.TempDir(),
+		NodeIDs:                  []int{1},
+		SyncWorkers:              1,
+		MassRemovalMaxPercent:    50,
+		MassRemovalMinUsers:      10,
+		MassRemovalConfirmations: 3,
+		MassRemovalAction:        "hold",
+	}
+	st := newSyncState()
+	ctx := context.Background()
+	allowedPath := filepath.Join(cfg.OutputDir, "node-1", "allowed-uuids.json")
+
+	var uuids []string
+	for i := 0; i < 20; i++ {
+		uuids = append(uuids, fmt.Sprintf("00000000-0000-4000-8000-%012d", i))
+	}
+	if err := applyAgentPush(ctx, cfg, st, agentPush{nodeID: 1, uuids: uuids}); err != nil {
+		t.Fatalf("initial push: %v", err)
+	}
+	if got, _ := loadAllowedUUIDsFile(allowedPath); len(got) != len(uuids) {
+		t.Fatalf("initial push applied %d users, want %d", len(got), len(uuids))
+	}
+
+	for i := 1; i < cfg.MassRemovalConfirmations; i++ {
+		if err := applyAgentPush(ctx, cfg, st, agentPush{nodeID: 1, uuids: []string{}}); err != nil {
+			t.Fatalf("empty push %d: %v", i, err)
+		}
+		if got, _ := loadAllowedUUIDsFile(allowedPath); len(got) != len(uuids) {
+			t.Fatalf("empty push %d wiped the node: %d users left, want %d kept", i, len(got), len(uuids))
+		}
+		if st.massRemovalErr(1) == nil {
+			t.Fatalf("empty push %d: mass removal not reported", i)
+		}
+	}
+
+	// 连续相同的推送达到确认次数后按原样生效
+	if err := applyAgentPush(ctx, cfg, st, agentPush{nodeID: 1, uuids: []string{}}); err != nil {
+		t.Fatalf("confirming push: %v", err)
+	}
+	if got, _ := loadAllowedUUIDsFile(allowedPath); len(got) != 0 {
+		t.Fatalf("confirmed empty push left %d users", len(got))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+)
+
+// 允许列表本地缓存（条件请求 / 增量同步）：
+// 每个节点缓存上次拉到的列表及面板给出的 version / ETag，下一轮请求带上 If-None-Match 和 since=<version>：
+// - 列表没变：面板返回 304，不传输、不重新规范化和计算 hash
+// - 列表有变且面板保留了增量：只返回 added（新增或限制变化的用户）/ removed，在缓存上合并
+// - 其它情况（首轮、面板重启、增量太旧）：返回全量，直接替换缓存
+// 旧版面板不返回 version：退化为每轮全量（Express 自带的 ETag 仍可能命中 304）。
+
+// allowedDelta 面板返回的增量
+type allowedDelta struct {
+	Added   []allowedUser `json:"added"`
+	Removed []string      `json:"removed"`
+}
+
+// allowedList 某节点的允许列表缓存
+type allowedList struct {
+	Version int64
+	ETag    string
+
+	uuids map[string]struct{}
+	users map[string]allowedUser // 面板未下发 users（旧版）时为空
+
+	// 规范化结果（去空、去重、排序）及其 hash，列表变化时重新计算
+	sorted []string
+	txt    []byte
+	hash   string
+}
+
+func newAllowedList(version int64, etag string, uuids []string, users []allowedUser) *allowedList {
+	al := &allowedList{
+		Version: version,
+		ETag:    etag,
+		uuids:   make(map[string]struct{}, len(uuids)),
+		users:   make(map[string]allowedUser, len(users)),
+	}
+	for _, u := range uuids {
+		if u = strings.TrimSpace(u); u != "" {
+			al.uuids[u] = struct{}{}
+		}
+	}
+	for _, u := range users {
+		if u.UUID = strings.TrimSpace(u.UUID); u.UUID != "" {
+			al.users[u.UUID] = u
+		}
+	}
+	al.normalize()
+	return al
+}
+
+// applyDelta 在缓存上合并增量，返回新的列表（不修改原缓存，合并失败时原缓存仍可用）
+func (al *allowedList) applyDelta(version int64, etag string, d allowedDelta) *allowedList {
+	next := &allowedList{
+		Version: version,
+		ETag:    etag,
+		uuids:   make(map[string]struct{}, len(al.uuids)+len(d.Added)),
+		users:   make(map[string]allowedUser, len(al.users)+len(d.Added)),
+	}
+	for u := range al.uuids {
+		next.uuids[u] = struct{}{}
+	}
+	for u, v := range al.users {
+		next.users[u] = v
+	}
+	for _, u := range d.Removed {
+		u = strings.TrimSpace(u)
+		delete(next.uuids, u)
+		delete(next.users, u)
+	}
+	for _, u := range d.Added {
+		if u.UUID = strings.TrimSpace(u.UUID); u.UUID == "" {
+			continue
+		}
+		next.uuids[u.UUID] = struct{}{}
+		next.users[u.UUID] = u
+	}
+	next.normalize()
+	return next
+}
+
+func (al *allowedList) normalize() {
+	al.sorted = make([]string, 0, len(al.uuids))
+	for u := range al.uuids {
+		al.sorted = append(al.sorted, u)
+	}
+	sortStrings(al.sorted)
+	al.txt = []byte(strings.Join(al.sorted, "\n") + "\n")
+	al.hash = sha256Hex(al.txt)
+}
+
+// userList 每用户限制（顺序与 sorted 一致）
+func (al *allowedList) userList() []allowedUser {
+	out := make([]allowedUser, 0, len(al.users))
+	for _, u := range al.sorted {
+		if v, ok := al.users[u]; ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
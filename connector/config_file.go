@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置文件（JSON，-config 或 CONNECTOR_CONFIG 指定）：
+// 顶层键为环境变量名的小写形式（panel_base_url、interval_seconds、xray_api_addr ……），
+// 节点写在 nodes 段，每个节点可单独指定 inbound tag、协议、flow、Xray API 地址和同步间隔。
+// 同名环境变量优先于文件；NODE_IDS / XRAY_TAG_MAP / SINGBOX_TAG_MAP 覆盖 nodes 段的节点列表与 tag。
+// 启动时校验失败直接退出；运行中文件内容变化（每 CONFIG_WATCH_SECONDS 检查一次）或收到 SIGHUP 时重新加载，
+// 新配置校验失败时打 WARN 并继续使用当前配置。定时任务的开关与间隔随重新加载生效，
+// APPLY_MODE、OUTPUT_DIR、AGENT_*、PANEL_EVENTS、HOST_ID 需要重启（见 keepRestartOnly）。
+
+type settingKind int
+
+const (
+	settingString settingKind = iota
+	settingInt
+	settingBool
+)
+
+// configSettings 配置文件允许的顶层设置（环境变量名）及类型
+var configSettings = map[string]settingKind{
+	"PANEL_BASE_URL":                    settingString,
+	"INTERNAL_API_KEY":                  settingString,
+	"OUTPUT_DIR":                        settingString,
+	"APPLY_CMD":                         settingString,
+	"APPLY_MODE":                        settingString,
+	"INTERVAL_SECONDS":                  settingInt,
+	"HTTP_TIMEOUT_SECONDS":              settingInt,
+	"XRAY_API_ADDR":                     settingString,
+	"XRAY_CONFIG":                       settingString,
+	"XRAY_CONFDIR":                      settingString,
+	"XRAY_VLESS_FLOW":                   settingString,
+	"XRAY_SS_METHOD":                    settingString,
+	"XRAY_RPC_TIMEOUT_SECONDS":          settingInt,
+	"XRAY_RECONCILE_INTERVAL_SECONDS":   settingInt,
+	"XRAY_WATCH_INTERVAL_SECONDS":       settingInt,
+	"XRAY_READY_TIMEOUT_SECONDS":        settingInt,
+	"XRAY_BIN":                          settingString,
+	"ENABLE_TRAFFIC_REPORT":             settingBool,
+	"TRAFFIC_REPORT_INTERVAL_SECONDS":   settingInt,
+	"XRAY_STATS_RESET":                  settingBool,
+	"TRAFFIC_OUTBOX_RETRY_BASE_SECONDS": settingInt,
+	"TRAFFIC_OUTBOX_RETRY_MAX_SECONDS":  settingInt,
+	"TRAFFIC_BULK_REPORT":               settingBool,
+	"TRAFFIC_BULK_MAX_ITEMS":            settingInt,
+	"SINGBOX_CONFIG":                    settingString,
+	"SINGBOX_RELOAD_CMD":                settingString,
+	"ONLINE_REPORT_INTERVAL_SECONDS":    settingInt,
+	"HEARTBEAT_INTERVAL_SECONDS":        settingInt,
+	"AGENT_LISTEN":                      settingString,
+	"AGENT_TOKEN":                       settingString,
+	"AGENT_NODE_INFO_FILE":              settingString,
+	"PANEL_EVENTS":                      settingBool,
+	"EVENTS_DEBOUNCE_SECONDS":           settingInt,
+	"SYNC_WORKERS":                      settingInt,
+	"NODE_SYNC_TIMEOUT_SECONDS":         settingInt,
+	"MASS_REMOVAL_MAX_COUNT":            settingInt,
+	"MASS_REMOVAL_MAX_PERCENT":          settingInt,
+	"MASS_REMOVAL_MIN_USERS":            settingInt,
+	"MASS_REMOVAL_CONFIRMATIONS":        settingInt,
+	"MASS_REMOVAL_ACTION":               settingString,
+	"OFFLINE_MAX_SECONDS":               settingInt,
+	"OFFLINE_POLICY":                    settingString,
+	"KICK_MODE":                         settingString,
+	"KICK_OUTBOUND_TAG":                 settingString,
+	"KICK_COOLDOWN_SECONDS":             settingInt,
+	"KICK_CHECK_SECONDS":                settingInt,
+	"KICK_BOUNCE_COMMAND":               settingString,
+	"SHUTDOWN_TIMEOUT_SECONDS":          settingInt,
+	"DEVICE_LIMIT_INTERVAL_SECONDS":     settingInt,
+	"DEVICE_LIMIT_COOLDOWN_SECONDS":     settingInt,
+	"DEVICE_LIMIT_DEFAULT":              settingInt,
+	"DEVICE_LIMIT_STRIKES":              settingInt,
+	"CONFIG_WATCH_SECONDS":              settingInt,
+	"HOST_ID":                           settingString,
+	"HOST_NODES_INTERVAL_SECONDS":       settingInt,
+	"NODE_NAME":                         settingString,
+	"NODE_PUBLIC_IP":                    settingString,
+	"REGISTER_ON_START":                 settingBool,
+	"REGISTER_ENV_FILE":                 settingString,
+	"REGISTER_PLAN_IDS":                 settingString,
+}
+
+// configEnums 取值固定的设置（环境变量照旧宽松处理，配置文件写错直接报错）
+var configEnums = map[string][]string{
+	"APPLY_MODE":          {"cmd", "xray-grpc", "singbox", "none"},
+	"MASS_REMOVAL_ACTION": {"hold", "stagger"},
+	"OFFLINE_POLICY":      {"open", "closed"},
+	"KICK_MODE":           {"route", "bounce", "off"},
+}
+
+// xrayProtocols xray-grpc 能下发用户的协议（见 xrayClient.buildUser）
+var xrayProtocols = []string{"vless", "vmess", "trojan", "shadowsocks"}
+
+// fileNode 配置文件 nodes 段的一项
+type fileNode struct {
+	ID              int    `json:"id"`
+	XrayTag         string `json:"xray_tag,omitempty"`
+	SingboxTag      string `json:"singbox_tag,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	Flow            string `json:"flow,omitempty"`
+	XrayAPIAddr     string `json:"xray_api_addr,omitempty"`
+	IntervalSeconds int    `json:"interval_seconds,omitempty"`
+}
+
+// nodeConfig 单个节点覆盖的设置，空值/0 表示使用全局设置
+type nodeConfig struct {
+	Protocol    string        // 为空时按 tag 推断
+	Flow        string        // vless flow，"none" 表示不带 flow
+	XrayAPIAddr string        // 该节点 inbound 所在 Xray 的 API 地址
+	Interval    time.Duration // 定时同步间隔
+}
+
+// configSource 设置来源：环境变量优先，其次配置文件，最后默认值
+type configSource struct {
+	file map[string]string // 环境变量名 -> 配置文件中的值
+}
+
+func (s configSource) get(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	if v := s.file[key]; v != "" {
+		return v
+	}
+	return def
+}
+
+// readConfigFile 读取并校验配置文件；path 为空时返回空来源（只用环境变量）
+func readConfigFile(path string) (configSource, []fileNode, string, error) {
+	src := configSource{file: map[string]string{}}
+	if path == "" {
+		return src, nil, "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return src, nil, "", err
+	}
+	hash := sha256Hex(b)
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return src, nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	var nodes []fileNode
+	for _, k := range keys {
+		raw := doc[k]
+		if k == "nodes" {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&nodes); err != nil {
+				errs = append(errs, fmt.Errorf("nodes: %w", err))
+			}
+			continue
+		}
+		name := strings.ToUpper(k)
+		kind, ok := configSettings[name]
+		if !ok {
+			switch name {
+			case "NODE_IDS", "XRAY_TAG_MAP", "SINGBOX_TAG_MAP":
+				errs = append(errs, fmt.Errorf("%s: use nodes instead", k))
+			default:
+				errs = append(errs, fmt.Errorf("%s: unknown setting", k))
+			}
+			continue
+		}
+		v, err := settingValue(kind, raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+			continue
+		}
+		if allowed, ok := configEnums[name]; ok && !containsString(allowed, v) {
+			errs = append(errs, fmt.Errorf("%s: %q is not one of %s", k, v, strings.Join(allowed, "/")))
+			continue
+		}
+		src.file[name] = v
+	}
+	errs = append(errs, validateFileNodes(nodes)...)
+	if len(errs) > 0 {
+		return src, nil, "", fmt.Errorf("%s: %w", path, errors.Join(errs...))
+	}
+	return src, nodes, hash, nil
+}
+
+// settingValue 把配置文件中的值按类型校验后转成与环境变量相同的字符串形式
+func settingValue(kind settingKind, raw json.RawMessage) (string, error) {
+	switch kind {
+	case settingInt:
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return "", errors.New("must be an integer")
+		}
+		if n < 0 {
+			return "", errors.New("must not be negative")
+		}
+		return strconv.Itoa(n), nil
+	case settingBool:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return "", errors.New("must be true or false")
+		}
+		return strconv.FormatBool(b), nil
+	default:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", errors.New("must be a string")
+		}
+		return strings.TrimSpace(s), nil
+	}
+}
+
+func validateFileNodes(nodes []fileNode) []error {
+	var errs []error
+	seen := make(map[int]bool, len(nodes))
+	for i, n := range nodes {
+		where := fmt.Sprintf("nodes[%d]", i)
+		if n.ID <= 0 {
+			errs = append(errs, fmt.Errorf("%s: id must be a positive integer", where))
+			continue
+		}
+		where = fmt.Sprintf("nodes[%d] (id %d)", i, n.ID)
+		if seen[n.ID] {
+			errs = append(errs, fmt.Errorf("%s: duplicate id", where))
+		}
+		seen[n.ID] = true
+		if n.Protocol != "" && !containsString(xrayProtocols, n.Protocol) {
+			errs = append(errs, fmt.Errorf("%s: protocol %q is not one of %s", where, n.Protocol, strings.Join(xrayProtocols, "/")))
+		}
+		if n.XrayAPIAddr != "" {
+			if _, _, err := net.SplitHostPort(n.XrayAPIAddr); err != nil {
+				errs = append(errs, fmt.Errorf("%s: xray_api_addr: %w", where, err))
+			}
+		}
+		if n.IntervalSeconds < 0 {
+			errs = append(errs, fmt.Errorf("%s: interval_seconds must not be negative", where))
+		}
+	}
+	return errs
+}
+
+// fileSHA256 配置文件内容的 hash，用于检测文件变化
+func fileSHA256(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(b), nil
+}
+
+// keepRestartOnly 重新加载时，运行中无法切换的设置保留当前值，并提示需要重启
+func keepRestartOnly(cur, next config) config {
+	changed := func(name string, differs bool) bool {
+		if differs {
+			fmt.Fprintf(os.Stderr, "[WARN] config reload: %s changed, restart required to take effect\n", name)
+		}
+		return differs
+	}
+	if changed("APPLY_MODE", next.ApplyMode != cur.ApplyMode) {
+		next.ApplyMode = cur.ApplyMode
+	}
+	if changed("OUTPUT_DIR", next.OutputDir != cur.OutputDir) {
+		next.OutputDir = cur.OutputDir
+	}
+	if changed("AGENT_*", next.AgentListen != cur.AgentListen || next.AgentToken != cur.AgentToken || next.AgentNodeInfoFile != cur.AgentNodeInfoFile) {
+		next.AgentListen, next.AgentToken, next.AgentNodeInfoFile = cur.AgentListen, cur.AgentToken, cur.AgentNodeInfoFile
+	}
+	if changed("PANEL_EVENTS", next.PanelEvents != cur.PanelEvents) {
+		next.PanelEvents = cur.PanelEvents
+	}
+	if changed("HOST_ID", next.HostID != cur.HostID) {
+		// 节点列表的来源跟着 HOST_ID 走，一并保留（HOST_ID 模式下随后按面板分配重新组装）
+		next.HostID, next.NodeIDs = cur.HostID, cur.NodeIDs
+	}
+	return next
+}
+
+// resetTicker 间隔变化时调整已启用的 ticker
+func resetTicker(t *time.Ticker, cur, next time.Duration) {
+	if t != nil && next > 0 && next != cur {
+		t.Reset(next)
+	}
+}
+
+// setTicker 配置重新加载时按新配置启用、停用定时任务，或调整其间隔；返回是否启停
+func setTicker(t **time.Ticker, c *<-chan time.Time, enabled bool, cur, next time.Duration, name, reason string) bool {
+	switch {
+	case !enabled && *t != nil:
+		(*t).Stop()
+		*t, *c = nil, nil
+		fmt.Printf("[INFO] %s disabled (%s)\n", name, reason)
+		return true
+	case enabled && *t == nil:
+		*t = time.NewTicker(next)
+		*c = (*t).C
+		fmt.Printf("[INFO] %s enabled every %s (%s)\n", name, next, reason)
+		return true
+	default:
+		resetTicker(*t, cur, next)
+		return false
+	}
+}
+
+// diffNodeIDs 重新加载后新增、移除的节点
+func diffNodeIDs(cur, next []int) (added, removed []int) {
+	curSet := make(map[int]bool, len(cur))
+	for _, id := range cur {
+		curSet[id] = true
+	}
+	nextSet := make(map[int]bool, len(next))
+	for _, id := range next {
+		nextSet[id] = true
+		if !curSet[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range cur {
+		if !nextSet[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// xrayProtoForNode 节点 inbound 的协议：配置文件指定的优先，其次用发现结果，都没有时按 tag 推断
+func xrayProtoForNode(cfg config, nodeID int) string {
+	if p := cfg.Nodes[nodeID].Protocol; p != "" {
+		return p
+	}
+	if in, ok := xrayInboundForNode(cfg, nodeID); ok && containsString(xrayProtocols, in.Protocol) {
+		return in.Protocol
+	}
+	return inferProtoFromTag(xrayTagForNode(cfg, nodeID))
+}
+
+// xrayAddrForNode 节点 inbound 所在 Xray 的 API 地址
+func xrayAddrForNode(cfg config, nodeID int) string {
+	if addr := cfg.Nodes[nodeID].XrayAPIAddr; addr != "" {
+		return addr
+	}
+	return cfg.XrayAPIAddr
+}
+
+// xrayClientForNode 按节点设置（API 地址、vless flow、shadowsocks 加密方式）创建 Xray 客户端：
+// 配置文件指定的优先，其次用 inbound 发现结果，最后用全局设置
+func xrayClientForNode(cfg config, nodeID int) *xrayClient {
+	flow, ssMethod := cfg.XrayVlessFlow, cfg.XraySSMethod
+	if in, ok := xrayInboundForNode(cfg, nodeID); ok {
+		if in.Flow != "" {
+			flow = in.Flow
+		}
+		if in.SSMethod != "" {
+			ssMethod = in.SSMethod
+		}
+	}
+	if f := cfg.Nodes[nodeID].Flow; f != "" {
+		flow = f
+	}
+	return newXrayClient(xrayAddrForNode(cfg, nodeID), cfg.XrayRPCTimeout, flow, ssMethod)
+}
+
+// xrayAPIAddrs 所有节点用到的 Xray API 地址（去重，按节点顺序）
+func xrayAPIAddrs(cfg config) []string {
+	var out []string
+	for _, nodeID := range cfg.NodeIDs {
+		if addr := xrayAddrForNode(cfg, nodeID); !containsString(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, cfg.XrayAPIAddr)
+	}
+	return out
+}
+
+// xrayAddrNodes 使用该 Xray API 地址的节点
+func xrayAddrNodes(cfg config, addr string) []int {
+	var out []int
+	for _, nodeID := range cfg.NodeIDs {
+		if xrayAddrForNode(cfg, nodeID) == addr {
+			out = append(out, nodeID)
+		}
+	}
+	return out
+}
+
+// nodeSyncInterval 节点的定时同步间隔
+func nodeSyncInterval(cfg config, nodeID int) time.Duration {
+	if d := cfg.Nodes[nodeID].Interval; d > 0 {
+		return d
+	}
+	return cfg.Interval
+}
+
+// syncTickInterval 定时同步 ticker 的间隔：所有节点间隔中最短的
+func syncTickInterval(cfg config) time.Duration {
+	tick := cfg.Interval
+	for _, nodeID := range cfg.NodeIDs {
+		if d := nodeSyncInterval(cfg, nodeID); d < tick {
+			tick = d
+		}
+	}
+	return tick
+}
+
+// dueNodes 本次定时同步轮到的节点（last 为各节点上次定时同步的时间，只在主循环中使用）
+func dueNodes(cfg config, last map[int]time.Time, now time.Time) []int {
+	// ticker 间隔是各节点间隔的公共下限，留半个 tick 的余量避免因调度抖动推迟一整轮
+	slack := syncTickInterval(cfg) / 2
+	var ids []int
+	for _, nodeID := range cfg.NodeIDs {
+		if t, ok := last[nodeID]; ok && now.Sub(t)+slack < nodeSyncInterval(cfg, nodeID) {
+			continue
+		}
+		ids = append(ids, nodeID)
+	}
+	return ids
+}
+
+// logNodeConfig 打印配置文件中按节点覆盖的设置
+func logNodeConfig(cfg config) {
+	for _, nodeID := range cfg.NodeIDs {
+		if _, ok := cfg.Nodes[nodeID]; !ok {
+			continue
+		}
+		if cfg.ApplyMode != "xray-grpc" {
+			fmt.Printf("[INFO] node %d: interval=%s\n", nodeID, nodeSyncInterval(cfg, nodeID))
+			continue
+		}
+		flow := xrayClientForNode(cfg, nodeID).vlessFlow
+		if flow == "" {
+			flow = "none"
+		}
+		fmt.Printf("[INFO] node %d: tag=%s protocol=%s flow=%s api=%s interval=%s\n",
+			nodeID, xrayTagForNode(cfg, nodeID), xrayProtoForNode(cfg, nodeID), flow, xrayAddrForNode(cfg, nodeID), nodeSyncInterval(cfg, nodeID))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 设备数限制（xray-grpc 模式）：
+// 套餐承诺“同时在线设备数”，这里用 Xray 的在线 IP 统计近似设备数：
+// 定期读取每个用户（email=UUID）最近 20 秒内的来源 IP，去重后与面板下发的限制比较，
+// 连续 DEVICE_LIMIT_STRIKES 次超限就从该用户所在的所有 inbound 临时移除，
+// 冷却 DEVICE_LIMIT_COOLDOWN_SECONDS 后重新加回。每次移除/恢复都会打日志。
+// 需要 Xray policy 开启 statsUserOnline，否则在线列表始终为空。
+// 冷却状态只在内存里，connector 重启后首轮同步会把用户加回来，超限会被再次移除。
+
+// userSuspension 因设备数超限被临时移除的用户
+type userSuspension struct {
+	Until time.Time
+	Nodes []int // 实际被移除的节点（恢复时只加回这些节点）
+	IPs   int
+	Limit int
+}
+
+// setDeviceLimits 记录面板下发的设备数限制（旧版面板不下发 users 时清空，改用 DEVICE_LIMIT_DEFAULT）
+func (st *syncState) setDeviceLimits(nodeID int, users []allowedUser) {
+	limits := make(map[string]int, len(users))
+	for _, u := range users {
+		if u.UUID != "" && u.DeviceLimit > 0 {
+			limits[u.UUID] = u.DeviceLimit
+		}
+	}
+	st.mu.Lock()
+	st.deviceLimits[nodeID] = limits
+	st.mu.Unlock()
+}
+
+// deviceLimitFor 用户的设备数限制：多个节点下发的值取最大，都没有时用默认值（0 表示不限）
+func (st *syncState) deviceLimitFor(cfg config, uuid string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	limit := 0
+	for _, limits := range st.deviceLimits {
+		if n := limits[uuid]; n > limit {
+			limit = n
+		}
+	}
+	if limit == 0 {
+		limit = cfg.DeviceLimitDefault
+	}
+	return limit
+}
+
+// withoutBlocked 过滤掉设备数超限冷却中、以及本地额度已用完的用户
+func (st *syncState) withoutBlocked(uuids []string) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]string, 0, len(uuids))
+	for _, u := range uuids {
+		if _, ok := st.suspended[u]; ok {
+			continue
+		}
+		if st.quota.isExhausted(u) {
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// suspendedSnapshot 冷却中用户的副本（遍历期间要调 Xray RPC，不能一直持锁）
+func (st *syncState) suspendedSnapshot() map[string]userSuspension {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make(map[string]userSuspension, len(st.suspended))
+	for k, v := range st.suspended {
+		out[k] = v
+	}
+	return out
+}
+
+func (st *syncState) isSuspended(uuid string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.suspended[uuid]
+	return ok
+}
+
+func (st *syncState) setSuspended(uuid string, s userSuspension) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.suspended[uuid] = s
+}
+
+func (st *syncState) clearSuspended(uuid string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.suspended, uuid)
+}
+
+func (st *syncState) suspendedCount() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.suspended)
+}
+
+// deviceLimitUnsupportedWarned 内核不支持在线统计时只提示一次
+var deviceLimitUnsupportedWarned bool
+
+// enforceDeviceLimits 执行一轮设备数检查：先恢复冷却结束的用户，再处理新的超限用户
+func enforceDeviceLimits(ctx context.Context, cfg config, st *syncState) error {
+	now := time.Now()
+
+	// 每个节点当前下发的列表（applied.json），用于确定用户在哪些 inbound 上
+	applied := make(map[int]map[string]struct{}, len(cfg.NodeIDs))
+	for _, nodeID := range cfg.NodeIDs {
+		list, err := loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json"))
+		if err != nil {
+			continue
+		}
+		set := make(map[string]struct{}, len(list))
+		for _, u := range list {
+			set[u] = struct{}{}
+		}
+		applied[nodeID] = set
+	}
+
+	for uuid, s := range st.suspendedSnapshot() {
+		if now.Before(s.Until) {
+			continue
+		}
+		var failed []int
+		for _, nodeID := range s.Nodes {
+			if _, ok := applied[nodeID][uuid]; !ok {
+				// 冷却期间面板已经不允许该用户使用此节点：不再加回
+				continue
+			}
+			if st.quota.isExhausted(uuid) {
+				// 冷却期间本地额度已用完：不加回，由额度恢复后的同步负责
+				continue
+			}
+			kicks.release(ctx, cfg, nodeID, []string{uuid})
+			if err := xrayClientForNode(cfg, nodeID).addUser(ctx, xrayTagForNode(cfg, nodeID), uuid, xrayProtoForNode(cfg, nodeID)); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s device limit restore failed: %v\n", nodeID, uuid, err)
+				failed = append(failed, nodeID)
+				continue
+			}
+			fmt.Printf("[INFO] node %d uuid %s device limit cooldown over, user restored\n", nodeID, uuid)
+		}
+		if len(failed) > 0 {
+			// 下一轮继续重试加回失败的节点
+			s.Nodes = failed
+			st.setSuspended(uuid, s)
+			continue
+		}
+		st.clearSuspended(uuid)
+		delete(st.deviceStrikes, uuid)
+	}
+
+	online, err := onlineUserIPsAll(ctx, cfg)
+	if err != nil {
+		if isXrayUnsupportedErr(err) {
+			if !deviceLimitUnsupportedWarned {
+				deviceLimitUnsupportedWarned = true
+				fmt.Fprintf(os.Stderr, "[WARN] xray core does not support online ip stats, device limit disabled: %v\n", err)
+			}
+			return nil
+		}
+		return fmt.Errorf("query online ips failed: %w", err)
+	}
+
+	for uuid := range st.deviceStrikes {
+		if _, ok := online[uuid]; !ok {
+			delete(st.deviceStrikes, uuid)
+		}
+	}
+
+	for uuid, ips := range online {
+		if st.isSuspended(uuid) {
+			continue
+		}
+		limit := st.deviceLimitFor(cfg, uuid)
+		if limit <= 0 || len(ips) <= limit {
+			delete(st.deviceStrikes, uuid)
+			continue
+		}
+		st.deviceStrikes[uuid]++
+		if st.deviceStrikes[uuid] < cfg.DeviceLimitStrikes {
+			fmt.Printf("[INFO] uuid %s over device limit (ips=%d limit=%d), strike %d/%d\n", uuid, len(ips), limit, st.deviceStrikes[uuid], cfg.DeviceLimitStrikes)
+			continue
+		}
+
+		s := userSuspension{Until: now.Add(cfg.DeviceLimitCooldown), IPs: len(ips), Limit: limit}
+		for _, nodeID := range cfg.NodeIDs {
+			if _, ok := applied[nodeID][uuid]; !ok {
+				continue
+			}
+			if err := xrayClientForNode(cfg, nodeID).removeUser(ctx, xrayTagForNode(cfg, nodeID), uuid); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s device limit remove failed: %v\n", nodeID, uuid, err)
+				continue
+			}
+			s.Nodes = append(s.Nodes, nodeID)
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s over device limit (ips=%d limit=%d %v), removed for %s\n", nodeID, uuid, len(ips), limit, ipList(ips), cfg.DeviceLimitCooldown)
+			kicks.kick(ctx, cfg, nodeID, []string{uuid})
+		}
+		if len(s.Nodes) > 0 {
+			st.setSuspended(uuid, s)
+		}
+	}
+	return nil
+}
+
+// onlineUserIPsAll 汇总各节点所在 Xray（配置文件可按节点指定 API 地址）的在线 IP
+func onlineUserIPsAll(ctx context.Context, cfg config) (map[string]map[string]int64, error) {
+	out := make(map[string]map[string]int64)
+	for _, addr := range xrayAPIAddrs(cfg) {
+		x := newXrayClient(addr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow, cfg.XraySSMethod)
+		online, err := x.onlineUserIPs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for uuid, ips := range online {
+			if out[uuid] == nil {
+				out[uuid] = make(map[string]int64, len(ips))
+			}
+			for ip, lastSeen := range ips {
+				if lastSeen > out[uuid][ip] {
+					out[uuid][ip] = lastSeen
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// ipList 在线 IP 列表（排序，便于日志对照）
+func ipList(ips map[string]int64) []string {
+	out := make([]string, 0, len(ips))
+	for ip := range ips {
+		out = append(out, ip)
+	}
+	sortStrings(out)
+	return out
+}
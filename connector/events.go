@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 面板变更事件（SSE）：
+// 常驻一条到 GET /api/internal/events?node_ids=... 的长连接，管理员封禁/退订/改绑定等操作后面板立即推送 users_changed，
+// 主循环收到后马上同步相关节点（配合条件请求，只拉增量），不必等下一轮 INTERVAL_SECONDS。
+// 连接建立（hello）时也做一次全量同步，补上断线期间漏掉的变更。
+// 收到事件后等 EVENTS_DEBOUNCE_SECONDS（singbox 默认 10 秒，每次同步都要重载整个实例）再同步，窗口内的事件合并（eventBatch）。
+// nodes_changed（节点增删改）只在 HOST_ID 模式下使用：重新查询面板分配给本机的节点。
+// 连接断开或面板不支持时按退避重连，期间照常由定时 syncOnce 兜底（定时同步始终开启）。
+
+// panelEvent 面板推送的事件
+type panelEvent struct {
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	UserID  int64  `json:"user_id"`
+	NodeIDs []int  `json:"node_ids"` // 为空表示可能影响所有节点
+}
+
+const (
+	eventsIdleTimeout = 90 * time.Second // 面板每 25 秒发一次保活注释，超过该时长没有任何数据视为断线
+	eventsRetryMin    = 1 * time.Second
+	eventsRetryMax    = 60 * time.Second
+)
+
+// runEventStream 维持事件长连接，把事件交给主循环；ctx 结束时退出
+func runEventStream(ctx context.Context, cfg config, out chan<- panelEvent) {
+	backoff := eventsRetryMin
+	for {
+		started := time.Now()
+		err := readEventStream(ctx, cfg, out)
+		if ctx.Err() != nil {
+			return
+		}
+		// 连接持续过一段时间说明面板正常，重新从最小间隔开始退避
+		if time.Since(started) > eventsIdleTimeout {
+			backoff = eventsRetryMin
+		}
+		fmt.Fprintf(os.Stderr, "[WARN] panel event stream disconnected: %v (retry in %s, falling back to interval sync)\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > eventsRetryMax {
+			backoff = eventsRetryMax
+		}
+	}
+}
+
+func readEventStream(ctx context.Context, cfg config, out chan<- panelEvent) error {
+	ids := make([]string, 0, len(cfg.NodeIDs))
+	for _, id := range cfg.NodeIDs {
+		ids = append(ids, fmt.Sprintf("%d", id))
+	}
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/events?node_ids=" + strings.Join(ids, ",")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	// 长连接不能设整体超时：用空闲计时器代替，收到任何一行就重置
+	idle := time.AfterFunc(cfg.HTTPTimeout, cancel)
+	defer idle.Stop()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("panel status=%d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		return fmt.Errorf("unexpected content-type %q (panel does not support events?)", ct)
+	}
+	idle.Reset(eventsIdleTimeout)
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	var eventType string
+	var data strings.Builder
+	for sc.Scan() {
+		idle.Reset(eventsIdleTimeout)
+		line := sc.Text()
+		switch {
+		case line == "":
+			// 空行：一条事件结束
+			if eventType != "" || data.Len() > 0 {
+				if err := dispatchPanelEvent(ctx, eventType, data.String(), out); err != nil {
+					return err
+				}
+			}
+			eventType = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// 保活注释
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by panel")
+}
+
+func dispatchPanelEvent(ctx context.Context, eventType, data string, out chan<- panelEvent) error {
+	var ev panelEvent
+	switch eventType {
+	case "hello":
+		fmt.Printf("[INFO] panel event stream connected\n")
+		ev.Type = "hello"
+	case "users_changed", "nodes_changed":
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] bad panel event: %v data=%s\n", err, data)
+			return nil
+		}
+		ev.Type = eventType
+	default:
+		return nil
+	}
+	select {
+	case out <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// eventNodes 事件涉及的本机节点（事件未指定节点时为全部节点）
+func eventNodes(cfg config, ev panelEvent) []int {
+	if len(ev.NodeIDs) == 0 {
+		return cfg.NodeIDs
+	}
+	var out []int
+	for _, id := range cfg.NodeIDs {
+		for _, n := range ev.NodeIDs {
+			if id == n {
+				out = append(out, id)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// eventBatch 合并窗口内收到的事件
+type eventBatch struct {
+	count        int
+	full         bool         // 收到过 hello：全量同步
+	nodesChanged bool         // 收到过 nodes_changed
+	nodes        map[int]bool // users_changed 涉及的节点
+	usersChanged *panelEvent  // 第一个 users_changed，用于日志
+}
+
+func (b *eventBatch) add(cfg config, ev panelEvent) {
+	b.count++
+	switch ev.Type {
+	case "hello":
+		b.full = true
+	case "nodes_changed":
+		b.nodesChanged = true
+		return
+	case "users_changed":
+		if b.usersChanged == nil {
+			e := ev
+			b.usersChanged = &e
+		}
+	}
+	for _, id := range eventNodes(cfg, ev) {
+		b.nodes[id] = true
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 批量移除保护：
+// 面板数据库抖动时 /allowed-uuids 可能返回空列表或少一大截，直接下发会把整个节点的用户踢掉。
+// 与上次下发的列表相比，一次要移除的用户数超过阈值（MASS_REMOVAL_MAX_COUNT 个，或上次人数的
+// MASS_REMOVAL_MAX_PERCENT%，人数少于 MASS_REMOVAL_MIN_USERS 时不按比例判断）视为可疑：
+// - hold（默认）：这些用户先保留，新增用户照常下发
+// - stagger：每轮最多移除阈值以内的人数，其余保留到后续轮次
+// 面板连续 MASS_REMOVAL_CONFIRMATIONS 次返回同一份列表（hash 相同）后才按原样全部生效。
+// 每次拦截都会打 WARN 日志并记入节点同步错误（心跳上报到面板）。
+
+// massRemovalPending 某节点正在等待确认的可疑列表
+type massRemovalPending struct {
+	hash  string
+	count int
+	err   error // 本轮拦截的描述，节点同步成功时仍作为同步错误上报
+}
+
+// massRemovalLimit 本次允许直接移除的人数（<0 表示不限）
+func massRemovalLimit(cfg config, prevCount int) int {
+	limit := -1
+	if cfg.MassRemovalMaxCount > 0 {
+		limit = cfg.MassRemovalMaxCount
+	}
+	if cfg.MassRemovalMaxPercent > 0 && prevCount >= cfg.MassRemovalMinUsers {
+		n := prevCount * cfg.MassRemovalMaxPercent / 100
+		if limit < 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// massRemovalErr 节点当前是否处于批量移除拦截中（nil 表示没有）
+func (st *syncState) massRemovalErr(nodeID int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.massPending[nodeID].err
+}
+
+// guardMassRemoval 检查面板列表相对上次下发列表（prev）的移除数量，返回实际要下发的列表：
+// 未触发保护或已确认时原样返回 al，否则返回保留了部分/全部待移除用户的新列表
+func (st *syncState) guardMassRemoval(cfg config, nodeID int, al *allowedList, prev []string) *allowedList {
+	var removed []string
+	for _, u := range prev {
+		if _, ok := al.uuids[u]; !ok {
+			removed = append(removed, u)
+		}
+	}
+
+	limit := massRemovalLimit(cfg, len(prev))
+	if limit < 0 || len(removed) <= limit {
+		st.mu.Lock()
+		delete(st.massPending, nodeID)
+		st.mu.Unlock()
+		return al
+	}
+
+	st.mu.Lock()
+	p := st.massPending[nodeID]
+	if p.hash == al.hash {
+		p.count++
+	} else {
+		p = massRemovalPending{hash: al.hash, count: 1}
+	}
+	st.massPending[nodeID] = p
+	st.mu.Unlock()
+
+	if p.count >= cfg.MassRemovalConfirmations {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d mass removal confirmed after %d identical responses, removing %d/%d users\n", nodeID, p.count, len(removed), len(prev))
+		st.mu.Lock()
+		delete(st.massPending, nodeID)
+		st.mu.Unlock()
+		return al
+	}
+
+	keep := removed
+	if cfg.MassRemovalAction == "stagger" {
+		sortStrings(removed)
+		keep = removed[limit:]
+	}
+	guarded := newAllowedList(al.Version, al.ETag, append(append([]string(nil), al.sorted...), keep...), nil)
+	guarded.users = al.users
+
+	p.err = fmt.Errorf("mass removal guarded: panel list would remove %d/%d users (limit %d), keeping %d (%s), confirmation %d/%d",
+		len(removed), len(prev), limit, len(keep), cfg.MassRemovalAction, p.count, cfg.MassRemovalConfirmations)
+	st.mu.Lock()
+	st.massPending[nodeID] = p
+	st.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "[WARN] node %d %v\n", nodeID, p.err)
+	return guarded
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点心跳：
+// 定期向面板上报 connector / Xray / 主机的运行状态，面板据此判断节点是否存活（nodes.status 只是静态开关）。
+// 内容包括 connector 版本、Xray 版本与 Uptime/内存（GetSysStats）、主机负载/CPU/内存/网卡流量（/proc），
+// 以及每个节点已下发的用户数和最近一次同步/上报的错误。
+// /proc 不存在（非 Linux）或 Xray 不可达时对应字段留空，心跳照常发送。
+
+// nodeHealth 单个节点最近一次同步 / 流量上报的结果
+type nodeHealth struct {
+	LastSyncAt      int64  `json:"last_sync_at,omitempty"`
+	LastSyncError   string `json:"last_sync_error,omitempty"`
+	LastReportAt    int64  `json:"last_report_at,omitempty"`
+	LastReportError string `json:"last_report_error,omitempty"`
+}
+
+// healthRegistry 汇总各节点状态（同步在主循环、首轮流量上报在独立 goroutine，需加锁）
+type healthRegistry struct {
+	mu    sync.Mutex
+	nodes map[int]*nodeHealth
+}
+
+var health = &healthRegistry{nodes: make(map[int]*nodeHealth)}
+
+func (h *healthRegistry) node(nodeID int) *nodeHealth {
+	n, ok := h.nodes[nodeID]
+	if !ok {
+		n = &nodeHealth{}
+		h.nodes[nodeID] = n
+	}
+	return n
+}
+
+// syncResult 记录一次同步结果（err 为 nil 表示成功）
+func (h *healthRegistry) syncResult(nodeID int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.node(nodeID)
+	n.LastSyncAt = time.Now().Unix()
+	n.LastSyncError = ""
+	if err != nil {
+		n.LastSyncError = err.Error()
+	}
+}
+
+// reportResult 记录一次流量上报结果（err 为 nil 表示成功）
+func (h *healthRegistry) reportResult(nodeID int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.node(nodeID)
+	n.LastReportAt = time.Now().Unix()
+	n.LastReportError = ""
+	if err != nil {
+		n.LastReportError = err.Error()
+	}
+}
+
+func (h *healthRegistry) snapshot(nodeID int) nodeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n, ok := h.nodes[nodeID]; ok {
+		return *n
+	}
+	return nodeHealth{}
+}
+
+// recordOutboxHealth 按 outbox 补报结果记录上报状态（退避中仍视为失败）
+func recordOutboxHealth(nodeID int, ob *trafficOutbox) {
+	if ob.LastError != "" {
+		health.reportResult(nodeID, errors.New(ob.LastError))
+		return
+	}
+	health.reportResult(nodeID, nil)
+}
+
+// hostStats 主机状态（/proc）
+type hostStats struct {
+	Uptime       int64   `json:"uptime,omitempty"` // 秒
+	Load1        float64 `json:"load1"`
+	Load5        float64 `json:"load5"`
+	Load15       float64 `json:"load15"`
+	CPUPercent   float64 `json:"cpu_percent"` // 距上次心跳的平均 CPU 使用率
+	MemTotal     uint64  `json:"mem_total,omitempty"`
+	MemAvailable uint64  `json:"mem_available,omitempty"`
+	NetRxBytes   uint64  `json:"net_rx_bytes,omitempty"` // 所有非 lo 网卡累计收发字节
+	NetTxBytes   uint64  `json:"net_tx_bytes,omitempty"`
+	NetRxRate    float64 `json:"net_rx_rate"` // 距上次心跳的平均速率（字节/秒）
+	NetTxRate    float64 `json:"net_tx_rate"`
+}
+
+// hostSample 计算 CPU 使用率 / 网速所需的上次采样
+type hostSample struct {
+	at       time.Time
+	cpuTotal uint64
+	cpuIdle  uint64
+	rx, tx   uint64
+}
+
+func readHostStats(prev *hostSample) (hostStats, *hostSample) {
+	var hs hostStats
+	cur := &hostSample{at: time.Now()}
+
+	if b, err := os.ReadFile("/proc/uptime"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 0 {
+			v, _ := strconv.ParseFloat(f[0], 64)
+			hs.Uptime = int64(v)
+		}
+	}
+	if b, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if f := strings.Fields(string(b)); len(f) >= 3 {
+			hs.Load1, _ = strconv.ParseFloat(f[0], 64)
+			hs.Load5, _ = strconv.ParseFloat(f[1], 64)
+			hs.Load15, _ = strconv.ParseFloat(f[2], 64)
+		}
+	}
+	if b, err := os.ReadFile("/proc/stat"); err == nil {
+		// 第一行：cpu user nice system idle iowait irq softirq steal ...
+		line, _, _ := strings.Cut(string(b), "\n")
+		f := strings.Fields(line)
+		if len(f) >= 5 && f[0] == "cpu" {
+			for i, v := range f[1:] {
+				if i >= 8 {
+					break // guest / guest_nice 已计入 user / nice
+				}
+				n, _ := strconv.ParseUint(v, 10, 64)
+				cur.cpuTotal += n
+				if i == 3 || i == 4 {
+					cur.cpuIdle += n
+				}
+			}
+		}
+	}
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			switch fields[0] {
+			case "MemTotal:":
+				hs.MemTotal = kb * 1024
+			case "MemAvailable:":
+				hs.MemAvailable = kb * 1024
+			}
+		}
+		f.Close()
+	}
+	if f, err := os.Open("/proc/net/dev"); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			name, rest, ok := strings.Cut(sc.Text(), ":")
+			if !ok || strings.TrimSpace(name) == "lo" {
+				continue
+			}
+			fields := strings.Fields(rest)
+			if len(fields) < 9 {
+				continue
+			}
+			rx, _ := strconv.ParseUint(fields[0], 10, 64)
+			tx, _ := strconv.ParseUint(fields[8], 10, 64)
+			cur.rx += rx
+			cur.tx += tx
+		}
+		f.Close()
+		hs.NetRxBytes, hs.NetTxBytes = cur.rx, cur.tx
+	}
+
+	if prev != nil {
+		if cur.cpuTotal > prev.cpuTotal && cur.cpuIdle >= prev.cpuIdle {
+			dt := cur.cpuTotal - prev.cpuTotal
+			busy := dt - (cur.cpuIdle - prev.cpuIdle)
+			hs.CPUPercent = math.Round(float64(busy)/float64(dt)*10000) / 100
+		}
+		if sec := cur.at.Sub(prev.at).Seconds(); sec > 0 {
+			if cur.rx >= prev.rx {
+				hs.NetRxRate = math.Round(float64(cur.rx-prev.rx) / sec)
+			}
+			if cur.tx >= prev.tx {
+				hs.NetTxRate = math.Round(float64(cur.tx-prev.tx) / sec)
+			}
+		}
+	}
+	return hs, cur
+}
+
+// xrayVersion 执行 `XRAY_BIN version` 读取内核版本（第一行，例如 "Xray 25.1.30 (Xray, Penetrates Everything.) ..."）
+func xrayVersion(ctx context.Context, bin string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	f := strings.Fields(line)
+	if len(f) >= 2 {
+		return f[1], nil
+	}
+	return line, nil
+}
+
+type heartbeatXray struct {
+	Version      string `json:"version,omitempty"`
+	Uptime       uint32 `json:"uptime"`
+	MemAlloc     uint64 `json:"mem_alloc"`
+	MemSys       uint64 `json:"mem_sys"`
+	NumGoroutine uint32 `json:"num_goroutine"`
+	Error        string `json:"error,omitempty"` // API 不可达时的错误
+}
+
+type heartbeatNode struct {
+	NodeID       int            `json:"node_id"`
+	AppliedUsers int            `json:"applied_users"`
+	Xray         *heartbeatXray `json:"xray,omitempty"` // 该节点 inbound 所在 Xray（节点可各自指定 xray_api_addr）
+	nodeHealth
+}
+
+// heartbeat 跨次保存的心跳状态
+type heartbeat struct {
+	prev        *hostSample
+	xrayVersion string
+	xrayUptime  map[string]uint32 // 按 API 地址；XRAY_API_ADDR 的 Uptime 变小说明 Xray 重启过（可能升级了内核），需要重新读版本
+}
+
+// xrayStatus 查询一个 Xray 的状态；XRAY_BIN 只对应本机 XRAY_API_ADDR 的内核，版本只在该地址上填写
+func (hb *heartbeat) xrayStatus(ctx context.Context, cfg config, addr string, x *xrayClient) *heartbeatXray {
+	if hb.xrayUptime == nil {
+		hb.xrayUptime = make(map[string]uint32)
+	}
+	global := addr == cfg.XrayAPIAddr
+	hx := &heartbeatXray{}
+	if ss, err := x.sysStats(ctx); err == nil {
+		hx.Uptime = ss.GetUptime()
+		hx.MemAlloc = ss.GetAlloc()
+		hx.MemSys = ss.GetSys()
+		hx.NumGoroutine = ss.GetNumGoroutine()
+		if global && hx.Uptime < hb.xrayUptime[addr] {
+			hb.xrayVersion = ""
+		}
+		hb.xrayUptime[addr] = hx.Uptime
+	} else {
+		hx.Error = err.Error()
+	}
+	if global {
+		if hb.xrayVersion == "" {
+			if v, err := xrayVersion(ctx, cfg.XrayBin); err == nil {
+				hb.xrayVersion = v
+			}
+		}
+		hx.Version = hb.xrayVersion
+	}
+	return hx
+}
+
+// send 采集一次状态并上报（POST /api/internal/heartbeat）
+func (hb *heartbeat) send(ctx context.Context, cfg config) error {
+	host, sample := readHostStats(hb.prev)
+	hb.prev = sample
+
+	payload := map[string]interface{}{
+		"connector_version": version,
+		"apply_mode":        cfg.ApplyMode,
+		"ts":                time.Now().Unix(),
+		"host":              host,
+	}
+
+	// 每个 API 地址只查询一次
+	byAddr := make(map[string]*heartbeatXray)
+	if cfg.ApplyMode == "xray-grpc" {
+		byAddr[cfg.XrayAPIAddr] = hb.xrayStatus(ctx, cfg, cfg.XrayAPIAddr, newXrayClient(cfg.XrayAPIAddr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow, cfg.XraySSMethod))
+		payload["xray"] = byAddr[cfg.XrayAPIAddr]
+	}
+
+	if len(cfg.NodeIDs) == 0 {
+		// HOST_ID 模式下面板还没给本机分配节点：面板按节点记录心跳，没有可报的
+		return nil
+	}
+	nodes := make([]heartbeatNode, 0, len(cfg.NodeIDs))
+	for _, nodeID := range cfg.NodeIDs {
+		n := heartbeatNode{NodeID: nodeID, nodeHealth: health.snapshot(nodeID)}
+		if cfg.ApplyMode == "xray-grpc" {
+			addr := xrayAddrForNode(cfg, nodeID)
+			if byAddr[addr] == nil {
+				byAddr[addr] = hb.xrayStatus(ctx, cfg, addr, xrayClientForNode(cfg, nodeID))
+			}
+			n.Xray = byAddr[addr]
+		}
+		if applied, err := loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json")); err == nil {
+			n.AppliedUsers = len(applied)
+		}
+		nodes = append(nodes, n)
+	}
+	payload["nodes"] = nodes
+
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/heartbeat"
+	bodyBytes, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return &panelError{Status: resp.StatusCode, Message: string(body)}
+	}
+	return nil
+}
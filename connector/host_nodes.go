@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 面板分配节点（HOST_ID）：
+// 设置 HOST_ID 后不必再手工维护 NODE_IDS / XRAY_TAG_MAP：connector 带 x-internal-token 与 x-host-id 请求
+// GET /api/internal/host-nodes，面板返回 nodes.config.host_id 等于该标识的节点及其 inbound_tag。
+// 每 HOST_NODES_INTERVAL_SECONDS 以及收到 nodes_changed 事件（管理员增删改节点、脚本重新注册）时重新查询，
+// 节点或 tag 有变化时按配置重新加载的流程切换（新增节点读回 last-good 并全量同步，去掉的节点不再同步）。
+// 每次查询成功后写 OUTPUT_DIR/host-nodes.json，启动时面板不可用就先用它。
+
+// hostNode 面板分配给本机的一个节点
+type hostNode struct {
+	NodeID     int    `json:"node_id"`
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	Port       int    `json:"port"`
+	Status     int    `json:"status"`
+	InboundTag string `json:"inbound_tag"` // nodes.config.inbound_tag，可为空
+}
+
+type hostNodesResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		HostID string     `json:"host_id"`
+		Nodes  []hostNode `json:"nodes"`
+	} `json:"data"`
+}
+
+// hostNodesFile host-nodes.json 内容
+type hostNodesFile struct {
+	HostID string     `json:"host_id"`
+	Nodes  []hostNode `json:"nodes"`
+}
+
+func hostNodesPath(cfg config) string {
+	return filepath.Join(cfg.OutputDir, "host-nodes.json")
+}
+
+// fetchHostNodes 向面板查询分配给本机的节点
+func fetchHostNodes(ctx context.Context, cfg config) ([]hostNode, error) {
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/host-nodes"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("x-host-id", cfg.HostID)
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, &panelError{Status: resp.StatusCode, Message: string(body)}
+	}
+	var parsed hostNodesResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("decode json failed: %w; body=%s", err, string(body))
+	}
+	if parsed.Code != 200 {
+		return nil, &panelError{Status: 200, Code: parsed.Code, Message: parsed.Message}
+	}
+	nodes := make([]hostNode, 0, len(parsed.Data.Nodes))
+	for _, n := range parsed.Data.Nodes {
+		if n.NodeID > 0 {
+			n.Protocol = strings.ToLower(n.Protocol)
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// saveHostNodes 落盘本次查询结果（内容没变时不写）
+func saveHostNodes(cfg config, nodes []hostNode) error {
+	b, err := json.MarshalIndent(hostNodesFile{HostID: cfg.HostID, Nodes: nodes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(cfg.OutputDir); err != nil {
+		return err
+	}
+	_, err = writeIfChanged(hostNodesPath(cfg), append(b, '\n'))
+	return err
+}
+
+// loadHostNodes 读回上次的查询结果；HOST_ID 换过时不用
+func loadHostNodes(cfg config) ([]hostNode, error) {
+	b, err := os.ReadFile(hostNodesPath(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var f hostNodesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("decode %s failed: %w", hostNodesPath(cfg), err)
+	}
+	if f.HostID != cfg.HostID {
+		return nil, fmt.Errorf("%s is for host %q", hostNodesPath(cfg), f.HostID)
+	}
+	return f.Nodes, nil
+}
+
+// initialHostNodes 启动时取节点分配：先查面板，失败时用上次落盘的结果
+func initialHostNodes(ctx context.Context, cfg config) ([]hostNode, error) {
+	nodes, err := fetchHostNodes(ctx, cfg)
+	if err == nil {
+		if err := saveHostNodes(cfg, nodes); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] save host nodes failed: %v\n", err)
+		}
+		return nodes, nil
+	}
+	cached, cerr := loadHostNodes(cfg)
+	if cerr != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[WARN] fetch host nodes failed, using %s: %v\n", hostNodesPath(cfg), err)
+	return cached, nil
+}
+
+func sameHostNodes(a, b []hostNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveHostNodes 按面板分配组装 NodeIDs 与 tag 映射：本地 XRAY_TAG_MAP / SINGBOX_TAG_MAP / nodes[].*_tag 优先，
+// 其次面板的 inbound_tag，xray-grpc 下都没有时按端口与协议在发现结果中匹配
+func resolveHostNodes(cfg config, nodes []hostNode) config {
+	cfg.HostNodes = nodes
+	cfg.NodeIDs = make([]int, 0, len(nodes))
+	cfg.XrayTagMap = make(map[int]string)
+	cfg.SingboxTagMap = make(map[int]string)
+	for id, tag := range cfg.LocalXrayTagMap {
+		cfg.XrayTagMap[id] = tag
+	}
+	for id, tag := range cfg.LocalSingboxTagMap {
+		cfg.SingboxTagMap[id] = tag
+	}
+	for _, n := range nodes {
+		cfg.NodeIDs = append(cfg.NodeIDs, n.NodeID)
+		tag := n.InboundTag
+		if tag == "" && cfg.ApplyMode == "xray-grpc" {
+			tag = matchInboundByPort(cfg, n)
+		}
+		if tag == "" {
+			continue
+		}
+		if _, ok := cfg.XrayTagMap[n.NodeID]; !ok {
+			cfg.XrayTagMap[n.NodeID] = tag
+		}
+		if _, ok := cfg.SingboxTagMap[n.NodeID]; !ok {
+			cfg.SingboxTagMap[n.NodeID] = tag
+		}
+	}
+	return cfg
+}
+
+// matchInboundByPort 面板节点没写 inbound_tag 时，找端口与协议都相同的唯一一个 inbound
+func matchInboundByPort(cfg config, n hostNode) string {
+	if n.Port <= 0 {
+		return ""
+	}
+	var tags []string
+	for tag, in := range cfg.XrayInbounds[xrayAddrForNode(cfg, n.NodeID)] {
+		if in.Port == n.Port && containsString(xrayProtocols, in.Protocol) && (n.Protocol == "" || n.Protocol == in.Protocol) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) != 1 {
+		return ""
+	}
+	return tags[0]
+}
+
+// dropInvalidHostNodes 跳过 tag 校验不通过的节点（xray-grpc）：面板里一个节点配错不影响本机其它节点，
+// 也不会把用户下发到猜出来的 inbound 上
+func dropInvalidHostNodes(cfg config) config {
+	if cfg.ApplyMode != "xray-grpc" {
+		return cfg
+	}
+	ids := make([]int, 0, len(cfg.NodeIDs))
+	owners := make(map[string]int)
+	for _, nodeID := range cfg.NodeIDs {
+		if err := checkXrayTag(cfg, nodeID); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] panel node skipped, set inbound_tag in its config: %v\n", err)
+			continue
+		}
+		if err := claimXrayTag(cfg, owners, nodeID); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] panel node skipped: %v\n", err)
+			continue
+		}
+		ids = append(ids, nodeID)
+	}
+	cfg.NodeIDs = ids
+	return cfg
+}
+
+// assignHostNodes 切换到新的节点分配：xray-grpc 下按新节点列表重新发现 inbound，再匹配 tag 并跳过有问题的节点
+func assignHostNodes(ctx context.Context, cfg config, nodes []hostNode) config {
+	cfg = resolveHostNodes(cfg, nodes)
+	if cfg.ApplyMode != "xray-grpc" {
+		return cfg
+	}
+	cfg.XrayInbounds = discoverXrayInbounds(ctx, cfg, cfg.XrayInbounds)
+	return dropInvalidHostNodes(resolveHostNodes(cfg, nodes))
+}
+
+// sameNodeMapping 节点列表与各节点 tag 是否相同
+func sameNodeMapping(a, b config) bool {
+	if len(a.NodeIDs) != len(b.NodeIDs) {
+		return false
+	}
+	for i, nodeID := range a.NodeIDs {
+		if b.NodeIDs[i] != nodeID || a.XrayTagMap[nodeID] != b.XrayTagMap[nodeID] || a.SingboxTagMap[nodeID] != b.SingboxTagMap[nodeID] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 踢下线（xray-grpc 模式，KICK_MODE 非 off 时）：
+// RemoveUser 只能拦住新的握手，已经建立的连接照常转发，被封禁的用户可以一直用到自己断线。
+// 用户被移除（面板封禁/到期、本地额度用完、设备数超限）后再切断其现有流量：
+// - route（默认）：通过 RoutingService 追加一条「该 inbound + 该用户 -> KICK_OUTBOUND_TAG（黑洞）」的路由规则，
+//   保持 KICK_COOLDOWN_SECONDS 后删除。路由规则只作用于新分发的请求（mux / XUDP 上新开的子连接也算），
+//   已经在转发的连接不受影响，要靠下面的 bounce 断开
+// - bounce：执行 KICK_BOUNCE_COMMAND（默认不设置；例如用 ss -K 断开该用户在线来源 IP 到该 inbound 端口的 TCP 连接，
+//   来源 IP 是共享/NAT 出口时会连带断开同一 IP 上其他用户的连接，需运营者自行决定是否开启），之后立即重新同步该节点
+// 踢出后每隔 KICK_CHECK_SECONDS 读一次该用户的流量计数器（不清零），确认流量已经停止；
+// route 模式下仍有流量且配置了 KICK_BOUNCE_COMMAND 时升级为 bounce，否则打 WARN，并继续复查到冷却结束。
+// 计数器按用户统计、不分 inbound：用户在本机其它节点上仍可用时无法据此确认，跳过复查。
+// 冷却期间用户被重新加回（续费、设备数冷却结束）时立即删除对应规则。
+// 注意：Xray 的路由规则只能追加在末尾，inbound 上有兜底规则（如 inboundTag -> direct）时追加的规则匹配不到，
+// 启动时（与配置重新加载时）检查 Xray 配置，发现这样的规则时打 WARN 退回 bounce / off；
+// 显式设置了 KICK_MODE=route 时直接报错（见 resolveKickMode）。
+
+// kickKey 一次踢出按「节点 + 用户」记录（路由规则带 inboundTag，只影响该节点）
+type kickKey struct {
+	nodeID int
+	uuid   string
+}
+
+type kickEntry struct {
+	ruleTag  string    // 已添加的路由规则，空表示没有
+	until    time.Time // 冷却结束、删除规则的时间
+	checkAt  time.Time // 下次复查流量的时间
+	baseline int64     // 上次读到的流量计数器
+	bounced  bool
+	stopped  bool // 已确认流量停止
+}
+
+type kickTracker struct {
+	mu      sync.Mutex
+	entries map[kickKey]*kickEntry
+
+	// bounce 之后需要重新同步的节点（inbound 可能被重建，动态添加的用户丢失），由主循环处理
+	resync chan int
+
+	routeUnsupportedWarned bool
+}
+
+// kicks 与 health 一样在同步、流量上报（本地限额）、设备数检查之间共用
+var kicks = &kickTracker{
+	entries: make(map[kickKey]*kickEntry),
+	resync:  make(chan int, 16),
+}
+
+func kickEnabled(cfg config) bool {
+	return cfg.ApplyMode == "xray-grpc" && cfg.KickMode != "off"
+}
+
+func kickRuleTag(nodeID int, uuid string) string {
+	return fmt.Sprintf("kick-%d-%s", nodeID, uuid)
+}
+
+// kick 用户刚从节点 inbound 移除后调用：切断其现有流量并登记复查
+func (k *kickTracker) kick(ctx context.Context, cfg config, nodeID int, uuids []string) {
+	if !kickEnabled(cfg) || len(uuids) == 0 {
+		return
+	}
+	x := xrayClientForNode(cfg, nodeID)
+	tag := xrayTagForNode(cfg, nodeID)
+	now := time.Now()
+
+	for _, uuid := range uuids {
+		baseline, err := x.userTrafficTotal(ctx, uuid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s read traffic before kick failed: %v\n", nodeID, uuid, err)
+		}
+		e := &kickEntry{until: now.Add(cfg.KickCooldown), checkAt: now.Add(cfg.KickCheckInterval), baseline: baseline}
+		if cfg.KickMode == "route" {
+			ruleTag := kickRuleTag(nodeID, uuid)
+			if err := x.addUserBlockRule(ctx, ruleTag, tag, uuid, cfg.KickOutboundTag); err != nil {
+				k.warnRouteFailed(nodeID, uuid, err)
+			} else {
+				e.ruleTag = ruleTag
+			}
+		}
+		k.mu.Lock()
+		if prev, ok := k.entries[kickKey{nodeID, uuid}]; ok && prev.ruleTag != "" && e.ruleTag == "" {
+			e.ruleTag = prev.ruleTag
+		}
+		k.entries[kickKey{nodeID, uuid}] = e
+		k.mu.Unlock()
+	}
+
+	if cfg.KickMode == "bounce" {
+		k.bounce(ctx, cfg, x, nodeID, uuids)
+	}
+	fmt.Printf("[INFO] node %d kicked %d users (mode=%s cooldown=%s)\n", nodeID, len(uuids), cfg.KickMode, cfg.KickCooldown)
+}
+
+func (k *kickTracker) warnRouteFailed(nodeID int, uuid string, err error) {
+	if isXrayUnsupportedErr(err) || strings.Contains(strings.ToLower(err.Error()), "unknown service") {
+		k.mu.Lock()
+		warned := k.routeUnsupportedWarned
+		k.routeUnsupportedWarned = true
+		k.mu.Unlock()
+		if !warned {
+			fmt.Fprintf(os.Stderr, "[WARN] xray RoutingService unavailable (add it to api.services), kick rules disabled: %v\n", err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s add kick rule failed: %v\n", nodeID, uuid, err)
+}
+
+// bounce 执行 KICK_BOUNCE_COMMAND，并让主循环重新同步该节点
+func (k *kickTracker) bounce(ctx context.Context, cfg config, x *xrayClient, nodeID int, uuids []string) {
+	if strings.TrimSpace(cfg.KickBounceCommand) == "" {
+		return
+	}
+	var ips []string
+	online, err := x.onlineUserIPs(ctx)
+	if err == nil {
+		for _, uuid := range uuids {
+			ips = append(ips, ipList(online[uuid])...)
+		}
+	}
+	if len(ips) == 0 && strings.Contains(cfg.KickBounceCommand, "{ips}") {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d kick bounce skipped: no online ips for %d users (enable statsUserOnline in xray policy; err=%v)\n", nodeID, len(uuids), err)
+		return
+	}
+	in, _ := xrayInboundForNode(cfg, nodeID)
+	if in.Port <= 0 && strings.Contains(cfg.KickBounceCommand, "{port}") {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d kick bounce skipped: port of inbound %s unknown\n", nodeID, xrayTagForNode(cfg, nodeID))
+		return
+	}
+	cmd := cfg.KickBounceCommand
+	cmd = strings.ReplaceAll(cmd, "{node_id}", strconv.Itoa(nodeID))
+	cmd = strings.ReplaceAll(cmd, "{tag}", xrayTagForNode(cfg, nodeID))
+	cmd = strings.ReplaceAll(cmd, "{port}", strconv.Itoa(in.Port))
+	cmd = strings.ReplaceAll(cmd, "{uuids}", strings.Join(uuids, ","))
+	cmd = strings.ReplaceAll(cmd, "{ips}", strings.Join(ips, " "))
+	if err := runShellCommand(ctx, cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d kick bounce command failed: %v\n", nodeID, err)
+		return
+	}
+	fmt.Printf("[INFO] node %d bounced %d users (ips=%d)\n", nodeID, len(uuids), len(ips))
+
+	k.mu.Lock()
+	for _, uuid := range uuids {
+		if e, ok := k.entries[kickKey{nodeID, uuid}]; ok {
+			e.bounced = true
+		}
+	}
+	k.mu.Unlock()
+	select {
+	case k.resync <- nodeID:
+	default:
+	}
+}
+
+// release 用户重新加回节点前调用：删除还在冷却中的踢出规则
+func (k *kickTracker) release(ctx context.Context, cfg config, nodeID int, uuids []string) {
+	if !kickEnabled(cfg) {
+		return
+	}
+	var rules []string
+	k.mu.Lock()
+	for _, uuid := range uuids {
+		key := kickKey{nodeID, uuid}
+		if e, ok := k.entries[key]; ok {
+			if e.ruleTag != "" {
+				rules = append(rules, e.ruleTag)
+			}
+			delete(k.entries, key)
+		}
+	}
+	k.mu.Unlock()
+	if len(rules) == 0 {
+		return
+	}
+	x := xrayClientForNode(cfg, nodeID)
+	for _, ruleTag := range rules {
+		if err := x.removeRule(ctx, ruleTag); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d remove kick rule %s failed: %v\n", nodeID, ruleTag, err)
+		}
+	}
+}
+
+// releaseAll 退出前（或重新加载关闭踢下线时）删除所有踢下线规则（之后没人按冷却时间删除，规则会一直留在 Xray 里）
+func (k *kickTracker) releaseAll(ctx context.Context, cfg config) {
+	if !kickEnabled(cfg) {
+		return
+	}
+	k.mu.Lock()
+	byNode := make(map[int][]string)
+	for key := range k.entries {
+		byNode[key.nodeID] = append(byNode[key.nodeID], key.uuid)
+	}
+	k.mu.Unlock()
+	for nodeID, uuids := range byNode {
+		k.release(ctx, cfg, nodeID, uuids)
+	}
+}
+
+func (k *kickTracker) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.entries)
+}
+
+// maintain 定期执行：复查被踢用户的流量是否已停止，冷却结束后删除规则
+func (k *kickTracker) maintain(ctx context.Context, cfg config) {
+	now := time.Now()
+	k.mu.Lock()
+	var due, expired []kickKey
+	for key, e := range k.entries {
+		switch {
+		case !now.Before(e.until):
+			expired = append(expired, key)
+		case !e.stopped && !now.Before(e.checkAt):
+			due = append(due, key)
+		}
+	}
+	k.mu.Unlock()
+	if len(due) == 0 && len(expired) == 0 {
+		return
+	}
+	sortKickKeys(due)
+	sortKickKeys(expired)
+
+	// 各节点当前下发的列表：判断用户是否还在其它节点上正常使用
+	applied := make(map[int][]string, len(cfg.NodeIDs))
+	if len(due) > 0 {
+		for _, nodeID := range cfg.NodeIDs {
+			applied[nodeID], _ = loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json"))
+		}
+	}
+
+	bounce := make(map[int][]string)
+	for _, key := range due {
+		if other := k.activeElsewhere(cfg, applied, key); other != 0 {
+			k.mu.Lock()
+			if e, ok := k.entries[key]; ok {
+				e.stopped = true
+			}
+			k.mu.Unlock()
+			fmt.Printf("[INFO] node %d uuid %s still active on node %d, traffic check after kick skipped\n", key.nodeID, key.uuid, other)
+			continue
+		}
+		total, err := xrayClientForNode(cfg, key.nodeID).userTrafficTotal(ctx, key.uuid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s read traffic after kick failed: %v\n", key.nodeID, key.uuid, err)
+			continue
+		}
+		k.mu.Lock()
+		e, ok := k.entries[key]
+		if !ok {
+			k.mu.Unlock()
+			continue
+		}
+		// 流量上报开启 reset 时计数器会被清零：读数变小但不为 0 说明清零之后仍有流量
+		moving := total > e.baseline || (total < e.baseline && total > 0)
+		e.baseline = total
+		e.checkAt = now.Add(cfg.KickCheckInterval)
+		escalate := moving && !e.bounced && cfg.KickBounceCommand != ""
+		if !moving {
+			e.stopped = true
+		}
+		bounced := e.bounced
+		k.mu.Unlock()
+
+		switch {
+		case !moving:
+			fmt.Printf("[INFO] node %d uuid %s traffic stopped after kick\n", key.nodeID, key.uuid)
+		case escalate:
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s still has traffic after kick, bouncing\n", key.nodeID, key.uuid)
+			bounce[key.nodeID] = append(bounce[key.nodeID], key.uuid)
+		default:
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s still has traffic after kick (bounced=%v)\n", key.nodeID, key.uuid, bounced)
+		}
+	}
+	for nodeID, uuids := range bounce {
+		k.bounce(ctx, cfg, xrayClientForNode(cfg, nodeID), nodeID, uuids)
+	}
+
+	for _, key := range expired {
+		k.mu.Lock()
+		e, ok := k.entries[key]
+		if ok {
+			delete(k.entries, key)
+		}
+		k.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if e.ruleTag != "" {
+			if err := xrayClientForNode(cfg, key.nodeID).removeRule(ctx, e.ruleTag); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d remove kick rule %s failed: %v\n", key.nodeID, e.ruleTag, err)
+			}
+		}
+		if !e.stopped {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s kick cooldown over, traffic stop not confirmed\n", key.nodeID, key.uuid)
+		}
+	}
+}
+
+// activeElsewhere 用户仍在本机哪个其它节点上可用（在 applied.json 中且没有被踢），0 表示没有
+func (k *kickTracker) activeElsewhere(cfg config, applied map[int][]string, key kickKey) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, nodeID := range cfg.NodeIDs {
+		if nodeID == key.nodeID || !containsString(applied[nodeID], key.uuid) {
+			continue
+		}
+		// 计数器在各自的 Xray 里：不同 API 地址上的节点不影响复查
+		if xrayAddrForNode(cfg, nodeID) != xrayAddrForNode(cfg, key.nodeID) {
+			continue
+		}
+		if _, kicked := k.entries[kickKey{nodeID, key.uuid}]; !kicked {
+			return nodeID
+		}
+	}
+	return 0
+}
+
+func sortKickKeys(keys []kickKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].nodeID != keys[j].nodeID {
+			return keys[i].nodeID < keys[j].nodeID
+		}
+		return keys[i].uuid < keys[j].uuid
+	})
+}
+
+// xrayConfigRule Xray 配置 routing.rules 中的一条规则（只取判断是否兜底所需的字段）
+type xrayConfigRule struct {
+	RuleTag    string   `json:"ruleTag"`
+	InboundTag []string `json:"inboundTag"`
+	Network    string   `json:"network"`
+	// 其余条件字段只关心是否设置
+	Conditions map[string]json.RawMessage `json:"-"`
+}
+
+// kickRuleNarrowing 规则上设置了这些字段之一时，只匹配部分流量，不会挡住追加的踢人规则
+var kickRuleNarrowing = []string{
+	"domain", "domains", "ip", "port", "sourcePort", "source", "sourceIP", "user", "protocol",
+	"attrs", "localIP", "localPort", "vlessRoute", "process",
+}
+
+// readXrayConfigRules 读取 Xray 配置文件与 confdir 片段中的 routing.rules
+func readXrayConfigRules(path, confDir string) ([]xrayConfigRule, error) {
+	_, files, err := readXrayConfigInbounds(path, confDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []xrayConfigRule
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var doc struct {
+			Routing struct {
+				Rules []json.RawMessage `json:"rules"`
+			} `json:"routing"`
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for _, raw := range doc.Routing.Rules {
+			var r xrayConfigRule
+			if err := json.Unmarshal(raw, &r); err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+			if err := json.Unmarshal(raw, &r.Conditions); err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// shadows 该规则是否会匹配 inbound tag 上的全部流量（踢人规则追加在末尾，永远轮不到）
+func (r xrayConfigRule) shadows(tag string) bool {
+	for _, key := range kickRuleNarrowing {
+		if v, ok := r.Conditions[key]; ok && !jsonEmpty(v) {
+			return false
+		}
+	}
+	if len(r.InboundTag) > 0 && !containsString(r.InboundTag, tag) {
+		return false
+	}
+	if r.Network != "" {
+		network := strings.ToLower(r.Network)
+		if !strings.Contains(network, "tcp") || !strings.Contains(network, "udp") {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonEmpty(v json.RawMessage) bool {
+	switch strings.TrimSpace(string(v)) {
+	case "", "null", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// checkKickRules route 模式下检查 Xray 配置里是否有规则兜住了节点的 inbound：
+// 有的话追加的踢人规则匹配不到，被封禁的用户连接照常转发
+func checkKickRules(cfg config) error {
+	if !kickEnabled(cfg) || cfg.KickMode != "route" || cfg.XrayConfigPath == "" && cfg.XrayConfDir == "" {
+		return nil
+	}
+	rules, err := readXrayConfigRules(cfg.XrayConfigPath, cfg.XrayConfDir)
+	if err != nil {
+		// 读不到配置文件（Xray 在其它机器上等）时无法检查
+		fmt.Fprintf(os.Stderr, "[WARN] kick: read xray routing rules failed, cannot check for catch-all rules: %v\n", err)
+		return nil
+	}
+	var errs []error
+	for _, nodeID := range cfg.NodeIDs {
+		tag := xrayTagForNode(cfg, nodeID)
+		for i, r := range rules {
+			if r.shadows(tag) {
+				name := r.RuleTag
+				if name == "" {
+					name = "#" + strconv.Itoa(i+1)
+				}
+				errs = append(errs, fmt.Errorf("node %d: xray routing rule %s matches all traffic of inbound %q, kick rules appended after it never match; narrow or remove it, or set KICK_MODE=bounce/off", nodeID, name, tag))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveKickMode 按 checkKickRules 的结果确定踢下线方式：route 规则不会生效时，
+// KICK_MODE 是默认值则打 WARN 退回 bounce（配置了 KICK_BOUNCE_COMMAND）或 off，照常同步用户、上报流量；
+// 运营者显式设置了 KICK_MODE=route 时返回错误
+func resolveKickMode(cfg config) (config, error) {
+	err := checkKickRules(cfg)
+	if err == nil {
+		return cfg, nil
+	}
+	if cfg.KickModeExplicit {
+		return cfg, err
+	}
+	fallback := "off"
+	if strings.TrimSpace(cfg.KickBounceCommand) != "" {
+		fallback = "bounce"
+	}
+	fmt.Fprintf(os.Stderr, "[WARN] kick: %v\n", err)
+	fmt.Fprintf(os.Stderr, "[WARN] kick: route mode cannot take effect, falling back to KICK_MODE=%s (set KICK_MODE=route explicitly to refuse to start instead)\n", fallback)
+	cfg.KickMode = fallback
+	return cfg, nil
+}
@@ -13,20 +13,40 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// version connector 版本，编译时注入：go build -ldflags "-X main.version=$(cat ../VERSION)"
+var version = "dev"
+
 type allowedUUIDsResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	Data    struct {
-		NodeID int      `json:"node_id"`
-		UUIDs  []string `json:"uuids"`
+		NodeID  int           `json:"node_id"`
+		Version int64         `json:"version"` // 列表版本（旧版面板没有该字段）
+		UUIDs   []string      `json:"uuids"`
+		Users   []allowedUser `json:"users"` // 新版面板附带的每用户限制（旧版没有该字段）
+		// 带 since 请求且面板保留了增量时，只返回 since 之后的变化（此时没有 uuids/users）
+		Since int64         `json:"since"`
+		Delta *allowedDelta `json:"delta"`
 	} `json:"data"`
 }
 
+// allowedUser 面板下发的单个用户及其限制
+type allowedUser struct {
+	UUID        string `json:"uuid"`
+	DeviceLimit int    `json:"device_limit"` // 同时在线设备（IP）数，0 表示不限
+	// 剩余流量（字节），-1 表示不限；旧版面板不下发（nil），此时不做本地限额
+	RemainingBytes *int64 `json:"remaining_bytes"`
+	// 到期时间（Unix 秒）；旧版面板不下发（nil），此时不做本地到期移除
+	ExpireAt *int64 `json:"expire_at"`
+}
+
 type config struct {
 	PanelBaseURL   string
 	InternalToken  string
@@ -43,11 +63,98 @@ type config struct {
 	XrayAPIAddr    string
 	XrayTagMap     map[int]string // node_id -> inbound tag
 	XrayVlessFlow  string
+	XraySSMethod   string
 	XrayRPCTimeout time.Duration
+	// Xray 配置（发现 inbound 的 tag / 协议 / flow），读不到时查询运行中的内核
+	XrayConfigPath string
+	XrayConfDir    string
+	XrayInbounds   map[string]map[string]xrayInbound // API 地址 -> tag -> inbound（发现结果，运行中更新）
+	// 全量对账周期：拉 Xray 实际用户列表与面板列表双向 diff
+	ReconcileInterval time.Duration
+	// Xray 重启检测与就绪等待
+	XrayWatchInterval time.Duration
+	XrayReadyTimeout  time.Duration
+
+	// sing-box apply
+	SingboxConfigPath string
+	SingboxTagMap     map[int]string // node_id -> inbound tag（未映射的节点列表下发到所有未映射 inbound）
+	SingboxReloadCmd  string
+
+	// 设备数限制（xray-grpc）：按在线 IP 数判断，超限临时移除用户
+	DeviceLimitInterval time.Duration // 0 表示关闭
+	DeviceLimitCooldown time.Duration
+	DeviceLimitDefault  int // 面板未下发限制时使用，0 表示不限
+	DeviceLimitStrikes  int // 连续多少次检查超限才移除
 
 	// traffic reporting
 	EnableTrafficReport bool
 	TrafficReportInterval time.Duration
+	TrafficResetStats     bool // 查询时清零 Xray 计数器，直接以读数作为增量
+	OutboxRetryBase       time.Duration
+	OutboxRetryMax        time.Duration
+	TrafficBulkReport     bool // 优先使用批量上报接口（面板不支持时自动退回逐条）
+	TrafficBulkMaxItems   int
+
+	// 在线用户/IP 上报（xray-grpc），0 表示关闭
+	OnlineReportInterval time.Duration
+
+	// 心跳上报，0 表示关闭
+	HeartbeatInterval time.Duration
+	XrayBin           string // 用于读取内核版本（xray version）
+
+	// 推送接口（兼容 node-agent.py），AgentListen 为空表示关闭
+	AgentListen       string
+	AgentToken        string
+	AgentNodeInfoFile string // /v1/node-info 返回的节点信息文件（一键脚本写的 node.json）
+
+	// 订阅面板变更事件（SSE），收到后立即同步
+	PanelEvents    bool
+	EventsDebounce time.Duration // 收到事件后等待该时长再同步，期间的事件合并为一次；0 表示立即同步
+
+	// 节点并发同步
+	SyncWorkers     int           // 同时处理的节点数
+	NodeSyncTimeout time.Duration // 单个节点一次同步的超时，0 表示不限
+
+	// 离线模式
+	OfflineMaxDuration time.Duration // 离线超过该时长后按 OfflinePolicy 处理，0 表示不限
+	OfflinePolicy      string        // open / closed
+
+	// 踢下线（xray-grpc）
+	KickMode          string        // route / bounce / off
+	KickModeExplicit  bool          // KICK_MODE 由运营者设置（而不是默认值）
+	KickOutboundTag   string        // route：黑洞 outbound 的 tag
+	KickCooldown      time.Duration // 踢出规则保留时长
+	KickCheckInterval time.Duration // 复查流量是否停止的间隔
+	KickBounceCommand string        // bounce：断开现有连接的命令，支持 {node_id} {tag} {port} {uuids} {ips}，空表示不执行
+
+	ShutdownTimeout time.Duration // 收到退出信号后收尾（最后一轮流量上报等）的最长时间
+
+	// 批量移除保护
+	MassRemovalMaxCount      int    // 一次最多直接移除的人数，0 表示不按人数判断
+	MassRemovalMaxPercent    int    // 一次最多直接移除上次人数的百分比，0 表示不按比例判断
+	MassRemovalMinUsers      int    // 上次人数少于该值时不按比例判断
+	MassRemovalConfirmations int    // 连续多少次相同列表后才全部生效
+	MassRemovalAction        string // hold / stagger
+
+	// 配置文件
+	ConfigPath          string             // 为空表示只用环境变量
+	ConfigHash          string             // 加载时文件内容的 sha256，用于检测变化
+	ConfigWatchInterval time.Duration      // 检查文件变化的间隔，0 表示只在 SIGHUP 时重新加载
+	Nodes               map[int]nodeConfig // 按节点覆盖的设置（配置文件 nodes 段）
+
+	// 面板分配节点（HOST_ID 为空表示关闭）：NodeIDs / XrayTagMap / SingboxTagMap 由 HostNodes 与本地 tag 合并得到
+	HostID             string
+	HostNodesInterval  time.Duration  // 定时重新查询的间隔，0 表示只在 nodes_changed 事件时查询
+	HostNodes          []hostNode     // 面板最近一次分配的节点
+	LocalXrayTagMap    map[int]string // 环境变量 / 配置文件中的 tag，优先于面板的 inbound_tag
+	LocalSingboxTagMap map[int]string
+
+	// 节点自注册（connector register / REGISTER_ON_START）
+	NodeName        string // 节点名前缀
+	NodePublicIP    string // 节点地址，为空时自动探测
+	RegisterOnStart bool
+	RegisterEnvFile string // 没有配置文件时写回 NODE_IDS / tag 映射的 env 文件
+	RegisterPlanIDs []int  // 注册时绑定的套餐，为空表示不改绑定
 }
 
 func env(key, def string) string {
@@ -127,208 +234,81 @@ func inferProtoFromTag(tag string) string {
 		return "vmess"
 	case strings.Contains(t, "vless"):
 		return "vless"
+	case strings.Contains(t, "trojan"):
+		return "trojan"
+	case strings.Contains(t, "shadowsocks") || strings.Contains(t, "ss2022") || hasTagToken(t, "ss"):
+		return "shadowsocks"
 	default:
 		// 先默认 vless（最常用）
 		return "vless"
 	}
 }
 
-func fetchAllowedUUIDs(ctx context.Context, cfg config, nodeID int) ([]string, error) {
+// hasTagToken 判断 tag 按 -/_/. 切分后是否含有指定片段（避免 "ss" 误匹配 "vless"）
+func hasTagToken(tag string, token string) bool {
+	for _, f := range strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+		if f == token {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchAllowedList 拉取节点允许列表；有缓存时带 If-None-Match / since 做条件请求。
+// 返回最新列表以及相对 cached 是否有变化（304 或空增量时为 false）。
+func fetchAllowedList(ctx context.Context, cfg config, nodeID int, cached *allowedList) (*allowedList, bool, error) {
 	url := strings.TrimRight(cfg.PanelBaseURL, "/") + fmt.Sprintf("/api/internal/nodes/%d/allowed-uuids", nodeID)
+	if cached != nil && cached.Version > 0 {
+		url += fmt.Sprintf("?since=%d", cached.Version)
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	req.Header.Set("x-internal-token", cfg.InternalToken)
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
 
 	client := &http.Client{Timeout: cfg.HTTPTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, false, nil
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("panel status=%d body=%s", resp.StatusCode, string(body))
+		return nil, false, fmt.Errorf("panel status=%d body=%s", resp.StatusCode, string(body))
 	}
 
 	var parsed allowedUUIDsResponse
 	if err := json.Unmarshal(body, &parsed); err != nil {
-		return nil, fmt.Errorf("decode json failed: %w; body=%s", err, string(body))
+		return nil, false, fmt.Errorf("decode json failed: %w; body=%s", err, string(body))
 	}
 	if parsed.Code != 200 {
-		return nil, fmt.Errorf("panel code=%d message=%s", parsed.Code, parsed.Message)
-	}
-	return parsed.Data.UUIDs, nil
-}
-
-// reportTraffic 上报流量到面板
-func reportTraffic(ctx context.Context, cfg config, nodeID int, uuid string, upload int64, download int64) error {
-	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/report-traffic"
-	payload := map[string]interface{}{
-		"uuid":      uuid,
-		"node_id":   nodeID,
-		"upload":    upload,
-		"download":  download,
-	}
-	bodyBytes, _ := json.Marshal(payload)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("x-internal-token", cfg.InternalToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: cfg.HTTPTimeout}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("panel status=%d body=%s", resp.StatusCode, string(body))
-	}
-
-	var result struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	}
-	body, _ := io.ReadAll(resp.Body)
-	if err := json.Unmarshal(body, &result); err == nil && result.Code != 200 {
-		return fmt.Errorf("panel code=%d message=%s", result.Code, result.Message)
-	}
-
-	return nil
-}
-
-// loadTrafficState 加载上次流量状态（用于计算增量）
-func loadTrafficState(path string) (map[string]struct {
-	Upload   int64 `json:"upload"`
-	Download int64 `json:"download"`
-}, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return make(map[string]struct {
-			Upload   int64 `json:"upload"`
-			Download int64 `json:"download"`
-		}), nil // 文件不存在时返回空 map
-	}
-
-	var state map[string]struct {
-		Upload   int64 `json:"upload"`
-		Download int64 `json:"download"`
-	}
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, err
-	}
-	return state, nil
-}
-
-// saveTrafficState 保存流量状态
-func saveTrafficState(path string, state map[string]struct {
-	Upload   int64 `json:"upload"`
-	Download int64 `json:"download"`
-}) error {
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0o644)
-}
-
-// reportTrafficOnce 上报一次流量（查询 Xray Stats 并上报增量）
-func reportTrafficOnce(ctx context.Context, cfg config, nodeID int, tag string) error {
-	// 加载 applied.json 获取当前活跃的 UUID 列表
-	nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
-	appliedPath := filepath.Join(nodeDir, "applied.json")
-	trafficStatePath := filepath.Join(nodeDir, "traffic-state.json")
-
-	appliedState, err := loadAppliedState(appliedPath)
-	if err != nil {
-		// applied.json 不存在或为空，跳过
-		return nil
-	}
-
-	if len(appliedState) == 0 {
-		return nil
-	}
-
-	// 加载上次流量状态
-	prevTraffic, err := loadTrafficState(trafficStatePath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[WARN] node %d load traffic state failed: %v\n", nodeID, err)
-		prevTraffic = make(map[string]struct {
-			Upload   int64 `json:"upload"`
-			Download int64 `json:"download"`
-		})
+		return nil, false, fmt.Errorf("panel code=%d message=%s", parsed.Code, parsed.Message)
 	}
 
-	// 创建 Xray 客户端
-	x := newXrayClient(cfg.XrayAPIAddr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow)
-
-	// 新的流量状态
-	newTraffic := make(map[string]struct {
-		Upload   int64 `json:"upload"`
-		Download int64 `json:"download"`
-	})
-
-	// 查询每个 UUID 的流量
-	for _, uuid := range appliedState {
-		upload, download, err := x.getUserTraffic(ctx, uuid)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s query traffic failed: %v\n", nodeID, uuid, err)
-			// 如果查询失败，使用上次的值（避免误报）
-			if prev, ok := prevTraffic[uuid]; ok {
-				newTraffic[uuid] = prev
-			} else {
-				newTraffic[uuid] = struct {
-					Upload   int64 `json:"upload"`
-					Download int64 `json:"download"`
-				}{0, 0}
-			}
-			continue
-		}
-
-		newTraffic[uuid] = struct {
-			Upload   int64 `json:"upload"`
-			Download int64 `json:"download"`
-		}{upload, download}
-
-		// 计算增量
-		var deltaUpload, deltaDownload int64
-		if prev, ok := prevTraffic[uuid]; ok {
-			deltaUpload = upload - prev.Upload
-			deltaDownload = download - prev.Download
-		} else {
-			// 第一次查询，增量就是当前值
-			deltaUpload = upload
-			deltaDownload = download
+	etag := resp.Header.Get("ETag")
+	if parsed.Data.Delta != nil {
+		if cached == nil || parsed.Data.Since != cached.Version {
+			// 增量基于的版本与本地缓存对不上：丢掉缓存重新拉全量
+			fmt.Fprintf(os.Stderr, "[WARN] node %d allowed list delta since=%d does not match local version, refetching full list\n", nodeID, parsed.Data.Since)
+			return fetchAllowedList(ctx, cfg, nodeID, nil)
 		}
-
-		// 只上报增量 > 0 的流量
-		if deltaUpload > 0 || deltaDownload > 0 {
-			if err := reportTraffic(ctx, cfg, nodeID, uuid, deltaUpload, deltaDownload); err != nil {
-				fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s report traffic failed: %v\n", nodeID, uuid, err)
-			} else {
-				fmt.Printf("[INFO] node %d uuid %s reported traffic: upload=%d download=%d\n", nodeID, uuid, deltaUpload, deltaDownload)
-			}
-		}
-	}
-
-	// 保存新的流量状态
-	if err := saveTrafficState(trafficStatePath, newTraffic); err != nil {
-		fmt.Fprintf(os.Stderr, "[WARN] node %d save traffic state failed: %v\n", nodeID, err)
+		d := parsed.Data.Delta
+		next := cached.applyDelta(parsed.Data.Version, etag, *d)
+		return next, len(d.Added) > 0 || len(d.Removed) > 0, nil
 	}
-
-	return nil
+	return newAllowedList(parsed.Data.Version, etag, parsed.Data.UUIDs, parsed.Data.Users), true, nil
 }
 
 // appliedEqualsNormalized 比较 applied.json 中的 UUID 列表与面板允许列表是否一致（集合相等）
@@ -370,7 +350,11 @@ func runApplyCommand(ctx context.Context, cmdTemplate string, nodeID int, uuidsF
 	cmd = strings.ReplaceAll(cmd, "{node_id}", strconv.Itoa(nodeID))
 	cmd = strings.ReplaceAll(cmd, "{uuids_file}", uuidsFile)
 	cmd = strings.ReplaceAll(cmd, "{uuids_json}", uuidsJSON)
+	return runShellCommand(ctx, cmd)
+}
 
+// runShellCommand 交给系统 shell 执行一条命令（输出直接透传到本进程）
+func runShellCommand(ctx context.Context, cmd string) error {
 	// 在 Windows / Linux 都尽量可用：交给 shell 解释
 	var c *exec.Cmd
 	if isWindows() {
@@ -387,165 +371,443 @@ func isWindows() bool {
 	return strings.Contains(strings.ToLower(os.Getenv("OS")), "windows") || os.PathSeparator == '\\'
 }
 
-func syncOnce(ctx context.Context, cfg config, lastHash map[int]string) error {
+// syncState 跨轮次保存的同步状态（仅内存，进程重启后首轮会做一次全量对账）
+// 各节点并发同步时会同时读写下面的 map，统一由 mu 保护；
+// 例外：deviceStrikes 只在主循环的 enforceDeviceLimits 中读写，不加锁
+type syncState struct {
+	mu sync.Mutex
+
+	lastHash      map[int]string    // node_id -> 上次成功应用的列表 hash
+	lastReconcile map[int]time.Time // node_id -> 上次与 Xray 实际用户全量对账的时间
+	xrayRestarted map[int]bool      // node_id -> 检测到 Xray 重启后尚未重新下发
+
+	deviceLimits  map[int]map[string]int    // node_id -> uuid -> 面板下发的设备数限制
+	deviceStrikes map[string]int            // uuid -> 连续超限次数
+	suspended     map[string]userSuspension // uuid -> 因超限被临时移除（冷却中）
+	quota         *quotaTracker             // 本地流量限额（与流量上报 goroutine 共用）
+
+	allowed     map[int]*allowedList       // node_id -> 上次拉到的允许列表（条件请求 / 增量同步）
+	massPending map[int]massRemovalPending // node_id -> 等待确认的可疑批量移除
+
+	lastGood      map[int]time.Time // node_id -> 上次从面板成功拿到列表的时间
+	lastGoodSaved map[int]time.Time // node_id -> 上次写 last-good.json 的时间
+	offlineErr    map[int]error     // node_id -> 离线中（本轮拉取失败、使用 last-good 列表）
+}
+
+func newSyncState() *syncState {
+	return &syncState{
+		lastHash:      make(map[int]string),
+		lastReconcile: make(map[int]time.Time),
+		xrayRestarted: make(map[int]bool),
+		deviceLimits:  make(map[int]map[string]int),
+		deviceStrikes: make(map[string]int),
+		suspended:     make(map[string]userSuspension),
+		quota:         newQuotaTracker(),
+		allowed:       make(map[int]*allowedList),
+		massPending:   make(map[int]massRemovalPending),
+		lastGood:      make(map[int]time.Time),
+		lastGoodSaved: make(map[int]time.Time),
+		offlineErr:    make(map[int]error),
+	}
+}
+
+// forceResync 忽略 hash 与对账周期，下一轮对这些节点全量下发（SIGHUP）
+func (st *syncState) forceResync(nodeIDs []int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, nodeID := range nodeIDs {
+		delete(st.lastHash, nodeID)
+		delete(st.lastReconcile, nodeID)
+	}
+}
+
+// markXrayRestarted Xray 重启后：清空 hash/对账记录，强制下一轮对所有节点全量下发
+func (st *syncState) markXrayRestarted(nodeIDs []int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, nodeID := range nodeIDs {
+		delete(st.lastHash, nodeID)
+		delete(st.lastReconcile, nodeID)
+		st.xrayRestarted[nodeID] = true
+	}
+}
+
+// reconcileDue 是否到了全量对账时间（interval<=0 表示每轮都对账）
+func (st *syncState) reconcileDue(nodeID int, interval time.Duration) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	last, ok := st.lastReconcile[nodeID]
+	return !ok || interval <= 0 || time.Since(last) >= interval
+}
+
+// markReconciled 记录一次成功的全量下发/对账
+func (st *syncState) markReconciled(nodeID int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastReconcile[nodeID] = time.Now()
+	delete(st.xrayRestarted, nodeID)
+}
+
+func (st *syncState) restartedFor(nodeID int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.xrayRestarted[nodeID]
+}
+
+func (st *syncState) hashFor(nodeID int) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.lastHash[nodeID]
+}
+
+func (st *syncState) setHash(nodeID int, hash string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastHash[nodeID] = hash
+}
+
+func (st *syncState) allowedFor(nodeID int) *allowedList {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.allowed[nodeID]
+}
+
+func (st *syncState) setAllowed(nodeID int, al *allowedList) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.allowed[nodeID] = al
+}
+
+// xrayTagForNode 取节点对应的 inbound tag
+func xrayTagForNode(cfg config, nodeID int) string {
+	tag := cfg.XrayTagMap[nodeID]
+	if tag == "" {
+		// 兜底（单节点场景）：Xray 里只有一个能下发用户的 inbound 时直接用它，否则用一键脚本的默认 tag
+		if tags := userInboundTags(cfg.XrayInbounds[xrayAddrForNode(cfg, nodeID)]); len(tags) == 1 {
+			return tags[0]
+		}
+		tag = defaultXrayTag
+	}
+	return tag
+}
+
+// defaultXrayTag 一键脚本生成的 inbound tag，未映射 tag 的节点默认使用
+const defaultXrayTag = "in-vless-reality"
+
+func syncOnce(ctx context.Context, cfg config, st *syncState) error {
+	return syncNodes(ctx, cfg, st, cfg.NodeIDs, nil)
+}
+
+// syncNodes 同步指定节点；pushed 中有的节点直接使用推送来的列表（agent 推送），不再向面板拉取。
+// 节点之间并发处理（最多 SYNC_WORKERS 个），每个节点有独立的超时（NODE_SYNC_TIMEOUT_SECONDS）和错误状态，
+// 一个节点卡住或失败不影响其它节点；FailFast 时第一个错误会取消其余节点并直接返回。
+func syncNodes(ctx context.Context, cfg config, st *syncState, nodeIDs []int, pushed map[int]*allowedList) error {
 	if err := ensureDir(cfg.OutputDir); err != nil {
 		return err
 	}
 
-	for _, nodeID := range cfg.NodeIDs {
-		uuids, err := fetchAllowedUUIDs(ctx, cfg, nodeID)
-		if err != nil {
-			if cfg.FailFast {
-				return fmt.Errorf("node %d fetch failed: %w", nodeID, err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := cfg.SyncWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+
+	type nodeResult struct {
+		nodeID      int
+		singboxHash string
+		err         error
+	}
+	results := make(chan nodeResult, len(nodeIDs))
+	var wg sync.WaitGroup
+	for _, nodeID := range nodeIDs {
+		wg.Add(1)
+		go func(nodeID int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results <- nodeResult{nodeID: nodeID, err: ctx.Err()}
+				return
+			}
+			nodeCtx := ctx
+			if cfg.NodeSyncTimeout > 0 {
+				var nodeCancel context.CancelFunc
+				nodeCtx, nodeCancel = context.WithTimeout(ctx, cfg.NodeSyncTimeout)
+				defer nodeCancel()
 			}
-			fmt.Fprintf(os.Stderr, "[WARN] node %d fetch failed: %v\n", nodeID, err)
+			hash, err := syncNode(nodeCtx, cfg, st, nodeID, pushed[nodeID])
+			if err != nil && cfg.FailFast {
+				cancel()
+			}
+			results <- nodeResult{nodeID: nodeID, singboxHash: hash, err: err}
+		}(nodeID)
+	}
+	wg.Wait()
+	close(results)
+
+	// singbox 模式下多个节点共用一份配置：只记下有变化的节点，最后统一渲染一次
+	singboxPending := make(map[int]string)
+	var errs []error
+	for r := range results {
+		if r.err != nil {
+			health.syncResult(r.nodeID, r.err)
+			errs = append(errs, r.err)
 			continue
 		}
+		if r.singboxHash != "" {
+			singboxPending[r.nodeID] = r.singboxHash
+		}
+	}
+	if len(errs) > 0 && cfg.FailFast {
+		// 其余节点因取消而失败的错误没有意义，只返回真正的第一个错误
+		for _, err := range errs {
+			if !errors.Is(err, context.Canceled) {
+				return err
+			}
+		}
+		return errs[0]
+	}
 
-		// 规范化：去空、去重、排序
-		seen := make(map[string]struct{}, len(uuids))
-		var normalized []string
-		for _, u := range uuids {
-			u = strings.TrimSpace(u)
-			if u == "" {
-				continue
+	if len(singboxPending) > 0 {
+		if err := applySingbox(ctx, cfg); err != nil {
+			if cfg.FailFast {
+				return fmt.Errorf("singbox apply failed: %w", err)
 			}
-			if _, ok := seen[u]; ok {
-				continue
+			fmt.Fprintf(os.Stderr, "[WARN] singbox apply failed: %v\n", err)
+			for nodeID := range singboxPending {
+				health.syncResult(nodeID, fmt.Errorf("singbox apply failed: %w", err))
 			}
-			seen[u] = struct{}{}
-			normalized = append(normalized, u)
+			// 不更新 lastHash，下一轮继续重试
+			return errors.Join(errs...)
+		}
+		for nodeID, hash := range singboxPending {
+			st.setHash(nodeID, hash)
+			health.syncResult(nodeID, st.syncWarning(nodeID))
+		}
+	}
+	// 其它节点已照常处理完，这里只汇总个别节点的严重错误（如写文件失败）
+	return errors.Join(errs...)
+}
+
+// syncNode 同步单个节点；返回非空 hash 表示 singbox 模式下该节点列表有变化、等待统一渲染。
+// 可恢复的失败（拉取/下发失败）记录到该节点的健康状态后返回 nil，FailFast 时返回错误。
+func syncNode(ctx context.Context, cfg config, st *syncState, nodeID int, pushed *allowedList) (string, error) {
+	al, modified := pushed, true
+	offline := false
+	if al == nil {
+		var err error
+		al, modified, err = fetchAllowedList(ctx, cfg, nodeID, st.allowedFor(nodeID))
+		if err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// 进程退出 / fail-fast 取消：不进入离线模式
+				return "", ctx.Err()
+			}
+			fetchErr := fmt.Errorf("fetch failed: %w", err)
+			if cfg.FailFast {
+				return "", nodeSyncFailed(cfg, nodeID, fetchErr)
+			}
+			// 离线模式：改用 last-good 列表（到期用户照常移除）；一次都没拿到过列表时保持 Xray 现状
+			if al = st.offlineList(cfg, nodeID, fetchErr); al == nil {
+				return "", nodeSyncFailed(cfg, nodeID, fetchErr)
+			}
+			offline, modified = true, false
+		}
+	}
+	if !offline {
+		st.setAllowed(nodeID, al)
+		st.markOnline(cfg, nodeID, al, modified)
+		if modified {
+			users := al.userList()
+			st.setDeviceLimits(nodeID, users)
+			st.quota.update(nodeID, users)
 		}
-		// 简单排序（字典序）
-		sortStrings(normalized)
 
-		jsonBytes, _ := json.MarshalIndent(map[string]any{
-			"node_id":    nodeID,
-			"generated":  time.Now().Format(time.RFC3339),
-			"uuids":      normalized,
-			"uuids_count": len(normalized),
-		}, "", "  ")
-		jsonBytes = append(jsonBytes, '\n')
+		// 批量移除保护：与上次写出的列表比较，可疑时先保留待移除的用户（缓存里仍是面板原始列表）
+		prevList, _ := loadAllowedUUIDsFile(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "allowed-uuids.json"))
+		al = st.guardMassRemoval(cfg, nodeID, al, prevList)
+	}
+
+	// 到期的用户在本地移除（离线时尤其重要：面板不可用期间不会再有人把他们移出列表）
+	al, expired := withoutExpired(al, time.Now())
+	if len(expired) > 0 {
+		fmt.Printf("[INFO] node %d %d users expired, removed locally\n", nodeID, len(expired))
+	}
 
-		txtBytes := []byte(strings.Join(normalized, "\n") + "\n")
+	// 规范化（去空、去重、排序）及 hash 在列表变化时已由 allowedList 算好
+	normalized := al.sorted
 
-		nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
-		if err := ensureDir(nodeDir); err != nil {
-			return err
-		}
+	jsonBytes, _ := json.MarshalIndent(map[string]any{
+		"node_id":    nodeID,
+		"generated":  time.Now().Format(time.RFC3339),
+		"uuids":      normalized,
+		"uuids_count": len(normalized),
+	}, "", "  ")
+	jsonBytes = append(jsonBytes, '\n')
 
-		jsonPath := filepath.Join(nodeDir, "allowed-uuids.json")
-		txtPath := filepath.Join(nodeDir, "allowed-uuids.txt")
-		appliedPath := filepath.Join(nodeDir, "applied.json")
+	txtBytes := al.txt
+
+	nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
+	if err := ensureDir(nodeDir); err != nil {
+		return "", fmt.Errorf("node %d: %w", nodeID, err)
+	}
 
-		hash := sha256Hex(jsonBytes)
-		skipByHash := (lastHash[nodeID] == hash)
-		// xray-grpc 下：若 applied.json 被删或与面板允许列表不一致（如 Xray 重启后 applied 被清空），必须重新 apply，不能仅因 hash 未变就跳过
-		if skipByHash && cfg.ApplyMode == "xray-grpc" {
-			applied, err := loadAppliedState(appliedPath)
-			if err != nil || !appliedEqualsNormalized(applied, normalized) {
+	jsonPath := filepath.Join(nodeDir, "allowed-uuids.json")
+	txtPath := filepath.Join(nodeDir, "allowed-uuids.txt")
+	appliedPath := filepath.Join(nodeDir, "applied.json")
+
+	// 只对 UUID 列表本身取 hash（jsonBytes 含 generated 时间戳，每轮都会变）
+	hash := al.hash
+	unchanged := (st.hashFor(nodeID) == hash)
+	skipByHash := unchanged
+	// xray-grpc 下：列表没变也要确认 Xray 里的用户确实还在（Xray 重启会清空动态添加的用户），
+	// 平时用 GetInboundUsersCount 廉价校验，到了全量对账周期再拉完整用户列表做双向 diff
+	// 因设备数超限被临时移除、或本地额度已用完的用户不下发到 Xray（applied.json 仍记录完整列表，流量照常统计）
+	desired := st.withoutBlocked(normalized)
+	if skipByHash && cfg.ApplyMode == "xray-grpc" {
+		if st.reconcileDue(nodeID, cfg.ReconcileInterval) {
+			skipByHash = false
+		} else {
+			x := xrayClientForNode(cfg, nodeID)
+			n, err := x.countInboundUsers(ctx, xrayTagForNode(cfg, nodeID))
+			switch {
+			case err == nil:
+				if n != int64(len(desired)) {
+					skipByHash = false
+				}
+			case isXrayUnsupportedErr(err):
+				// 老内核没有该接口：退回旧逻辑，按 applied.json 判断
+				applied, err := loadAppliedState(appliedPath)
+				if err != nil || !appliedEqualsNormalized(applied, normalized) {
+					skipByHash = false
+				}
+			default:
 				skipByHash = false
 			}
 		}
-		if skipByHash {
-			continue
-		}
+	}
+	if skipByHash {
+		health.syncResult(nodeID, st.syncWarning(nodeID))
+		return "", nil
+	}
 
-		changedJSON, err := writeIfChanged(jsonPath, jsonBytes)
-		if err != nil {
-			return err
-		}
-		changedTXT, err := writeIfChanged(txtPath, txtBytes)
-		if err != nil {
-			return err
-		}
+	changedJSON, err := writeIfChanged(jsonPath, jsonBytes)
+	if err != nil {
+		return "", fmt.Errorf("node %d: %w", nodeID, err)
+	}
+	changedTXT, err := writeIfChanged(txtPath, txtBytes)
+	if err != nil {
+		return "", fmt.Errorf("node %d: %w", nodeID, err)
+	}
 
-		if changedJSON || changedTXT {
-			fmt.Printf("[INFO] node %d updated uuids=%d (sha=%s)\n", nodeID, len(normalized), hash[:12])
-		}
+	if changedJSON || changedTXT {
+		fmt.Printf("[INFO] node %d updated uuids=%d (sha=%s)\n", nodeID, len(normalized), hash[:12])
+	}
 
-		// apply（两种模式：shell cmd 或 xray-grpc）
-		if cfg.ApplyMode == "xray-grpc" {
-			tag := cfg.XrayTagMap[nodeID]
-			if tag == "" {
-				// 兜底：允许只填一个 inbound tag（单节点场景）
-				tag = "in-vless-reality"
-			}
-			protoName := inferProtoFromTag(tag)
+	// apply（两种模式：shell cmd 或 xray-grpc）
+	if cfg.ApplyMode == "xray-grpc" {
+		tag := xrayTagForNode(cfg, nodeID)
+		protoName := xrayProtoForNode(cfg, nodeID)
+		x := xrayClientForNode(cfg, nodeID)
 
-			var prev []string
-			if b, err := os.ReadFile(appliedPath); err == nil && len(b) > 0 {
+		// 以 Xray 实际用户为准做 diff（包括手工加进去的用户）；老内核不支持时退回 applied.json
+		prev, err := x.listInboundUsers(ctx, tag)
+		if err != nil {
+			if !isXrayUnsupportedErr(err) {
+				return "", nodeSyncFailed(cfg, nodeID, fmt.Errorf("list xray users failed: %w", err))
+			}
+			prev = nil
+			// Xray 刚重启过：内存里已经没有用户，applied.json 不可信
+			if b, err := os.ReadFile(appliedPath); err == nil && len(b) > 0 && !st.restartedFor(nodeID) {
 				// loadAppliedState 期望文件存在；这里避免把不存在当错误
 				prev, _ = loadAppliedState(appliedPath)
 			}
+		}
 
-			prevSet := make(map[string]struct{}, len(prev))
-			for _, u := range prev {
-				prevSet[u] = struct{}{}
+		prevSet := make(map[string]struct{}, len(prev))
+		for _, u := range prev {
+			prevSet[u] = struct{}{}
+		}
+		nowSet := make(map[string]struct{}, len(desired))
+		for _, u := range desired {
+			nowSet[u] = struct{}{}
+		}
+
+		var toAdd []string
+		var toRemove []string
+		for u := range nowSet {
+			if _, ok := prevSet[u]; !ok {
+				toAdd = append(toAdd, u)
 			}
-			nowSet := make(map[string]struct{}, len(normalized))
-			for _, u := range normalized {
-				nowSet[u] = struct{}{}
+		}
+		for u := range prevSet {
+			if _, ok := nowSet[u]; !ok {
+				toRemove = append(toRemove, u)
 			}
+		}
+		sortStrings(toAdd)
+		sortStrings(toRemove)
+		if unchanged && (len(toAdd) > 0 || len(toRemove) > 0) {
+			fmt.Printf("[INFO] node %d xray drift detected: missing=%d unexpected=%d\n", nodeID, len(toAdd), len(toRemove))
+		}
 
-			var toAdd []string
-			var toRemove []string
-			for u := range nowSet {
-				if _, ok := prevSet[u]; !ok {
-					toAdd = append(toAdd, u)
+		var removed []string
+		applyErr := func() error {
+			// remove first, then add
+			for _, u := range toRemove {
+				if err := x.removeUser(ctx, tag, u); err != nil {
+					return fmt.Errorf("remove user failed: %w", err)
 				}
+				removed = append(removed, u)
 			}
-			for u := range prevSet {
-				if _, ok := nowSet[u]; !ok {
-					toRemove = append(toRemove, u)
+			kicks.release(ctx, cfg, nodeID, toAdd)
+			for _, u := range toAdd {
+				if err := x.addUser(ctx, tag, u, protoName); err != nil {
+					return fmt.Errorf("add user failed: %w", err)
 				}
 			}
-			sortStrings(toAdd)
-			sortStrings(toRemove)
+			return nil
+		}()
+		// 已移除的用户即使后续步骤失败也要切断现有连接
+		kicks.kick(ctx, cfg, nodeID, removed)
+		if applyErr != nil {
+			// 不更新 lastHash，下一轮继续重试
+			return "", nodeSyncFailed(cfg, nodeID, fmt.Errorf("xray-grpc apply failed: %w", applyErr))
+		}
 
-			x := newXrayClient(cfg.XrayAPIAddr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow)
-			applyErr := func() error {
-				// remove first, then add
-				for _, u := range toRemove {
-					if err := x.removeUser(ctx, tag, u); err != nil {
-						return fmt.Errorf("remove user failed: %w", err)
-					}
-				}
-				for _, u := range toAdd {
-					if err := x.addUser(ctx, tag, u, protoName); err != nil {
-						return fmt.Errorf("add user failed: %w", err)
-					}
-				}
-				return nil
-			}()
-			if applyErr != nil {
-				if cfg.FailFast {
-					return fmt.Errorf("node %d xray-grpc apply failed: %w", nodeID, applyErr)
-				}
-				fmt.Fprintf(os.Stderr, "[WARN] node %d xray-grpc apply failed: %v\n", nodeID, applyErr)
-				// 不更新 lastHash，下一轮继续重试
-				continue
-			}
+		st.markReconciled(nodeID)
 
-			if err := saveAppliedState(appliedPath, nodeID, normalized); err != nil {
-				if cfg.FailFast {
-					return fmt.Errorf("node %d save applied state failed: %w", nodeID, err)
-				}
-				fmt.Fprintf(os.Stderr, "[WARN] node %d save applied state failed: %v\n", nodeID, err)
-			}
-		} else {
-			if err := runApplyCommand(ctx, cfg.ApplyCommand, nodeID, txtPath, jsonPath); err != nil {
-				if cfg.FailFast {
-					return fmt.Errorf("node %d apply failed: %w", nodeID, err)
-				}
-				fmt.Fprintf(os.Stderr, "[WARN] node %d apply failed: %v\n", nodeID, err)
-				// 不更新 lastHash，下一轮继续重试
-				continue
+		if err := saveAppliedState(appliedPath, nodeID, normalized); err != nil {
+			if cfg.FailFast {
+				return "", fmt.Errorf("node %d save applied state failed: %w", nodeID, err)
 			}
+			fmt.Fprintf(os.Stderr, "[WARN] node %d save applied state failed: %v\n", nodeID, err)
 		}
+	} else if cfg.ApplyMode == "singbox" {
+		// 多个节点共用一份配置：由 syncNodes 在所有节点处理完后统一渲染
+		return hash, nil
+	} else {
+		if err := runApplyCommand(ctx, cfg.ApplyCommand, nodeID, txtPath, jsonPath); err != nil {
+			// 不更新 lastHash，下一轮继续重试
+			return "", nodeSyncFailed(cfg, nodeID, fmt.Errorf("apply failed: %w", err))
+		}
+	}
 
-		lastHash[nodeID] = hash
+	st.setHash(nodeID, hash)
+	health.syncResult(nodeID, st.syncWarning(nodeID))
+	return "", nil
+}
+
+// nodeSyncFailed 记录节点同步失败：FailFast 时返回错误，否则只打日志（下一轮重试）
+func nodeSyncFailed(cfg config, nodeID int, err error) error {
+	health.syncResult(nodeID, err)
+	if cfg.FailFast {
+		return fmt.Errorf("node %d %w", nodeID, err)
 	}
+	fmt.Fprintf(os.Stderr, "[WARN] node %d %v\n", nodeID, err)
 	return nil
 }
 
@@ -561,37 +823,117 @@ func sortStrings(a []string) {
 	}
 }
 
-func main() {
-	var (
-		flagOnce     = flag.Bool("once", false, "run once and exit")
-		flagFailFast = flag.Bool("fail-fast", false, "exit on first error")
-	)
-	flag.Parse()
+// loadConfig 读取配置文件（path 为空时跳过）与环境变量，组装并校验 config
+func loadConfig(path string, once, failFast bool) (config, error) {
+	src, fileNodes, configHash, err := readConfigFile(path)
+	if err != nil {
+		return config{}, err
+	}
 
-	panel := env("PANEL_BASE_URL", "http://localhost:3000")
-	token := env("INTERNAL_API_KEY", "")
-	nodeIDsStr := env("NODE_IDS", "")
-	outDir := env("OUTPUT_DIR", "./out")
-	applyCmd := env("APPLY_CMD", "")
-	applyMode := env("APPLY_MODE", "")
-	intervalSec := env("INTERVAL_SECONDS", "10")
-	httpTimeoutSec := env("HTTP_TIMEOUT_SECONDS", "10")
-	xrayAPIAddr := env("XRAY_API_ADDR", "127.0.0.1:10085")
-	xrayTagMapRaw := env("XRAY_TAG_MAP", "")
-	xrayVlessFlow := env("XRAY_VLESS_FLOW", "xtls-rprx-vision")
-	xrayRPCTimeoutSec := env("XRAY_RPC_TIMEOUT_SECONDS", "5")
-	enableTrafficReport := env("ENABLE_TRAFFIC_REPORT", "true")
-	trafficReportIntervalSec := env("TRAFFIC_REPORT_INTERVAL_SECONDS", "60")
+	panel := src.get("PANEL_BASE_URL", "http://localhost:3000")
+	token := src.get("INTERNAL_API_KEY", "")
+	outDir := src.get("OUTPUT_DIR", "./out")
+	applyCmd := src.get("APPLY_CMD", "")
+	applyMode := src.get("APPLY_MODE", "")
+	intervalSec := src.get("INTERVAL_SECONDS", "10")
+	httpTimeoutSec := src.get("HTTP_TIMEOUT_SECONDS", "10")
+	xrayAPIAddr := src.get("XRAY_API_ADDR", "127.0.0.1:10085")
+	xrayConfigPath := src.get("XRAY_CONFIG", "/etc/xray/config.json")
+	xrayConfDir := src.get("XRAY_CONFDIR", "")
+	xrayVlessFlow := src.get("XRAY_VLESS_FLOW", "xtls-rprx-vision")
+	xraySSMethod := src.get("XRAY_SS_METHOD", "2022-blake3-aes-128-gcm")
+	xrayRPCTimeoutSec := src.get("XRAY_RPC_TIMEOUT_SECONDS", "5")
+	reconcileIntervalSec := src.get("XRAY_RECONCILE_INTERVAL_SECONDS", "300")
+	xrayWatchIntervalSec := src.get("XRAY_WATCH_INTERVAL_SECONDS", "5")
+	xrayReadyTimeoutSec := src.get("XRAY_READY_TIMEOUT_SECONDS", "60")
+	enableTrafficReport := src.get("ENABLE_TRAFFIC_REPORT", "true")
+	trafficReportIntervalSec := src.get("TRAFFIC_REPORT_INTERVAL_SECONDS", "60")
+	xrayStatsReset := src.get("XRAY_STATS_RESET", "false")
+	outboxRetryBaseSec := src.get("TRAFFIC_OUTBOX_RETRY_BASE_SECONDS", "30")
+	outboxRetryMaxSec := src.get("TRAFFIC_OUTBOX_RETRY_MAX_SECONDS", "600")
+	trafficBulkReport := src.get("TRAFFIC_BULK_REPORT", "true")
+	trafficBulkMaxItemsRaw := src.get("TRAFFIC_BULK_MAX_ITEMS", "500")
+	singboxConfigPath := src.get("SINGBOX_CONFIG", "/opt/panel-node-sb/singbox/config.json")
+	singboxReloadCmd := src.get("SINGBOX_RELOAD_CMD", "docker kill --signal HUP panel_singbox")
+	onlineReportIntervalSec := src.get("ONLINE_REPORT_INTERVAL_SECONDS", "60")
+	heartbeatIntervalSec := src.get("HEARTBEAT_INTERVAL_SECONDS", "30")
+	xrayBin := src.get("XRAY_BIN", "xray")
+	agentListen := src.get("AGENT_LISTEN", "")
+	agentToken := src.get("AGENT_TOKEN", env("NODE_AGENT_TOKEN", ""))
+	agentNodeInfoFile := src.get("AGENT_NODE_INFO_FILE", "")
+	panelEvents := src.get("PANEL_EVENTS", "true")
+	eventsDebounceSec := src.get("EVENTS_DEBOUNCE_SECONDS", "")
+	syncWorkersRaw := src.get("SYNC_WORKERS", "4")
+	nodeSyncTimeoutSec := src.get("NODE_SYNC_TIMEOUT_SECONDS", "60")
+	massRemovalMaxCountRaw := src.get("MASS_REMOVAL_MAX_COUNT", "0")
+	massRemovalMaxPercentRaw := src.get("MASS_REMOVAL_MAX_PERCENT", "50")
+	massRemovalMinUsersRaw := src.get("MASS_REMOVAL_MIN_USERS", "10")
+	massRemovalConfirmationsRaw := src.get("MASS_REMOVAL_CONFIRMATIONS", "3")
+	massRemovalAction := src.get("MASS_REMOVAL_ACTION", "hold")
+	offlineMaxSec := src.get("OFFLINE_MAX_SECONDS", "86400")
+	offlinePolicy := src.get("OFFLINE_POLICY", "open")
+	kickMode := src.get("KICK_MODE", "route")
+	kickOutboundTag := src.get("KICK_OUTBOUND_TAG", "block")
+	kickCooldownSec := src.get("KICK_COOLDOWN_SECONDS", "600")
+	kickCheckSec := src.get("KICK_CHECK_SECONDS", "10")
+	kickBounceCommand := src.get("KICK_BOUNCE_COMMAND", "")
+	shutdownTimeoutSec := src.get("SHUTDOWN_TIMEOUT_SECONDS", "15")
+	deviceLimitIntervalSec := src.get("DEVICE_LIMIT_INTERVAL_SECONDS", "30")
+	deviceLimitCooldownSec := src.get("DEVICE_LIMIT_COOLDOWN_SECONDS", "300")
+	deviceLimitDefaultRaw := src.get("DEVICE_LIMIT_DEFAULT", "0")
+	deviceLimitStrikesRaw := src.get("DEVICE_LIMIT_STRIKES", "2")
+	configWatchSec := src.get("CONFIG_WATCH_SECONDS", "5")
+	hostID := src.get("HOST_ID", "")
+	hostNodesSec := src.get("HOST_NODES_INTERVAL_SECONDS", "60")
+	nodeName := src.get("NODE_NAME", "node")
+	nodePublicIP := src.get("NODE_PUBLIC_IP", "")
+	registerOnStart := src.get("REGISTER_ON_START", "false")
+	registerEnvFile := src.get("REGISTER_ENV_FILE", "")
+	registerPlanIDsRaw := src.get("REGISTER_PLAN_IDS", "")
 
 	if token == "" {
-		fmt.Fprintln(os.Stderr, "INTERNAL_API_KEY is empty (env). It must match backend .env.docker INTERNAL_API_KEY and be sent as x-internal-token.")
-		os.Exit(2)
+		return config{}, errors.New("INTERNAL_API_KEY is empty (env or config file). It must match backend .env.docker INTERNAL_API_KEY and be sent as x-internal-token.")
 	}
 
-	nodeIDs, err := parseNodeIDs(nodeIDsStr)
+	// 节点列表与 tag：配置文件 nodes 段，NODE_IDS / XRAY_TAG_MAP / SINGBOX_TAG_MAP 环境变量覆盖
+	var fileNodeIDs []int
+	xrayTags := make(map[int]string)
+	singboxTags := make(map[int]string)
+	nodes := make(map[int]nodeConfig)
+	for _, n := range fileNodes {
+		fileNodeIDs = append(fileNodeIDs, n.ID)
+		if n.XrayTag != "" {
+			xrayTags[n.ID] = n.XrayTag
+		}
+		if n.SingboxTag != "" {
+			singboxTags[n.ID] = n.SingboxTag
+		}
+		nodes[n.ID] = nodeConfig{
+			Protocol:    n.Protocol,
+			Flow:        n.Flow,
+			XrayAPIAddr: n.XrayAPIAddr,
+			Interval:    time.Duration(n.IntervalSeconds) * time.Second,
+		}
+	}
+	for id, tag := range parseTagMap(env("XRAY_TAG_MAP", "")) {
+		xrayTags[id] = tag
+	}
+	for id, tag := range parseTagMap(env("SINGBOX_TAG_MAP", "")) {
+		singboxTags[id] = tag
+	}
+	// HOST_ID 模式下节点由面板分配（启动后查询）；节点列表为空由 checkNodeIDs 检查（启动注册后可能就有了）
+	nodeIDs := fileNodeIDs
+	if hostID != "" {
+		nodeIDs = nil
+	} else if nodeIDsStr := env("NODE_IDS", ""); nodeIDsStr != "" {
+		nodeIDs, err = parseNodeIDs(nodeIDsStr)
+		if err != nil {
+			return config{}, fmt.Errorf("NODE_IDS parse failed: %w", err)
+		}
+	}
+	registerPlanIDs, err := parsePlanIDs(registerPlanIDsRaw)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NODE_IDS parse failed: %v\n", err)
-		os.Exit(2)
+		return config{}, fmt.Errorf("REGISTER_PLAN_IDS parse failed: %w", err)
 	}
 
 	sec, _ := strconv.Atoi(intervalSec)
@@ -607,6 +949,126 @@ func main() {
 		rpcSec = 5
 	}
 
+	reconcileSec, _ := strconv.Atoi(reconcileIntervalSec)
+	if reconcileSec < 0 {
+		reconcileSec = 300
+	}
+
+	watchSec, _ := strconv.Atoi(xrayWatchIntervalSec)
+	if watchSec < 0 {
+		watchSec = 5
+	}
+	readySec, _ := strconv.Atoi(xrayReadyTimeoutSec)
+	if readySec <= 0 {
+		readySec = 60
+	}
+
+	obBaseSec, _ := strconv.Atoi(outboxRetryBaseSec)
+	if obBaseSec <= 0 {
+		obBaseSec = 30
+	}
+	obMaxSec, _ := strconv.Atoi(outboxRetryMaxSec)
+	if obMaxSec < obBaseSec {
+		obMaxSec = obBaseSec
+	}
+
+	bulkMaxItems, _ := strconv.Atoi(trafficBulkMaxItemsRaw)
+	if bulkMaxItems <= 0 {
+		bulkMaxItems = 500
+	}
+
+	onlineSec, _ := strconv.Atoi(onlineReportIntervalSec)
+	if onlineSec < 0 {
+		onlineSec = 60
+	}
+
+	syncWorkers, _ := strconv.Atoi(syncWorkersRaw)
+	if syncWorkers <= 0 {
+		syncWorkers = 4
+	}
+	nodeSyncSec, _ := strconv.Atoi(nodeSyncTimeoutSec)
+	if nodeSyncSec < 0 {
+		nodeSyncSec = 60
+	}
+
+	massMaxCount, _ := strconv.Atoi(massRemovalMaxCountRaw)
+	if massMaxCount < 0 {
+		massMaxCount = 0
+	}
+	massMaxPercent, _ := strconv.Atoi(massRemovalMaxPercentRaw)
+	if massMaxPercent < 0 || massMaxPercent > 100 {
+		massMaxPercent = 50
+	}
+	massMinUsers, _ := strconv.Atoi(massRemovalMinUsersRaw)
+	if massMinUsers < 0 {
+		massMinUsers = 10
+	}
+	massConfirmations, _ := strconv.Atoi(massRemovalConfirmationsRaw)
+	if massConfirmations <= 0 {
+		massConfirmations = 3
+	}
+	massRemovalAction = strings.ToLower(strings.TrimSpace(massRemovalAction))
+	if massRemovalAction != "stagger" {
+		massRemovalAction = "hold"
+	}
+
+	offlineMax, _ := strconv.Atoi(offlineMaxSec)
+	if offlineMax < 0 {
+		offlineMax = 0
+	}
+	offlinePolicy = strings.ToLower(strings.TrimSpace(offlinePolicy))
+	if offlinePolicy != "closed" {
+		offlinePolicy = "open"
+	}
+
+	kickMode = strings.ToLower(strings.TrimSpace(kickMode))
+	if kickMode != "bounce" && kickMode != "off" {
+		kickMode = "route"
+	}
+	kickCooldown, _ := strconv.Atoi(kickCooldownSec)
+	if kickCooldown <= 0 {
+		kickCooldown = 600
+	}
+	kickCheck, _ := strconv.Atoi(kickCheckSec)
+	if kickCheck <= 0 {
+		kickCheck = 10
+	}
+	shutdownTimeout, _ := strconv.Atoi(shutdownTimeoutSec)
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 15
+	}
+
+	heartbeatSec, _ := strconv.Atoi(heartbeatIntervalSec)
+	if heartbeatSec < 0 {
+		heartbeatSec = 30
+	}
+
+	deviceSec, _ := strconv.Atoi(deviceLimitIntervalSec)
+	if deviceSec < 0 {
+		deviceSec = 30
+	}
+	deviceCooldownSec, _ := strconv.Atoi(deviceLimitCooldownSec)
+	if deviceCooldownSec <= 0 {
+		deviceCooldownSec = 300
+	}
+	deviceDefault, _ := strconv.Atoi(deviceLimitDefaultRaw)
+	if deviceDefault < 0 {
+		deviceDefault = 0
+	}
+	deviceStrikes, _ := strconv.Atoi(deviceLimitStrikesRaw)
+	if deviceStrikes <= 0 {
+		deviceStrikes = 2
+	}
+
+	configWatch, _ := strconv.Atoi(configWatchSec)
+	if configWatch < 0 {
+		configWatch = 5
+	}
+	hostNodesInterval, _ := strconv.Atoi(hostNodesSec)
+	if hostNodesInterval < 0 {
+		hostNodesInterval = 60
+	}
+
 	if strings.TrimSpace(applyMode) == "" {
 		if strings.TrimSpace(applyCmd) != "" {
 			applyMode = "cmd"
@@ -615,6 +1077,18 @@ func main() {
 		}
 	}
 
+	// sing-box 每次同步都要重载整个实例（断开本机所有连接）：默认把 10 秒内的事件合并成一次
+	if eventsDebounceSec == "" {
+		eventsDebounceSec = "0"
+		if applyMode == "singbox" {
+			eventsDebounceSec = "10"
+		}
+	}
+	eventsDebounce, _ := strconv.Atoi(eventsDebounceSec)
+	if eventsDebounce < 0 {
+		eventsDebounce = 0
+	}
+
 	enableTraffic := strings.ToLower(enableTrafficReport) == "true"
 	trafficSec, _ := strconv.Atoi(trafficReportIntervalSec)
 	if trafficSec <= 0 {
@@ -630,88 +1104,680 @@ func main() {
 		ApplyCommand:  applyCmd,
 		ApplyMode:     applyMode,
 		HTTPTimeout:   time.Duration(tsec) * time.Second,
-		Once:          *flagOnce,
-		FailFast:      *flagFailFast,
+		Once:          once,
+		FailFast:      failFast,
 
 		XrayAPIAddr:    xrayAPIAddr,
-		XrayTagMap:     parseTagMap(xrayTagMapRaw),
+		XrayTagMap:     xrayTags,
 		XrayVlessFlow:  xrayVlessFlow,
+		XraySSMethod:   xraySSMethod,
 		XrayRPCTimeout: time.Duration(rpcSec) * time.Second,
+		XrayConfigPath: xrayConfigPath,
+		XrayConfDir:    xrayConfDir,
+
+		ReconcileInterval: time.Duration(reconcileSec) * time.Second,
+		XrayWatchInterval: time.Duration(watchSec) * time.Second,
+		XrayReadyTimeout:  time.Duration(readySec) * time.Second,
+
+		SingboxConfigPath: singboxConfigPath,
+		SingboxTagMap:     singboxTags,
+		SingboxReloadCmd:  singboxReloadCmd,
+
+		DeviceLimitInterval: time.Duration(deviceSec) * time.Second,
+		DeviceLimitCooldown: time.Duration(deviceCooldownSec) * time.Second,
+		DeviceLimitDefault:  deviceDefault,
+		DeviceLimitStrikes:  deviceStrikes,
 
 		EnableTrafficReport:  enableTraffic,
 		TrafficReportInterval: time.Duration(trafficSec) * time.Second,
+		TrafficResetStats:     strings.ToLower(xrayStatsReset) == "true",
+		OutboxRetryBase:       time.Duration(obBaseSec) * time.Second,
+		OutboxRetryMax:        time.Duration(obMaxSec) * time.Second,
+		TrafficBulkReport:     strings.ToLower(trafficBulkReport) == "true",
+		TrafficBulkMaxItems:   bulkMaxItems,
+
+		OnlineReportInterval: time.Duration(onlineSec) * time.Second,
+
+		HeartbeatInterval: time.Duration(heartbeatSec) * time.Second,
+		XrayBin:           xrayBin,
+
+		AgentListen:       strings.TrimSpace(agentListen),
+		AgentToken:        strings.TrimSpace(agentToken),
+		AgentNodeInfoFile: agentNodeInfoFile,
+
+		PanelEvents:    strings.ToLower(panelEvents) == "true",
+		EventsDebounce: time.Duration(eventsDebounce) * time.Second,
+
+		SyncWorkers:     syncWorkers,
+		NodeSyncTimeout: time.Duration(nodeSyncSec) * time.Second,
+
+		MassRemovalMaxCount:      massMaxCount,
+		MassRemovalMaxPercent:    massMaxPercent,
+		MassRemovalMinUsers:      massMinUsers,
+		MassRemovalConfirmations: massConfirmations,
+		MassRemovalAction:        massRemovalAction,
+
+		OfflineMaxDuration: time.Duration(offlineMax) * time.Second,
+		OfflinePolicy:      offlinePolicy,
+
+		KickMode:          kickMode,
+		KickModeExplicit:  src.get("KICK_MODE", "") != "",
+		KickOutboundTag:   kickOutboundTag,
+		KickCooldown:      time.Duration(kickCooldown) * time.Second,
+		KickCheckInterval: time.Duration(kickCheck) * time.Second,
+		KickBounceCommand: kickBounceCommand,
+
+		ShutdownTimeout: time.Duration(shutdownTimeout) * time.Second,
+
+		ConfigPath:          path,
+		ConfigHash:          configHash,
+		ConfigWatchInterval: time.Duration(configWatch) * time.Second,
+		Nodes:               nodes,
+
+		HostID:             hostID,
+		HostNodesInterval:  time.Duration(hostNodesInterval) * time.Second,
+		LocalXrayTagMap:    xrayTags,
+		LocalSingboxTagMap: singboxTags,
+
+		NodeName:        nodeName,
+		NodePublicIP:    strings.TrimSpace(nodePublicIP),
+		RegisterOnStart: strings.ToLower(registerOnStart) == "true",
+		RegisterEnvFile: registerEnvFile,
+		RegisterPlanIDs: registerPlanIDs,
+	}
+	return cfg, nil
+}
+
+// checkNodeIDs 非 HOST_ID 模式下必须有节点（NODE_IDS、配置文件 nodes 段或启动注册的结果）
+func checkNodeIDs(cfg config) error {
+	if cfg.HostID == "" && len(cfg.NodeIDs) == 0 {
+		return errors.New("NODE_IDS is empty (set NODE_IDS, nodes in the config file, HOST_ID, or run connector register)")
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "register" {
+		os.Exit(runRegister(os.Args[2:]))
 	}
+	var (
+		flagOnce     = flag.Bool("once", false, "run once and exit")
+		flagFailFast = flag.Bool("fail-fast", false, "exit on first error")
+		flagConfig   = flag.String("config", env("CONNECTOR_CONFIG", ""), "config file (JSON); env vars override its settings")
+	)
+	flag.Parse()
 
-	fmt.Printf("[INFO] connector started panel=%s nodes=%v interval=%s out=%s\n", cfg.PanelBaseURL, cfg.NodeIDs, cfg.Interval, cfg.OutputDir)
+	cfg, err := loadConfig(*flagConfig, *flagOnce, *flagFailFast)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	if cfg.RegisterOnStart {
+		cfg = registerOnStart(cfg)
+	}
+	if err := checkNodeIDs(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	var hostErr error
+	if cfg.HostID != "" {
+		if env("NODE_IDS", "") != "" {
+			fmt.Fprintf(os.Stderr, "[WARN] HOST_ID is set, NODE_IDS is ignored (nodes are assigned by the panel)\n")
+		}
+		var nodes []hostNode
+		nodes, hostErr = initialHostNodes(context.Background(), cfg)
+		if hostErr != nil && (cfg.Once || cfg.FailFast) {
+			fmt.Fprintf(os.Stderr, "host nodes: %v\n", hostErr)
+			os.Exit(1)
+		}
+		cfg = resolveHostNodes(cfg, nodes)
+	}
+	if cfg.ApplyMode == "xray-grpc" {
+		// 发现 inbound 并校验 tag：写错的 tag 在启动时就暴露，而不是等到下发用户时报错
+		discoverCtx, cancelDiscover := context.WithTimeout(context.Background(), cfg.XrayRPCTimeout)
+		cfg.XrayInbounds = discoverXrayInbounds(discoverCtx, cfg, nil)
+		cancelDiscover()
+		if cfg.HostID != "" {
+			// 面板分配的节点：按发现结果匹配 tag，配错的节点跳过而不是退出
+			cfg = dropInvalidHostNodes(resolveHostNodes(cfg, cfg.HostNodes))
+		} else if errs := checkXrayTags(cfg); len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "config: %v\n", errors.Join(errs...))
+			os.Exit(2)
+		}
+		var kickErr error
+		if cfg, kickErr = resolveKickMode(cfg); kickErr != nil {
+			fmt.Fprintf(os.Stderr, "config: %v\n", kickErr)
+			os.Exit(2)
+		}
+	}
+
+	fmt.Printf("[INFO] connector %s started panel=%s nodes=%v interval=%s out=%s workers=%d\n", version, cfg.PanelBaseURL, cfg.NodeIDs, cfg.Interval, cfg.OutputDir, cfg.SyncWorkers)
+	if cfg.HostID != "" {
+		if hostErr != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] host %s: no node assignment from panel yet, will retry: %v\n", cfg.HostID, hostErr)
+		} else {
+			fmt.Printf("[INFO] host %s: panel assigned %d node(s), refresh=%s\n", cfg.HostID, len(cfg.HostNodes), cfg.HostNodesInterval)
+		}
+	}
 	if cfg.ApplyMode == "xray-grpc" {
 		fmt.Printf("[INFO] apply mode: xray-grpc api=%s vless_flow=%s\n", cfg.XrayAPIAddr, cfg.XrayVlessFlow)
 		if len(cfg.XrayTagMap) > 0 {
 			fmt.Printf("[INFO] xray tag map: %v\n", cfg.XrayTagMap)
-		} else {
-			fmt.Printf("[WARN] XRAY_TAG_MAP is empty; default inbound tag will be used: in-vless-reality\n")
+		} else if len(cfg.NodeIDs) > 0 {
+			fmt.Printf("[WARN] XRAY_TAG_MAP is empty; inbound tag will be used: %s\n", xrayTagForNode(cfg, cfg.NodeIDs[0]))
+		}
+	} else if cfg.ApplyMode == "singbox" {
+		fmt.Printf("[INFO] apply mode: singbox config=%s reload=%q\n", cfg.SingboxConfigPath, cfg.SingboxReloadCmd)
+		fmt.Fprintf(os.Stderr, "[WARN] singbox mode: every user list change reloads sing-box and drops all existing connections on this host; use APPLY_MODE=xray-grpc to add/remove users without that\n")
+		if len(cfg.SingboxTagMap) > 0 {
+			fmt.Printf("[INFO] sing-box tag map: %v\n", cfg.SingboxTagMap)
 		}
 	} else if cfg.ApplyCommand != "" {
 		fmt.Printf("[INFO] apply command enabled: %s\n", cfg.ApplyCommand)
 	}
 	if cfg.EnableTrafficReport {
-		fmt.Printf("[INFO] traffic reporting enabled: interval=%s\n", cfg.TrafficReportInterval)
+		fmt.Printf("[INFO] traffic reporting enabled: interval=%s reset_stats=%v\n", cfg.TrafficReportInterval, cfg.TrafficResetStats)
 	}
+	if cfg.ApplyMode == "xray-grpc" && cfg.OnlineReportInterval > 0 {
+		fmt.Printf("[INFO] online report enabled: interval=%s\n", cfg.OnlineReportInterval)
+	}
+	if cfg.ApplyMode == "xray-grpc" && cfg.DeviceLimitInterval > 0 {
+		fmt.Printf("[INFO] device limit enabled: interval=%s cooldown=%s strikes=%d default=%d\n", cfg.DeviceLimitInterval, cfg.DeviceLimitCooldown, cfg.DeviceLimitStrikes, cfg.DeviceLimitDefault)
+	}
+	if cfg.ConfigPath != "" {
+		fmt.Printf("[INFO] config file: %s watch=%s\n", cfg.ConfigPath, cfg.ConfigWatchInterval)
+		logNodeConfig(cfg)
+	}
+
+	st := newSyncState()
+	st.restoreLastGood(cfg, cfg.NodeIDs)
+	started := time.Now()
+
+	// 退出信号取消 ctx：进行中的 RPC / HTTP 请求立即返回，主循环处理完当前这一步后退出
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resyncC := make(chan struct{}, 1)
+	statusC := make(chan struct{}, 1)
+	sigC := make(chan os.Signal, 4)
+	notifySignals(sigC)
+	go func() {
+		for sig := range sigC {
+			switch {
+			case isResyncSignal(sig):
+				select {
+				case resyncC <- struct{}{}:
+				default:
+				}
+			case isStatusSignal(sig):
+				select {
+				case statusC <- struct{}{}:
+				default:
+				}
+			case ctx.Err() != nil:
+				fmt.Fprintf(os.Stderr, "[WARN] received %s again, exiting immediately\n", sig)
+				os.Exit(1)
+			default:
+				fmt.Printf("[INFO] received %s, shutting down\n", sig)
+				cancel()
+			}
+		}
+	}()
 
-	lastHash := make(map[int]string)
-	ctx := context.Background()
+	// handleSyncErr 打印同步错误；退出过程中被取消的错误忽略，FailFast 时直接退出
+	handleSyncErr := func(err error) {
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "sync failed: %v\n", err)
+		if cfg.FailFast {
+			os.Exit(1)
+		}
+	}
 
 	if cfg.Once {
-		if err := syncOnce(ctx, cfg, lastHash); err != nil {
+		if err := syncOnce(ctx, cfg, st); err != nil {
 			fmt.Fprintf(os.Stderr, "sync failed: %v\n", err)
 			os.Exit(1)
 		}
 		return
 	}
 
-	syncTicker := time.NewTicker(cfg.Interval)
+	// 各节点可以有自己的同步间隔：ticker 取最短的间隔，每次只同步轮到的节点
+	syncTicker := time.NewTicker(syncTickInterval(cfg))
 	defer syncTicker.Stop()
-
-	var trafficTicker *time.Ticker
+	lastPeriodic := make(map[int]time.Time)
+
+	// 未启用的 ticker 保持 nil channel，select 永远不会选中
+	// ticker 保留在外层，配置重新加载时启停或调整间隔
+	var trafficC <-chan time.Time
+	// 定时任务的开关也可以在重新加载时切换（见 switchConfig），退出时停掉当时启用的
+	var trafficTicker, watchTicker, deviceTicker, onlineTicker, kickTicker, heartbeatTicker, configTicker, hostTicker *time.Ticker
+	defer func() {
+		for _, t := range []*time.Ticker{trafficTicker, watchTicker, deviceTicker, onlineTicker, kickTicker, heartbeatTicker, configTicker, hostTicker} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+	}()
+	// 首次流量上报：协程只等 Xray API 就绪，上报本身回到主循环做，与定时上报串行
+	// （两者同时跑会读到同一份 traffic-state / outbox，重复计费并互相覆盖）；等待期间定时上报先跳过
+	var trafficReadyC chan error
+	initialTrafficPending := false
 	if cfg.EnableTrafficReport && cfg.ApplyMode == "xray-grpc" {
 		trafficTicker = time.NewTicker(cfg.TrafficReportInterval)
-		defer trafficTicker.Stop()
-		// 立即执行一次流量上报（延迟 5 秒，等待 Xray 启动）
+		trafficC = trafficTicker.C
+		trafficReadyC = make(chan error, 1)
+		initialTrafficPending = true
+		readyC, readyCfg := trafficReadyC, cfg
 		go func() {
-			time.Sleep(5 * time.Second)
-			for _, nodeID := range cfg.NodeIDs {
-				tag := cfg.XrayTagMap[nodeID]
-				if tag == "" {
-					tag = "in-vless-reality"
-				}
-				if err := reportTrafficOnce(ctx, cfg, nodeID, tag); err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] node %d initial traffic report failed: %v\n", nodeID, err)
-				}
+			// 多个 Xray（节点各自的 xray_api_addr）时等全部就绪；只有部分就绪时照常上报，没就绪的下一轮再报
+			ready, err := waitXrayReadyAll(ctx, readyCfg, readyCfg.XrayReadyTimeout)
+			if err != nil && ready > 0 {
+				fmt.Fprintf(os.Stderr, "[WARN] some xray apis not ready, their traffic waits for the next report: %v\n", err)
+				err = nil
 			}
+			readyC <- err
 		}()
 	}
 
+	var watchC <-chan time.Time
+	// 每个 Xray API 地址一个探测状态
+	watches := make(map[string]*xrayWatch)
+	for _, addr := range xrayAPIAddrs(cfg) {
+		watches[addr] = &xrayWatch{}
+	}
+	if cfg.ApplyMode == "xray-grpc" && cfg.XrayWatchInterval > 0 {
+		watchTicker = time.NewTicker(cfg.XrayWatchInterval)
+		watchC = watchTicker.C
+	}
+
+	var deviceC <-chan time.Time
+	if cfg.ApplyMode == "xray-grpc" && cfg.DeviceLimitInterval > 0 {
+		deviceTicker = time.NewTicker(cfg.DeviceLimitInterval)
+		deviceC = deviceTicker.C
+	}
+
+	var onlineC <-chan time.Time
+	if cfg.ApplyMode == "xray-grpc" && cfg.OnlineReportInterval > 0 {
+		onlineTicker = time.NewTicker(cfg.OnlineReportInterval)
+		onlineC = onlineTicker.C
+	}
+
+	var kickC <-chan time.Time
+	var kickResyncC <-chan int
+	if kickEnabled(cfg) {
+		kickTicker = time.NewTicker(cfg.KickCheckInterval)
+		kickC = kickTicker.C
+		kickResyncC = kicks.resync
+	}
+
+	var heartbeatC <-chan time.Time
+	hb := &heartbeat{}
+	if cfg.HeartbeatInterval > 0 {
+		heartbeatTicker = time.NewTicker(cfg.HeartbeatInterval)
+		heartbeatC = heartbeatTicker.C
+	}
+
+	// 推送接口：HTTP 协程把推送交给主循环执行，与定期同步串行，不会并发改 Xray
+	var agentC chan agentPush
+	if cfg.AgentListen != "" {
+		if cfg.AgentToken == "" {
+			fmt.Fprintf(os.Stderr, "[WARN] AGENT_LISTEN is set but AGENT_TOKEN is empty; agent requests will be rejected\n")
+		}
+		agentC = make(chan agentPush)
+		agentCtx, cancelAgent := context.WithCancel(ctx)
+		defer cancelAgent()
+		startAgentServer(agentCtx, cfg, agentC)
+	}
+
+	var eventC chan panelEvent
+	cancelEvents := func() {}
+	startEvents := func() {
+		var eventsCtx context.Context
+		eventsCtx, cancelEvents = context.WithCancel(ctx)
+		go runEventStream(eventsCtx, cfg, eventC)
+	}
+	if cfg.PanelEvents {
+		eventC = make(chan panelEvent, 16)
+		startEvents()
+	}
+	defer func() { cancelEvents() }()
+
+	var configC <-chan time.Time
+	if cfg.ConfigPath != "" && cfg.ConfigWatchInterval > 0 {
+		configTicker = time.NewTicker(cfg.ConfigWatchInterval)
+		configC = configTicker.C
+	}
+
+	var hostC <-chan time.Time
+	if cfg.HostID != "" && cfg.HostNodesInterval > 0 {
+		hostTicker = time.NewTicker(cfg.HostNodesInterval)
+		hostC = hostTicker.C
+	}
+
+	// switchConfig 切换到新配置（配置重新加载、面板重新分配节点）：调整各定时任务，新增节点读回 last-good，
+	// 然后对所有节点全量同步一次；去掉的节点不再同步
+	switchConfig := func(next config, reason string) {
+		prev := cfg
+		cfg = next
+		added, removed := diffNodeIDs(prev.NodeIDs, cfg.NodeIDs)
+		for _, nodeID := range removed {
+			fmt.Printf("[INFO] node %d removed (%s), no longer synced (its xray users are left as is)\n", nodeID, reason)
+			delete(lastPeriodic, nodeID)
+		}
+		if len(added) > 0 {
+			fmt.Printf("[INFO] nodes %v added (%s)\n", added, reason)
+			st.restoreLastGood(cfg, added)
+		}
+
+		resetTicker(syncTicker, syncTickInterval(prev), syncTickInterval(cfg))
+		xrayGRPC := cfg.ApplyMode == "xray-grpc"
+		if setTicker(&trafficTicker, &trafficC, cfg.EnableTrafficReport && xrayGRPC, prev.TrafficReportInterval, cfg.TrafficReportInterval, "traffic report", reason) && trafficTicker == nil {
+			// 关闭时首次上报还在等 Xray 就绪：不再等
+			trafficReadyC, initialTrafficPending = nil, false
+		}
+		setTicker(&watchTicker, &watchC, xrayGRPC && cfg.XrayWatchInterval > 0, prev.XrayWatchInterval, cfg.XrayWatchInterval, "xray watch", reason)
+		if xrayGRPC {
+			// 节点的 API 地址有增减：新地址从头开始探测（首次探测不触发重新下发，本次切换已全量同步），去掉的不再探测
+			addrs := xrayAPIAddrs(cfg)
+			next := make(map[string]*xrayWatch, len(addrs))
+			for _, addr := range addrs {
+				if w, ok := watches[addr]; ok {
+					next[addr] = w
+				} else {
+					next[addr] = &xrayWatch{}
+				}
+			}
+			if !slices.Equal(xrayAPIAddrs(prev), addrs) {
+				fmt.Printf("[INFO] xray api addresses changed (%s): %v\n", reason, addrs)
+			}
+			watches = next
+		}
+		setTicker(&deviceTicker, &deviceC, xrayGRPC && cfg.DeviceLimitInterval > 0, prev.DeviceLimitInterval, cfg.DeviceLimitInterval, "device limit check", reason)
+		setTicker(&onlineTicker, &onlineC, xrayGRPC && cfg.OnlineReportInterval > 0, prev.OnlineReportInterval, cfg.OnlineReportInterval, "online report", reason)
+		if setTicker(&kickTicker, &kickC, kickEnabled(cfg), prev.KickCheckInterval, cfg.KickCheckInterval, "kick", reason) {
+			if kickTicker == nil {
+				// 关闭踢下线：删除还在冷却中的规则（按旧配置找到对应的 Xray）
+				kicks.releaseAll(ctx, prev)
+				kickResyncC = nil
+			} else {
+				kickResyncC = kicks.resync
+			}
+		}
+		setTicker(&heartbeatTicker, &heartbeatC, cfg.HeartbeatInterval > 0, prev.HeartbeatInterval, cfg.HeartbeatInterval, "heartbeat", reason)
+		setTicker(&configTicker, &configC, cfg.ConfigPath != "" && cfg.ConfigWatchInterval > 0, prev.ConfigWatchInterval, cfg.ConfigWatchInterval, "config watch", reason)
+		setTicker(&hostTicker, &hostC, cfg.HostID != "" && cfg.HostNodesInterval > 0, prev.HostNodesInterval, cfg.HostNodesInterval, "host nodes refresh", reason)
+		if eventC != nil && (cfg.PanelBaseURL != prev.PanelBaseURL || cfg.InternalToken != prev.InternalToken || len(added) > 0 || len(removed) > 0) {
+			// 事件流连接用的是旧地址/token/节点列表：重连
+			cancelEvents()
+			startEvents()
+		}
+
+		st.forceResync(cfg.NodeIDs)
+		handleSyncErr(syncOnce(ctx, cfg, st))
+	}
+
+	// reloadConfig 重新加载配置文件：校验失败保留当前配置并返回 false；成功后切换到新配置
+	reloadConfig := func(reason string) bool {
+		next, err := loadConfig(cfg.ConfigPath, cfg.Once, cfg.FailFast)
+		if err == nil {
+			err = checkNodeIDs(next)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] config reload (%s) failed, keeping current config: %v\n", reason, err)
+			// 文件内容没再变化时不重复报错
+			if hash, err := fileSHA256(cfg.ConfigPath); err == nil {
+				cfg.ConfigHash = hash
+			}
+			return false
+		}
+		next = keepRestartOnly(cfg, next)
+		if next.HostID != "" {
+			next = resolveHostNodes(next, cfg.HostNodes)
+		}
+		if next.ApplyMode == "xray-grpc" {
+			next.XrayInbounds = discoverXrayInbounds(ctx, next, cfg.XrayInbounds)
+			if next.HostID != "" {
+				next = dropInvalidHostNodes(resolveHostNodes(next, next.HostNodes))
+			} else if errs := checkXrayTags(next); len(errs) > 0 {
+				fmt.Fprintf(os.Stderr, "[WARN] config reload (%s) failed, keeping current config: %v\n", reason, errors.Join(errs...))
+				cfg.ConfigHash = next.ConfigHash
+				return false
+			}
+			var kickErr error
+			if next, kickErr = resolveKickMode(next); kickErr != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] config reload (%s) failed, keeping current config: %v\n", reason, kickErr)
+				cfg.ConfigHash = next.ConfigHash
+				return false
+			}
+		}
+		fmt.Printf("[INFO] config reloaded (%s): nodes=%v interval=%s\n", reason, next.NodeIDs, next.Interval)
+		logNodeConfig(next)
+		switchConfig(next, "config "+reason)
+		return true
+	}
+
+	// refreshHostNodes 重新查询面板分配给本机的节点，节点或 tag 有变化时切换；返回是否切换
+	refreshHostNodes := func(reason string) bool {
+		nodes, err := fetchHostNodes(ctx, cfg)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "[WARN] host nodes refresh (%s) failed, keeping current nodes: %v\n", reason, err)
+			}
+			return false
+		}
+		if err := saveHostNodes(cfg, nodes); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] save host nodes failed: %v\n", err)
+		}
+		if sameHostNodes(cfg.HostNodes, nodes) {
+			return false
+		}
+		next := assignHostNodes(ctx, cfg, nodes)
+		if sameNodeMapping(cfg, next) {
+			// 只有名称、状态等变化
+			cfg.HostNodes = next.HostNodes
+			cfg.XrayInbounds = next.XrayInbounds
+			return false
+		}
+		tags := make(map[int]string, len(next.NodeIDs))
+		for _, nodeID := range next.NodeIDs {
+			if next.ApplyMode == "singbox" {
+				tags[nodeID] = next.SingboxTagMap[nodeID]
+			} else {
+				tags[nodeID] = xrayTagForNode(next, nodeID)
+			}
+		}
+		fmt.Printf("[INFO] panel node assignment changed (%s): nodes=%v tags=%v\n", reason, next.NodeIDs, tags)
+		logNodeConfig(next)
+		switchConfig(next, "panel assignment")
+		return true
+	}
+
+	// 面板事件先攒进 events，EVENTS_DEBOUNCE_SECONDS 后（为 0 时立即）由 flushEvents 统一同步
+	var events *eventBatch
+	var eventFlushC <-chan time.Time
+	flushEvents := func() {
+		b := events
+		events = nil
+		if b == nil {
+			return
+		}
+		// 节点有增删改、或事件流（重新）连上可能错过了变更：重新查询本机的节点分配，切换时已全量同步
+		if cfg.HostID != "" && (b.full || b.nodesChanged) {
+			reason := "panel event"
+			if b.full {
+				reason = "event stream connected"
+			}
+			if refreshHostNodes(reason) {
+				return
+			}
+		}
+		var ids []int
+		for _, id := range cfg.NodeIDs {
+			if b.full || b.nodes[id] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return
+		}
+		if b.usersChanged != nil {
+			if b.count > 1 {
+				fmt.Printf("[INFO] panel event %s (%s) and %d more, syncing nodes %v\n", b.usersChanged.Type, b.usersChanged.Reason, b.count-1, ids)
+			} else {
+				fmt.Printf("[INFO] panel event %s (%s), syncing nodes %v\n", b.usersChanged.Type, b.usersChanged.Reason, ids)
+			}
+		}
+		handleSyncErr(syncNodes(ctx, cfg, st, ids, nil))
+	}
+
+loop:
 	for {
 		select {
-		case <-syncTicker.C:
-			if err := syncOnce(ctx, cfg, lastHash); err != nil {
-				fmt.Fprintf(os.Stderr, "sync failed: %v\n", err)
-				if cfg.FailFast {
-					os.Exit(1)
+		case <-ctx.Done():
+			break loop
+		case <-resyncC:
+			if cfg.ConfigPath != "" && reloadConfig("SIGHUP") {
+				continue
+			}
+			fmt.Printf("[INFO] resync requested, re-applying all nodes\n")
+			st.forceResync(cfg.NodeIDs)
+			handleSyncErr(syncOnce(ctx, cfg, st))
+		case <-configC:
+			if hash, err := fileSHA256(cfg.ConfigPath); err == nil && hash != cfg.ConfigHash {
+				reloadConfig("file changed")
+			}
+		case <-hostC:
+			refreshHostNodes("interval")
+		case <-statusC:
+			dumpStatus(cfg, st, started)
+		case ev := <-eventC:
+			// 合并连续到达的事件：通道里已有的直接并入，再等合并窗口结束，只同步一次
+			if events == nil {
+				events = &eventBatch{nodes: make(map[int]bool)}
+			}
+			events.add(cfg, ev)
+		drain:
+			for {
+				select {
+				case more := <-eventC:
+					events.add(cfg, more)
+				default:
+					break drain
 				}
 			}
-		case <-trafficTicker.C:
-			if cfg.EnableTrafficReport && cfg.ApplyMode == "xray-grpc" {
-				for _, nodeID := range cfg.NodeIDs {
-					tag := cfg.XrayTagMap[nodeID]
-					if tag == "" {
-						tag = "in-vless-reality"
+			if cfg.EventsDebounce <= 0 {
+				flushEvents()
+			} else if eventFlushC == nil {
+				eventFlushC = time.After(cfg.EventsDebounce)
+			}
+		case <-eventFlushC:
+			eventFlushC = nil
+			flushEvents()
+		case p := <-agentC:
+			err := applyAgentPush(ctx, cfg, st, p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d agent push apply failed: %v\n", p.nodeID, err)
+			}
+			p.done <- err
+		case <-kickC:
+			kicks.maintain(ctx, cfg)
+		case nodeID := <-kickResyncC:
+			// bounce 可能重建了 inbound：立即把用户补回去（列表没变时按 Xray 实际用户数校验）
+			handleSyncErr(syncNodes(ctx, cfg, st, []int{nodeID}, nil))
+		case <-heartbeatC:
+			if err := hb.send(ctx, cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] heartbeat failed: %v\n", err)
+			}
+		case <-onlineC:
+			if err := reportOnlineAll(ctx, cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] online report failed: %v\n", err)
+			}
+		case <-deviceC:
+			if err := enforceDeviceLimits(ctx, cfg, st); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] device limit check failed: %v\n", err)
+			}
+		case <-watchC:
+			// 逐个地址探测：记下重启过的地址，以及 API 刚恢复、需要补做发现的情况
+			var restartedAddrs, reasons []string
+			rediscover := false
+			for _, addr := range xrayAPIAddrs(cfg) {
+				w := watches[addr]
+				if w == nil {
+					w = &xrayWatch{}
+					watches[addr] = w
+				}
+				wasUp := w.up
+				restarted, reason := w.check(ctx, newXrayClient(addr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow, cfg.XraySSMethod))
+				if restarted {
+					restartedAddrs = append(restartedAddrs, addr)
+					reasons = append(reasons, addr+": "+reason)
+				}
+				if restarted || (!wasUp && w.up && xrayDiscoveryIncomplete(cfg)) {
+					rediscover = true
+				}
+			}
+			var restartedNodes []int
+			for _, addr := range restartedAddrs {
+				restartedNodes = append(restartedNodes, xrayAddrNodes(cfg, addr)...)
+			}
+			reason := strings.Join(reasons, "; ")
+			if rediscover {
+				// Xray 重启后配置可能变了；启动时 Xray 还没就绪的，API 可用后补做发现
+				cfg.XrayInbounds = discoverXrayInbounds(ctx, cfg, cfg.XrayInbounds)
+				if cfg.HostID != "" {
+					// 面板分配的节点按新的发现结果重新匹配 tag（之前跳过的节点可能已经可用）
+					if next := dropInvalidHostNodes(resolveHostNodes(cfg, cfg.HostNodes)); !sameNodeMapping(cfg, next) {
+						if len(restartedAddrs) > 0 {
+							fmt.Printf("[INFO] xray restart detected (%s), re-applying all nodes\n", reason)
+							st.markXrayRestarted(next.NodeIDs)
+						}
+						switchConfig(next, "xray inbounds changed")
+						continue
 					}
-					if err := reportTrafficOnce(ctx, cfg, nodeID, tag); err != nil {
-						fmt.Fprintf(os.Stderr, "[WARN] node %d traffic report failed: %v\n", nodeID, err)
+				} else {
+					for _, err := range checkXrayTags(cfg) {
+						fmt.Fprintf(os.Stderr, "[WARN] %v\n", err)
 					}
 				}
 			}
+			if len(restartedNodes) > 0 {
+				// 只重新下发用到重启过的 Xray 的节点
+				fmt.Printf("[INFO] xray restart detected (%s), re-applying nodes %v\n", reason, restartedNodes)
+				st.markXrayRestarted(restartedNodes)
+				handleSyncErr(syncNodes(ctx, cfg, st, restartedNodes, nil))
+			}
+		case now := <-syncTicker.C:
+			ids := dueNodes(cfg, lastPeriodic, now)
+			for _, nodeID := range ids {
+				lastPeriodic[nodeID] = now
+			}
+			if len(ids) > 0 {
+				handleSyncErr(syncNodes(ctx, cfg, st, ids, nil))
+			}
+		case err := <-trafficReadyC:
+			trafficReadyC = nil
+			initialTrafficPending = false
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] initial traffic report skipped: %v\n", err)
+			} else if cfg.EnableTrafficReport && cfg.ApplyMode == "xray-grpc" {
+				if err := reportTrafficAll(ctx, cfg, st.quota); err != nil {
+					fmt.Fprintf(os.Stderr, "[WARN] initial traffic report failed: %v\n", err)
+				}
+			}
+		case <-trafficC:
+			if initialTrafficPending {
+				// 首次上报还在等 Xray 就绪
+				break
+			}
+			if cfg.EnableTrafficReport && cfg.ApplyMode == "xray-grpc" {
+				if err := reportTrafficAll(ctx, cfg, st.quota); err != nil {
+					fmt.Fprintf(os.Stderr, "[WARN] traffic report failed: %v\n", err)
+				}
+			}
 		}
 	}
+
+	shutdown(cfg, st)
 }
 
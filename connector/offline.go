@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 离线模式：
+// 每次从面板成功拉到列表后落盘到 node-<id>/last-good.json（含每用户限制与 expire_at、version/ETag、拉取时间），
+// 进程启动时先读回作为本地缓存。拉取失败（面板宕机、网络中断）时不再原样保留 Xray 里的用户，
+// 而是以这份 last-good 列表继续走正常的下发流程：
+// - 面板下发了 expire_at 的用户到期后在本地移除（在线时同样生效，不必等面板缓存刷新）
+// - 离线超过 OFFLINE_MAX_SECONDS 后按 OFFLINE_POLICY 处理：open 继续使用 last-good 列表，closed 移除所有用户
+// 离线期间不做批量移除保护（列表来自本地，不是面板的可疑响应），节点同步结果记为拉取失败。
+
+// lastGoodSaveInterval 列表没变化（304）时 last-good.json 最多隔多久刷新一次拉取时间
+const lastGoodSaveInterval = 5 * time.Minute
+
+// lastGoodFile last-good.json 内容
+type lastGoodFile struct {
+	NodeID    int           `json:"node_id"`
+	Version   int64         `json:"version"`
+	ETag      string        `json:"etag"`
+	FetchedAt string        `json:"fetched_at"`
+	UUIDs     []string      `json:"uuids"`
+	Users     []allowedUser `json:"users"`
+}
+
+func lastGoodPath(cfg config, nodeID int) string {
+	return filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "last-good.json")
+}
+
+func saveLastGood(cfg config, nodeID int, al *allowedList, fetchedAt time.Time) error {
+	b, err := json.MarshalIndent(lastGoodFile{
+		NodeID:    nodeID,
+		Version:   al.Version,
+		ETag:      al.ETag,
+		FetchedAt: fetchedAt.Format(time.RFC3339),
+		UUIDs:     al.sorted,
+		Users:     al.userList(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := ensureDir(filepath.Dir(lastGoodPath(cfg, nodeID))); err != nil {
+		return err
+	}
+	return writeFileAtomic(lastGoodPath(cfg, nodeID), b, 0o644)
+}
+
+func loadLastGood(cfg config, nodeID int) (*allowedList, time.Time, error) {
+	b, err := os.ReadFile(lastGoodPath(cfg, nodeID))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var doc lastGoodFile
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, time.Time{}, err
+	}
+	fetchedAt, err := time.Parse(time.RFC3339, doc.FetchedAt)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("bad fetched_at: %w", err)
+	}
+	return newAllowedList(doc.Version, doc.ETag, doc.UUIDs, doc.Users), fetchedAt, nil
+}
+
+// restoreLastGood 读回节点的 last-good 列表作为本地缓存（启动时、配置重新加载新增节点时）
+func (st *syncState) restoreLastGood(cfg config, nodeIDs []int) {
+	for _, nodeID := range nodeIDs {
+		al, fetchedAt, err := loadLastGood(cfg, nodeID)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d load last-good list failed: %v\n", nodeID, err)
+			}
+			continue
+		}
+		st.setAllowed(nodeID, al)
+		users := al.userList()
+		st.setDeviceLimits(nodeID, users)
+		st.quota.update(nodeID, users)
+		st.mu.Lock()
+		st.lastGood[nodeID] = fetchedAt
+		st.lastGoodSaved[nodeID] = fetchedAt
+		st.mu.Unlock()
+		fmt.Printf("[INFO] node %d restored last-good list uuids=%d fetched_at=%s\n", nodeID, len(al.sorted), fetchedAt.Format(time.RFC3339))
+	}
+}
+
+// markOnline 面板拉取（或推送）成功：记录时间，列表有变化或距上次落盘太久时写 last-good.json
+func (st *syncState) markOnline(cfg config, nodeID int, al *allowedList, modified bool) {
+	now := time.Now()
+	st.mu.Lock()
+	st.lastGood[nodeID] = now
+	wasOffline := st.offlineErr[nodeID] != nil
+	delete(st.offlineErr, nodeID)
+	save := modified || now.Sub(st.lastGoodSaved[nodeID]) >= lastGoodSaveInterval
+	st.mu.Unlock()
+
+	if wasOffline {
+		fmt.Printf("[INFO] node %d panel reachable again, leaving offline mode\n", nodeID)
+	}
+	if !save {
+		return
+	}
+	if err := saveLastGood(cfg, nodeID, al, now); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d save last-good list failed: %v\n", nodeID, err)
+		return
+	}
+	st.mu.Lock()
+	st.lastGoodSaved[nodeID] = now
+	st.mu.Unlock()
+}
+
+// offlineList 拉取失败时使用的列表；没有 last-good 列表时返回 nil（保持 Xray 现状）
+func (st *syncState) offlineList(cfg config, nodeID int, fetchErr error) *allowedList {
+	cached := st.allowedFor(nodeID)
+	if cached == nil {
+		return nil
+	}
+	st.mu.Lock()
+	offlineFor := time.Since(st.lastGood[nodeID]).Truncate(time.Second)
+	st.offlineErr[nodeID] = fmt.Errorf("%w (offline %s, using last-good list)", fetchErr, offlineFor)
+	st.mu.Unlock()
+
+	if cfg.OfflineMaxDuration > 0 && offlineFor > cfg.OfflineMaxDuration {
+		if cfg.OfflinePolicy == "closed" {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d offline for %s (> %s), fail-closed: removing all users\n", nodeID, offlineFor, cfg.OfflineMaxDuration)
+			return newAllowedList(cached.Version, cached.ETag, nil, nil)
+		}
+		fmt.Fprintf(os.Stderr, "[WARN] node %d offline for %s (> %s), fail-open: keeping last-good list uuids=%d\n", nodeID, offlineFor, cfg.OfflineMaxDuration, len(cached.sorted))
+		return cached
+	}
+	fmt.Fprintf(os.Stderr, "[WARN] node %d %v, offline for %s, using last-good list uuids=%d\n", nodeID, fetchErr, offlineFor, len(cached.sorted))
+	return cached
+}
+
+// withoutExpired 去掉已到期（expire_at <= now）的用户；没有到期用户时原样返回
+func withoutExpired(al *allowedList, now time.Time) (*allowedList, []string) {
+	var expired []string
+	for _, u := range al.sorted {
+		if v, ok := al.users[u]; ok && v.ExpireAt != nil && *v.ExpireAt <= now.Unix() {
+			expired = append(expired, u)
+		}
+	}
+	if len(expired) == 0 {
+		return al, nil
+	}
+	keep := make([]string, 0, len(al.sorted)-len(expired))
+	users := make([]allowedUser, 0, len(al.users))
+	j := 0
+	for _, u := range al.sorted {
+		if j < len(expired) && expired[j] == u {
+			j++
+			continue
+		}
+		keep = append(keep, u)
+		if v, ok := al.users[u]; ok {
+			users = append(users, v)
+		}
+	}
+	return newAllowedList(al.Version, al.ETag, keep, users), expired
+}
+
+// syncWarning 节点同步本身成功、但仍需上报的异常（离线使用 last-good 列表、批量移除拦截中）
+func (st *syncState) syncWarning(nodeID int) error {
+	st.mu.Lock()
+	offline := st.offlineErr[nodeID]
+	st.mu.Unlock()
+	return errors.Join(offline, st.massRemovalErr(nodeID))
+}
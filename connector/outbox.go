@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 流量上报 outbox：
+// 增量先落盘到 OUTPUT_DIR/node-<id>/traffic-outbox.json，再尝试上报；面板确认后才从 outbox 删除。
+// 面板不可用时按指数退避重试，connector 重启后继续补报，保证 users.traffic_used 不丢。
+// 每条记录带产生时间 ts，面板按 ts 写入 user_traffic_minute，补报的流量仍落在原来的分钟里。
+// 每条记录还带一个固定的上报 ID（节点:UUID:窗口起-窗口止），超时重试、进程重启后补报都用同一个 ID，
+// 面板据此去重，同一段流量不会被记两次账。
+
+type outboxEntry struct {
+	ID          string `json:"id"` // 上报 ID，面板幂等键
+	UUID        string `json:"uuid"`
+	Upload      int64  `json:"upload"`
+	Download    int64  `json:"download"`
+	WindowStart int64  `json:"window_start,omitempty"` // 增量窗口起点（上次读数时间，unix 秒；未知为 0）
+	TS          int64  `json:"ts"`                     // 增量产生时间 = 窗口终点（unix 秒）
+}
+
+type trafficOutbox struct {
+	Entries     []outboxEntry `json:"entries"`
+	Attempts    int           `json:"attempts"`                // 连续失败次数
+	NextRetryAt int64         `json:"next_retry_at,omitempty"` // 退避中：此时间（unix 秒）之前不再尝试
+	LastError   string        `json:"last_error,omitempty"`
+	// Baseline 本轮写入 outbox 的增量对应的计数器读数，traffic-state.json 保存成功后清空。
+	// 进程恰好在“写 outbox”和“写 traffic-state.json”之间退出时，下一轮以它为基准做差，
+	// 避免把已经进了 outbox 的窗口再算一遍（重算出来的增量窗口不同、ID 也不同，面板无法去重）。
+	Baseline map[string]trafficStateEntry `json:"baseline,omitempty"`
+}
+
+// trafficReportID 生成上报 ID：同一节点、同一用户、同一窗口的增量永远得到同一个 ID
+func trafficReportID(nodeID int, uuid string, windowStart, windowEnd int64) string {
+	return fmt.Sprintf("%d:%s:%d-%d", nodeID, uuid, windowStart, windowEnd)
+}
+
+// reportID 返回条目的上报 ID；旧版本写入的条目没有 ID，按内容补一个（同一文件内容每次算出来都一样）
+func (e outboxEntry) reportID(nodeID int) string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return trafficReportID(nodeID, e.UUID, e.WindowStart, e.TS)
+}
+
+func outboxPath(cfg config, nodeID int) string {
+	return filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "traffic-outbox.json")
+}
+
+func loadOutbox(path string) (*trafficOutbox, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &trafficOutbox{}, nil
+		}
+		return nil, err
+	}
+	var ob trafficOutbox
+	if err := json.Unmarshal(b, &ob); err != nil {
+		return nil, err
+	}
+	return &ob, nil
+}
+
+func saveOutbox(path string, ob *trafficOutbox) error {
+	if len(ob.Entries) == 0 && len(ob.Baseline) == 0 {
+		// 没有待上报内容时删除文件，便于排查时一眼看出是否有积压
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(ob, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	return writeFileAtomic(path, b, 0o644)
+}
+
+// add 追加一条增量。不与已有条目合并：已有条目可能已经带着它的 ID 发出去过（只是没收到确认），
+// 改了内容再用同一个 ID 重发，面板会按重复丢掉新增的部分
+func (ob *trafficOutbox) add(nodeID int, uuid string, delta trafficCounter, windowStart, ts int64) {
+	ob.Entries = append(ob.Entries, outboxEntry{
+		ID:          trafficReportID(nodeID, uuid, windowStart, ts),
+		UUID:        uuid,
+		Upload:      delta.Upload,
+		Download:    delta.Download,
+		WindowStart: windowStart,
+		TS:          ts,
+	})
+}
+
+// outboxBackoff 第 n 次连续失败后的等待时间：base * 2^(n-1)，封顶 max
+func outboxBackoff(cfg config, attempts int) time.Duration {
+	d := cfg.OutboxRetryBase
+	for i := 1; i < attempts && d < cfg.OutboxRetryMax; i++ {
+		d *= 2
+	}
+	if d > cfg.OutboxRetryMax {
+		d = cfg.OutboxRetryMax
+	}
+	return d
+}
+
+// fail 记录一次补报失败并进入退避
+func (ob *trafficOutbox) fail(cfg config, nodeID int, now time.Time, err error) {
+	ob.Attempts++
+	ob.LastError = err.Error()
+	wait := outboxBackoff(cfg, ob.Attempts)
+	ob.NextRetryAt = now.Add(wait).Unix()
+	fmt.Fprintf(os.Stderr, "[WARN] node %d traffic outbox flush failed (pending=%d, attempt=%d, retry in %s): %v\n", nodeID, len(ob.Entries), ob.Attempts, wait, err)
+}
+
+// done 前 n 条已被面板处理（接受或明确拒绝），从 outbox 移除并清除退避
+func (ob *trafficOutbox) done(n int) {
+	ob.Entries = ob.Entries[n:]
+	ob.Attempts = 0
+	ob.NextRetryAt = 0
+	ob.LastError = ""
+}
+
+// flushOutbox 按时间顺序补报 outbox 中的增量
+// - 优先走批量接口（每批最多 TRAFFIC_BULK_MAX_ITEMS 条）；面板不支持时退回逐条上报
+// - 成功：删除对应条目
+// - 面板明确拒绝（4xx，例如 uuid 不存在 / 无可用权益）：重试也不会成功，记录日志后丢弃
+// - 其它错误（网络、超时、5xx）：整个 outbox 进入退避，剩余条目下次再报
+func flushOutbox(ctx context.Context, cfg config, nodeID int, ob *trafficOutbox) {
+	now := time.Now()
+	if ob.NextRetryAt > 0 && now.Unix() < ob.NextRetryAt {
+		return
+	}
+
+	sent := 0
+	for len(ob.Entries) > 0 {
+		if cfg.TrafficBulkReport && !bulkReportUnsupported.Load() {
+			n := len(ob.Entries)
+			if n > cfg.TrafficBulkMaxItems {
+				n = cfg.TrafficBulkMaxItems
+			}
+			batch := ob.Entries[:n]
+			items := make([]bulkReportItem, 0, n)
+			for _, e := range batch {
+				items = append(items, bulkReportItem{ReportID: e.reportID(nodeID), UUID: e.UUID, Upload: e.Upload, Download: e.Download, TS: e.TS})
+			}
+			windowStart, windowEnd := batch[0].TS, batch[n-1].TS
+			reportID := fmt.Sprintf("n%d-%d-%d-%d", nodeID, windowStart, windowEnd, n)
+
+			res, err := reportTrafficBulk(ctx, cfg, nodeID, reportID, windowStart, windowEnd, items)
+			if errors.Is(err, errBulkUnsupported) {
+				bulkReportUnsupported.Store(true)
+				fmt.Printf("[INFO] panel does not support bulk traffic report, falling back to per-user reports\n")
+				continue
+			}
+			if err != nil {
+				// 进程退出时取消的请求不算失败，不进入退避
+				if ctx.Err() == nil {
+					ob.fail(cfg, nodeID, now, err)
+				}
+				break
+			}
+			for _, r := range res.Rejected {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s traffic dropped by panel: status=%d message=%s\n", nodeID, r.UUID, r.Status, r.Message)
+			}
+			if res.Duplicates > 0 {
+				fmt.Printf("[INFO] node %d %d traffic reports already accounted by panel (retry)\n", nodeID, res.Duplicates)
+			}
+			sent += n - len(res.Rejected)
+			ob.done(n)
+			continue
+		}
+
+		e := ob.Entries[0]
+		err := reportTraffic(ctx, cfg, nodeID, e.reportID(nodeID), e.UUID, e.Upload, e.Download, e.TS)
+		if err != nil && !isPermanentPanelErr(err) {
+			if ctx.Err() == nil {
+				ob.fail(cfg, nodeID, now, err)
+			}
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s traffic dropped by panel: upload=%d download=%d: %v\n", nodeID, e.UUID, e.Upload, e.Download, err)
+		} else {
+			sent++
+		}
+		ob.done(1)
+	}
+	if sent > 0 {
+		fmt.Printf("[INFO] node %d traffic outbox flushed=%d pending=%d\n", nodeID, sent, len(ob.Entries))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 本地流量限额（xray-grpc 模式）：
+// 面板只有在流量上报后才会把权益标为 exhausted，再等下一轮同步才会把用户从列表里去掉，
+// 两次同步之间重度用户可能超出配额很多。这里用面板随允许列表下发的 remaining_bytes 作为额度，
+// 在 reportTrafficOnce 算增量时同步累计本地用量，一旦用完立即从 Xray 移除，不等面板。
+// - remaining_bytes 缺省（旧版面板）：不做本地限额；-1：不限流量
+// - 同一 UUID 在多个节点下发的额度取最大值，用完后从所有包含它的节点移除
+// - 每次同步拿到新额度时，面板额度减少了多少（说明这部分上报已被记账）本地用量就扣掉多少，
+//   还没上报/还在 outbox 里的用量继续保留
+// - 已因本地限额移除的用户，只有面板额度重新大于本地用量（续费/加流量）才会恢复；
+//   面板把用户移出允许列表后对应记录自动清理
+
+type quotaEntry struct {
+	remaining int64 // 最近一次同步时面板给出的剩余字节数（-1 不限）
+	used      int64 // 本地统计到、面板额度中尚未体现的用量
+	exhausted bool  // 已因本地限额从 Xray 移除
+	removed   bool  // 移除动作已成功执行
+}
+
+type quotaTracker struct {
+	mu      sync.Mutex
+	entries map[string]*quotaEntry   // uuid -> 额度
+	byNode  map[int]map[string]int64 // node_id -> uuid -> 面板下发的剩余字节数
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		entries: make(map[string]*quotaEntry),
+		byNode:  make(map[int]map[string]int64),
+	}
+}
+
+// update 记录某节点最新的允许列表额度，并按所有节点重新汇总
+func (q *quotaTracker) update(nodeID int, users []allowedUser) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limits := make(map[string]int64, len(users))
+	for _, u := range users {
+		if u.UUID == "" || u.RemainingBytes == nil {
+			continue
+		}
+		limits[u.UUID] = *u.RemainingBytes
+	}
+	q.byNode[nodeID] = limits
+
+	merged := make(map[string]int64)
+	for _, m := range q.byNode {
+		for uuid, remaining := range m {
+			prev, ok := merged[uuid]
+			switch {
+			case !ok:
+				merged[uuid] = remaining
+			case prev < 0 || remaining < 0:
+				merged[uuid] = -1
+			case remaining > prev:
+				merged[uuid] = remaining
+			}
+		}
+	}
+
+	for uuid, e := range q.entries {
+		remaining, ok := merged[uuid]
+		if !ok {
+			// 面板已不再下发该用户（或不再下发额度）：交给正常同步处理
+			delete(q.entries, uuid)
+			continue
+		}
+		if e.remaining >= 0 && remaining >= 0 && remaining < e.remaining {
+			e.used -= e.remaining - remaining
+			if e.used < 0 {
+				e.used = 0
+			}
+		}
+		e.remaining = remaining
+		if e.exhausted && (remaining < 0 || e.used < remaining) {
+			fmt.Printf("[INFO] uuid %s quota refilled by panel (remaining=%d), local limit lifted\n", uuid, remaining)
+			e.exhausted = false
+			e.removed = false
+		}
+	}
+	for uuid, remaining := range merged {
+		if _, ok := q.entries[uuid]; !ok {
+			q.entries[uuid] = &quotaEntry{remaining: remaining}
+		}
+	}
+}
+
+// consume 累计本地用量，返回本次是否刚好用完额度
+func (q *quotaTracker) consume(uuid string, bytes int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.entries[uuid]
+	if !ok || e.remaining < 0 || e.exhausted {
+		return false
+	}
+	e.used += bytes
+	if e.used >= e.remaining {
+		e.exhausted = true
+		return true
+	}
+	return false
+}
+
+// pendingRemoval 已用完额度但还没成功从 Xray 移除的用户
+func (q *quotaTracker) pendingRemoval() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out []string
+	for uuid, e := range q.entries {
+		if e.exhausted && !e.removed {
+			out = append(out, uuid)
+		}
+	}
+	sortStrings(out)
+	return out
+}
+
+func (q *quotaTracker) markRemoved(uuid string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[uuid]; ok {
+		e.removed = true
+	}
+}
+
+// exhaustedCount 因本地限额被移除的用户数
+func (q *quotaTracker) exhaustedCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, e := range q.entries {
+		if e.exhausted {
+			n++
+		}
+	}
+	return n
+}
+
+func (q *quotaTracker) isExhausted(uuid string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[uuid]
+	return ok && e.exhausted
+}
+
+// enforceQuota 把用完本地额度的用户从所在节点的 inbound 移除
+func enforceQuota(ctx context.Context, cfg config, q *quotaTracker) {
+	uuids := q.pendingRemoval()
+	if len(uuids) == 0 {
+		return
+	}
+	for _, uuid := range uuids {
+		ok := true
+		for _, nodeID := range cfg.NodeIDs {
+			applied, err := loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json"))
+			if err != nil || !containsString(applied, uuid) {
+				continue
+			}
+			if err := xrayClientForNode(cfg, nodeID).removeUser(ctx, xrayTagForNode(cfg, nodeID), uuid); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s quota exhausted but remove failed: %v\n", nodeID, uuid, err)
+				ok = false
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "[WARN] node %d uuid %s local quota exhausted, user removed before panel sync\n", nodeID, uuid)
+			kicks.kick(ctx, cfg, nodeID, []string{uuid})
+		}
+		if ok {
+			q.markRemoved(uuid)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
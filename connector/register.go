@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 节点自注册（取代一键脚本里 jq + curl 拼 register-node 请求的做法）：
+// 从本机 Xray 配置（XRAY_CONFIG / XRAY_CONFDIR，APPLY_MODE=singbox 时为 SINGBOX_CONFIG）的 inbound
+// 生成节点记录（地址、端口、协议、Reality 公钥 / SNI / shortId、传输方式等），逐条 POST /api/internal/register-node。
+// 面板按 host_id + inbound_tag（设置了 HOST_ID 时）或 address + port + protocol 幂等，重复注册只更新已有节点：
+// 请求带 merge，保留管理员改过的名称，config 只覆盖 connector 生成的键（见 registerOwnedKeys）；
+// 返回的节点 ID 与面板上最终生效的 inbound tag（面板原有的 tag 优先）写回：
+// 有配置文件时写进其 nodes 段，否则写进 REGISTER_ENV_FILE 的 NODE_IDS / XRAY_TAG_MAP（SINGBOX_TAG_MAP）。
+// 用法：connector register [-config file] [-dry-run]；REGISTER_ON_START=true 时每次启动先注册一遍。
+
+// nodeRecord 一条 register-node 请求
+type nodeRecord struct {
+	Tag      string         `json:"-"` // 对应的 inbound tag
+	Name     string         `json:"name"`
+	Address  string         `json:"address"`
+	Port     int            `json:"port"`
+	Protocol string         `json:"protocol"`
+	Config   map[string]any `json:"config"`
+	PlanIDs  []int          `json:"plan_ids,omitempty"`
+	Merge    bool           `json:"merge"` // 更新已有节点时保留名称、合并 config
+}
+
+// registerOwnedKeys connector 生成的 config 键：本次没有生成的以 null 提交，面板删除旧值
+// （如传输从 ws 换成 tcp 后残留的 path），其余键（管理员补充的）保持不动
+var registerOwnedKeys = []string{"net", "path", "host", "security", "sni", "publicKey", "shortId", "tls", "insecure", "alpn", "flow", "encryption"}
+
+// registeredNode 注册结果
+type registeredNode struct {
+	nodeRecord
+	ID      int
+	Created bool
+}
+
+type registerNodeResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		ID         int    `json:"id"`
+		Created    bool   `json:"created"`
+		InboundTag string `json:"inbound_tag"` // 旧版面板不返回
+	} `json:"data"`
+}
+
+// registerFromSingbox 节点记录取自 sing-box 配置还是 Xray 配置
+func registerFromSingbox(cfg config) bool {
+	return cfg.ApplyMode == "singbox"
+}
+
+// localNodeRecords 由本机内核配置生成节点记录
+func localNodeRecords(ctx context.Context, cfg config) ([]nodeRecord, error) {
+	address := detectPublicIP(ctx, cfg.NodePublicIP)
+	if address == "" {
+		return nil, errors.New("cannot detect public address, set NODE_PUBLIC_IP")
+	}
+	var (
+		records []nodeRecord
+		err     error
+	)
+	if registerFromSingbox(cfg) {
+		records, err = singboxNodeRecords(cfg, address)
+	} else {
+		records, err = xrayNodeRecords(cfg, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no inbound to register in local config")
+	}
+	for i := range records {
+		if cfg.HostID != "" {
+			records[i].Config["host_id"] = cfg.HostID
+		}
+		records[i].Config["inbound_tag"] = records[i].Tag
+		for _, key := range registerOwnedKeys {
+			if _, ok := records[i].Config[key]; !ok {
+				records[i].Config[key] = nil
+			}
+		}
+		records[i].PlanIDs = cfg.RegisterPlanIDs
+		records[i].Merge = true
+	}
+	return records, nil
+}
+
+// xrayNodeRecords 每个带 tag、xray-grpc 能管理用户的 inbound 一条记录，config 字段与订阅生成（subscription.js）读取的一致
+func xrayNodeRecords(cfg config, address string) ([]nodeRecord, error) {
+	inbounds, _, err := readXrayConfigInbounds(cfg.XrayConfigPath, cfg.XrayConfDir)
+	if err != nil {
+		return nil, err
+	}
+	var records []nodeRecord
+	for _, in := range inbounds {
+		proto := strings.ToLower(in.Protocol)
+		port := configPort(in.Port)
+		if !containsString(xrayProtocols, proto) || port <= 0 {
+			continue
+		}
+		ss := in.StreamSettings
+		network := strings.ToLower(ss.Network)
+		nodeCfg := map[string]any{}
+
+		switch network {
+		case "", "tcp", "raw":
+			network = "tcp"
+		case "ws", "httpupgrade":
+			nodeCfg["net"] = network
+			nodeCfg["path"] = ss.WSSettings.Path
+			host := ss.WSSettings.Host
+			if host == "" {
+				host = ss.WSSettings.Headers["Host"]
+			}
+			if host != "" {
+				nodeCfg["host"] = host
+			}
+		case "grpc":
+			nodeCfg["net"] = network
+			nodeCfg["path"] = ss.GRPCSettings.ServiceName
+		default:
+			nodeCfg["net"] = network
+		}
+
+		switch strings.ToLower(ss.Security) {
+		case "reality":
+			r := ss.RealitySettings
+			publicKey := os.Getenv("REALITY_PUBLIC_KEY")
+			if publicKey == "" {
+				publicKey = realityPublicKey(r.PrivateKey)
+			}
+			if publicKey == "" {
+				fmt.Fprintf(os.Stderr, "[WARN] inbound %s: cannot derive reality public key, set REALITY_PUBLIC_KEY\n", in.Tag)
+			}
+			nodeCfg["security"] = "reality"
+			nodeCfg["sni"] = firstNonEmpty(r.ServerNames)
+			nodeCfg["publicKey"] = publicKey
+			nodeCfg["shortId"] = firstNonEmpty(r.ShortIDs)
+		case "tls":
+			nodeCfg["security"] = "tls"
+			nodeCfg["tls"] = "tls"
+			if sni := ss.TLSSettings.ServerName; sni != "" {
+				nodeCfg["sni"] = sni
+			} else {
+				// 没配域名一般是自签证书：按 IP 连接并跳过校验
+				nodeCfg["sni"] = address
+				nodeCfg["insecure"] = true
+			}
+		}
+
+		switch proto {
+		case "vless":
+			var flows []string
+			for _, c := range in.Settings.Clients {
+				flows = append(flows, c.Flow)
+			}
+			flow := inboundFlow(proto, network, flows, true)
+			if flow == "" {
+				flow = cfg.XrayVlessFlow
+			}
+			if flow == "none" || network != "tcp" {
+				flow = ""
+			}
+			nodeCfg["flow"] = flow
+			nodeCfg["encryption"] = "none"
+		case "shadowsocks":
+			method := in.Settings.Method
+			for _, c := range in.Settings.Clients {
+				if method != "" {
+					break
+				}
+				method = c.Method
+			}
+			if method == "" {
+				method = cfg.XraySSMethod
+			}
+			nodeCfg["method"] = method
+			nodeCfg["multi_user"] = true
+			if isSS2022Method(method) {
+				// 订阅里的密码为 服务端密钥:用户密钥
+				nodeCfg["password"] = in.Settings.Password
+			}
+		}
+
+		records = append(records, nodeRecord{
+			Tag:      in.Tag,
+			Name:     fmt.Sprintf("%s %s %s", cfg.NodeName, proto, in.Tag),
+			Address:  address,
+			Port:     port,
+			Protocol: proto,
+			Config:   nodeCfg,
+		})
+	}
+	return records, nil
+}
+
+func firstNonEmpty(list []string) string {
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// registerNode POST /api/internal/register-node
+func registerNode(ctx context.Context, cfg config, rec nodeRecord) (registeredNode, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return registeredNode{}, err
+	}
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/register-node"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return registeredNode{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return registeredNode{}, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return registeredNode{}, err
+	}
+	if resp.StatusCode != 200 {
+		return registeredNode{}, &panelError{Status: resp.StatusCode, Message: string(b)}
+	}
+	var parsed registerNodeResponse
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return registeredNode{}, fmt.Errorf("decode json failed: %w; body=%s", err, string(b))
+	}
+	if parsed.Code != 200 {
+		return registeredNode{}, &panelError{Status: 200, Code: parsed.Code, Message: parsed.Message}
+	}
+	if parsed.Data.ID <= 0 {
+		return registeredNode{}, fmt.Errorf("invalid node id in response: %s", string(b))
+	}
+	if tag := parsed.Data.InboundTag; tag != "" && tag != rec.Tag {
+		// 按 address + port + protocol 匹配到的已有节点在面板上另有 tag：以面板为准，写回的映射与面板一致
+		fmt.Fprintf(os.Stderr, "[WARN] node %d keeps inbound_tag %q set in panel (local inbound %q)\n", parsed.Data.ID, tag, rec.Tag)
+		rec.Tag = tag
+	}
+	return registeredNode{nodeRecord: rec, ID: parsed.Data.ID, Created: parsed.Data.Created}, nil
+}
+
+// registerNodes 逐条注册；某条失败不影响其它，返回成功的部分与所有错误
+func registerNodes(ctx context.Context, cfg config, records []nodeRecord) ([]registeredNode, error) {
+	var (
+		out  []registeredNode
+		errs []error
+	)
+	for _, rec := range records {
+		r, err := registerNode(ctx, cfg, rec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("register %s (%s:%d %s): %w", rec.Tag, rec.Address, rec.Port, rec.Protocol, err))
+			continue
+		}
+		action := "updated"
+		if r.Created {
+			action = "created"
+		}
+		fmt.Printf("[INFO] node %d %s: tag=%s %s %s:%d\n", r.ID, action, r.Tag, r.Protocol, r.Address, r.Port)
+		out = append(out, r)
+	}
+	return out, errors.Join(errs...)
+}
+
+// mergeRegistered 把注册结果并入节点列表与 tag 映射：同一 inbound tag 原来对应的节点 ID 换成面板返回的 ID
+func mergeRegistered(ids []int, tags map[int]string, regs []registeredNode) ([]int, map[int]string) {
+	outTags := make(map[int]string, len(tags)+len(regs))
+	for id, tag := range tags {
+		outTags[id] = tag
+	}
+	outIDs := append([]int(nil), ids...)
+	for _, r := range regs {
+		for id, tag := range outTags {
+			if tag == r.Tag && id != r.ID {
+				delete(outTags, id)
+				outIDs = removeInt(outIDs, id)
+			}
+		}
+		outTags[r.ID] = r.Tag
+		if !containsInt(outIDs, r.ID) {
+			outIDs = append(outIDs, r.ID)
+		}
+	}
+	return outIDs, outTags
+}
+
+func removeInt(list []int, n int) []int {
+	out := list[:0]
+	for _, v := range list {
+		if v != n {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// applyRegistered 启动时注册成功后直接用上结果（HOST_ID 模式下节点由面板分配，不改）
+func applyRegistered(cfg config, regs []registeredNode) config {
+	if cfg.HostID != "" {
+		return cfg
+	}
+	if registerFromSingbox(cfg) {
+		cfg.NodeIDs, cfg.SingboxTagMap = mergeRegistered(cfg.NodeIDs, cfg.LocalSingboxTagMap, regs)
+		cfg.LocalSingboxTagMap = cfg.SingboxTagMap
+	} else {
+		cfg.NodeIDs, cfg.XrayTagMap = mergeRegistered(cfg.NodeIDs, cfg.LocalXrayTagMap, regs)
+		cfg.LocalXrayTagMap = cfg.XrayTagMap
+	}
+	return cfg
+}
+
+// saveRegistered 把注册结果写回配置文件或 env 文件，返回写入的文件（没有可写的位置时为空）
+func saveRegistered(cfg config, regs []registeredNode) (string, error) {
+	if len(regs) == 0 || cfg.HostID != "" {
+		return "", nil
+	}
+	if cfg.ConfigPath != "" {
+		return cfg.ConfigPath, saveRegisteredToConfigFile(cfg.ConfigPath, registerFromSingbox(cfg), regs)
+	}
+	if cfg.RegisterEnvFile != "" {
+		return cfg.RegisterEnvFile, saveRegisteredToEnvFile(cfg.RegisterEnvFile, registerFromSingbox(cfg), regs)
+	}
+	return "", nil
+}
+
+// saveRegisteredToConfigFile 更新配置文件的 nodes 段：按 inbound tag 找到已有节点改 ID，没有的追加；
+// 其它设置原样保留（键按字母序重新排版）
+func saveRegisteredToConfigFile(path string, singbox bool, regs []registeredNode) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var nodes []fileNode
+	if raw, ok := doc["nodes"]; ok {
+		if err := json.Unmarshal(raw, &nodes); err != nil {
+			return fmt.Errorf("%s: nodes: %w", path, err)
+		}
+	}
+
+	tagOf := func(n *fileNode) *string {
+		if singbox {
+			return &n.SingboxTag
+		}
+		return &n.XrayTag
+	}
+	for _, r := range regs {
+		i := -1
+		for j := range nodes {
+			if *tagOf(&nodes[j]) == r.Tag {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			for j := range nodes {
+				if nodes[j].ID == r.ID && *tagOf(&nodes[j]) == "" {
+					i = j
+					break
+				}
+			}
+		}
+		if i < 0 {
+			nodes = append(nodes, fileNode{})
+			i = len(nodes) - 1
+		}
+		nodes[i].ID = r.ID
+		*tagOf(&nodes[i]) = r.Tag
+		// 同一 ID 的其它项（原来手写、tag 不同）去掉，避免 nodes 段出现重复 id
+		kept := nodes[:0]
+		for j, n := range nodes {
+			if j == i || n.ID != r.ID {
+				kept = append(kept, n)
+			} else if j < i {
+				i--
+			}
+		}
+		nodes = kept
+	}
+
+	rawNodes, err := json.Marshal(nodes)
+	if err != nil {
+		return err
+	}
+	doc["nodes"] = rawNodes
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if bytes.Equal(out, b) {
+		return nil
+	}
+	return writeFileAtomic(path, out, info.Mode().Perm())
+}
+
+// saveRegisteredToEnvFile 更新 env 文件（KEY=value 每行一个）中的 NODE_IDS 与 tag 映射，其它行原样保留
+func saveRegisteredToEnvFile(path string, singbox bool, regs []registeredNode) error {
+	tagKey := "XRAY_TAG_MAP"
+	if singbox {
+		tagKey = "SINGBOX_TAG_MAP"
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	perm := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	var lines []string
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	}
+	values := map[string]string{}
+	for _, line := range lines {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	var ids []int
+	if values["NODE_IDS"] != "" {
+		if ids, err = parseNodeIDs(values["NODE_IDS"]); err != nil {
+			return fmt.Errorf("%s: NODE_IDS: %w", path, err)
+		}
+	}
+	ids, tags := mergeRegistered(ids, parseTagMap(values[tagKey]), regs)
+
+	set := map[string]string{"NODE_IDS": joinInts(ids), tagKey: formatTagMap(ids, tags)}
+	for i, line := range lines {
+		if k, _, ok := strings.Cut(line, "="); ok {
+			if v, ok := set[strings.TrimSpace(k)]; ok {
+				lines[i] = strings.TrimSpace(k) + "=" + v
+				delete(set, strings.TrimSpace(k))
+			}
+		}
+	}
+	for _, k := range []string{"NODE_IDS", tagKey} {
+		if v, ok := set[k]; ok {
+			lines = append(lines, k+"="+v)
+		}
+	}
+	out := []byte(strings.Join(lines, "\n") + "\n")
+	if bytes.Equal(out, b) {
+		return nil
+	}
+	return writeFileAtomic(path, out, perm)
+}
+
+// registerOnStart REGISTER_ON_START：启动时注册并用上返回的节点 ID；失败时打 WARN，按已保存的节点继续
+func registerOnStart(cfg config) config {
+	ctx := context.Background()
+	records, err := localNodeRecords(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] register on start failed, using saved nodes: %v\n", err)
+		return cfg
+	}
+	regs, err := registerNodes(ctx, cfg, records)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] register on start: %v\n", err)
+	}
+	cfg = applyRegistered(cfg, regs)
+	path, err := saveRegistered(cfg, regs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] save registered nodes to %s failed: %v\n", path, err)
+	} else if path == cfg.ConfigPath && path != "" {
+		// 自己写的变化不算配置文件变化，免得随后又触发重新加载
+		if hash, err := fileSHA256(path); err == nil {
+			cfg.ConfigHash = hash
+		}
+	}
+	return cfg
+}
+
+// runRegister connector register 子命令，返回退出码：0 全部成功，1 注册或保存失败，2 配置错误
+func runRegister(args []string) int {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	var (
+		flagConfig  = fs.String("config", env("CONNECTOR_CONFIG", ""), "config file (JSON); registered node ids are saved into its nodes")
+		flagEnvFile = fs.String("env-file", "", "env file to save NODE_IDS and the tag map into when no config file is used (default REGISTER_ENV_FILE)")
+		flagName    = fs.String("name", "", "node name prefix (default NODE_NAME)")
+		flagAddress = fs.String("address", "", "public address of this host (default NODE_PUBLIC_IP, detected when empty)")
+		flagPlanIDs = fs.String("plan-ids", "", "bind the nodes to these plans, comma separated (default REGISTER_PLAN_IDS)")
+		flagDryRun  = fs.Bool("dry-run", false, "print the node records without registering")
+	)
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*flagConfig, true, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 2
+	}
+	if *flagEnvFile != "" {
+		cfg.RegisterEnvFile = *flagEnvFile
+	}
+	if *flagName != "" {
+		cfg.NodeName = *flagName
+	}
+	if *flagAddress != "" {
+		cfg.NodePublicIP = *flagAddress
+	}
+	if *flagPlanIDs != "" {
+		if cfg.RegisterPlanIDs, err = parsePlanIDs(*flagPlanIDs); err != nil {
+			fmt.Fprintf(os.Stderr, "config: -plan-ids: %v\n", err)
+			return 2
+		}
+	}
+
+	ctx := context.Background()
+	records, err := localNodeRecords(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "register: %v\n", err)
+		return 1
+	}
+	if *flagDryRun {
+		b, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+
+	code := 0
+	regs, err := registerNodes(ctx, cfg, records)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "register: %v\n", err)
+		code = 1
+	}
+	if len(regs) == 0 {
+		return 1
+	}
+	if cfg.HostID != "" {
+		fmt.Printf("[INFO] HOST_ID is set: the panel assigns these nodes to host %s, nothing to save\n", cfg.HostID)
+		return code
+	}
+	path, err := saveRegistered(cfg, regs)
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "register: save to %s failed: %v\n", path, err)
+		return 1
+	case path == "":
+		ids, tags := mergeRegistered(nil, nil, regs)
+		tagKey := "XRAY_TAG_MAP"
+		if registerFromSingbox(cfg) {
+			tagKey = "SINGBOX_TAG_MAP"
+		}
+		fmt.Printf("[INFO] no config file or REGISTER_ENV_FILE, node ids not saved: NODE_IDS=%s %s=%s\n", joinInts(ids), tagKey, formatTagMap(ids, tags))
+	default:
+		fmt.Printf("[INFO] saved %d node(s) to %s\n", len(regs), path)
+		if cfg.ConfigPath != "" && env("NODE_IDS", "") != "" {
+			fmt.Fprintf(os.Stderr, "[WARN] NODE_IDS is set in the environment and overrides the nodes saved in %s\n", path)
+		}
+	}
+	return code
+}
+
+// parsePlanIDs 逗号分隔的套餐 ID
+func parsePlanIDs(s string) ([]int, error) {
+	var out []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		id, err := strconv.Atoi(p)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid plan id: %q", p)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+func joinInts(list []int) string {
+	s := make([]string, 0, len(list))
+	for _, n := range list {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+// formatTagMap 按 ids 顺序输出 id:tag,id:tag（与 parseTagMap 相反）
+func formatTagMap(ids []int, tags map[int]string) string {
+	pairs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if tag := tags[id]; tag != "" {
+			pairs = append(pairs, fmt.Sprintf("%d:%s", id, tag))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Shadowsocks-2022 多用户：每个用户需要一把与加密方式等长的独立密钥（base64）。
+// 面板只下发 UUID，这里用 SHA-256(uuid) 截取前 N 字节派生用户密钥，
+// 面板生成订阅时按同样规则计算（见 backend subscription.js），两边无需额外同步密钥。
+
+// ss2022KeyLen 返回 2022 加密方式要求的密钥长度；非 2022 方法返回 0
+func ss2022KeyLen(method string) int {
+	switch strings.ToLower(strings.TrimSpace(method)) {
+	case "2022-blake3-aes-128-gcm":
+		return 16
+	case "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305":
+		return 32
+	default:
+		return 0
+	}
+}
+
+func isSS2022Method(method string) bool {
+	return ss2022KeyLen(method) > 0
+}
+
+// ss2022UserKey 由 UUID 派生 Shadowsocks-2022 用户密钥
+func ss2022UserKey(uuid string, method string) string {
+	n := ss2022KeyLen(method)
+	if n == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(uuid)))
+	return base64.StdEncoding.EncodeToString(sum[:n])
+}
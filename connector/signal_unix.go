@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals 订阅退出（SIGINT/SIGTERM）、立即重新同步（SIGHUP）与输出状态（SIGUSR1）信号
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+}
+
+func isResyncSignal(sig os.Signal) bool { return sig == syscall.SIGHUP }
+
+func isStatusSignal(sig os.Signal) bool { return sig == syscall.SIGUSR1 }
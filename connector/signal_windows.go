@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals Windows 没有 SIGHUP/SIGUSR1，只处理退出
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+}
+
+func isResyncSignal(sig os.Signal) bool { return false }
+
+func isStatusSignal(sig os.Signal) bool { return false }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sing-box 模式（APPLY_MODE=singbox）：
+// sing-box 没有 Xray 那样的用户增删 API，只能改配置文件。这里把各节点允许列表渲染进
+// inbounds[].users，原子写回后执行 SINGBOX_RELOAD_CMD（默认发 SIGHUP），
+// 替代 node-agent.py / sync.sh 的“改文件 + docker restart”。
+// 这不是不断线的热更新：sing-box 收到 SIGHUP 会关闭并重建所有 inbound，这台机器上所有用户的现有连接都会断开，
+// 与 restart 相比只是省掉了进程/容器重启。能做的只是少重载：渲染结果与现有配置一致时不写文件、不重载，
+// 只有用户列表真的变化时才重载（事件触发的同步另有合并窗口）。需要增删用户不影响其他人时用 xray-grpc。
+// 写回时只替换各 inbound 的 users 值，文件其余部分（键顺序、缩进、注释外的格式）保持原样。
+
+// singboxUsers 按 inbound 类型生成 users 数组（与 node-agent.py 的字段保持一致）
+func singboxUsers(inbound map[string]any, uuids []string, vlessFlow string) ([]any, error) {
+	typ, _ := inbound["type"].(string)
+	users := make([]any, 0, len(uuids))
+	switch typ {
+	case "vless":
+		for _, u := range uuids {
+			user := map[string]any{"name": u, "uuid": u}
+			if vlessFlow != "" {
+				user["flow"] = vlessFlow
+			}
+			users = append(users, user)
+		}
+	case "vmess":
+		for _, u := range uuids {
+			users = append(users, map[string]any{"name": u, "uuid": u, "alterId": 0})
+		}
+	case "trojan", "hysteria2":
+		for _, u := range uuids {
+			users = append(users, map[string]any{"name": u, "password": u})
+		}
+	case "socks":
+		for _, u := range uuids {
+			users = append(users, map[string]any{"username": u, "password": u})
+		}
+	case "shadowsocks":
+		// sing-box 的 shadowsocks 多用户只支持 2022 系列加密
+		method, _ := inbound["method"].(string)
+		if !isSS2022Method(method) {
+			return nil, fmt.Errorf("shadowsocks method %q does not support multi-user", method)
+		}
+		for _, u := range uuids {
+			users = append(users, map[string]any{"name": u, "password": ss2022UserKey(u, method)})
+		}
+	default:
+		return nil, nil
+	}
+	return users, nil
+}
+
+// renderSingboxConfig 把允许列表写进配置的 inbounds[].users，只改这些值，其余字节原样保留
+// byTag：显式映射到某个 inbound tag 的用户；fallback：未映射 inbound 使用的用户（nil 表示不改动）
+func renderSingboxConfig(raw []byte, byTag map[string][]string, fallback []string, vlessFlow string) ([]byte, error) {
+	if !json.Valid(raw) {
+		var doc any
+		return nil, fmt.Errorf("decode sing-box config failed: %w", json.Unmarshal(raw, &doc))
+	}
+	top, _, err := jsonObjectMembers(raw, jsonSkipSpace(raw, 0))
+	if err != nil {
+		return nil, fmt.Errorf("decode sing-box config failed: %w", err)
+	}
+	var edits []jsonEdit
+	for _, m := range top {
+		if m.Key != "inbounds" || raw[m.ValStart] != '[' {
+			continue
+		}
+		elems, err := jsonArrayElements(raw, m.ValStart)
+		if err != nil {
+			return nil, fmt.Errorf("decode sing-box config failed: %w", err)
+		}
+		for _, e := range elems {
+			if raw[e[0]] != '{' {
+				continue
+			}
+			var inbound map[string]any
+			if err := json.Unmarshal(raw[e[0]:e[1]], &inbound); err != nil {
+				return nil, fmt.Errorf("decode sing-box config failed: %w", err)
+			}
+			tag, _ := inbound["tag"].(string)
+			uuids, mapped := byTag[tag]
+			if !mapped {
+				if fallback == nil {
+					continue
+				}
+				uuids = fallback
+			}
+			users, err := singboxUsers(inbound, uuids, vlessFlow)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] sing-box inbound %s skipped: %v\n", tag, err)
+				continue
+			}
+			if users == nil {
+				continue
+			}
+			edit, err := singboxUsersEdit(raw, e[0], users)
+			if err != nil {
+				return nil, fmt.Errorf("decode sing-box config failed: %w", err)
+			}
+			edits = append(edits, edit)
+		}
+	}
+	return applyJSONEdits(raw, edits), nil
+}
+
+// singboxUsersEdit 生成替换（或插入）一个 inbound 对象 users 值的修改，格式跟随该对象：
+// 单行对象写成单行，多行对象按已有键的缩进展开
+func singboxUsersEdit(raw []byte, objStart int, users []any) (jsonEdit, error) {
+	members, objEnd, err := jsonObjectMembers(raw, objStart)
+	if err != nil {
+		return jsonEdit{}, err
+	}
+	multiline := bytes.IndexByte(raw[objStart:objEnd], '\n') >= 0
+	unit := "  "
+	if len(members) > 0 {
+		// 缩进单位取对象内键相对对象所在行多出的空白
+		objIndent, keyIndent := lineIndent(raw, objStart), lineIndent(raw, members[0].KeyStart)
+		if strings.HasPrefix(keyIndent, objIndent) && len(keyIndent) > len(objIndent) {
+			unit = keyIndent[len(objIndent):]
+		}
+	}
+	marshal := func(indent string) ([]byte, error) {
+		if multiline {
+			return json.MarshalIndent(users, indent, unit)
+		}
+		return json.Marshal(users)
+	}
+	for _, m := range members {
+		if m.Key == "users" {
+			b, err := marshal(lineIndent(raw, m.KeyStart))
+			if err != nil {
+				return jsonEdit{}, err
+			}
+			return jsonEdit{Start: m.ValStart, End: m.ValEnd, Text: b}, nil
+		}
+	}
+	if len(members) == 0 {
+		// 空对象 {}：直接写在括号里
+		b, err := json.Marshal(users)
+		if err != nil {
+			return jsonEdit{}, err
+		}
+		return jsonEdit{Start: objEnd - 1, End: objEnd - 1, Text: append([]byte(`"users":`), b...)}, nil
+	}
+	last := members[len(members)-1]
+	indent := lineIndent(raw, last.KeyStart)
+	b, err := marshal(indent)
+	if err != nil {
+		return jsonEdit{}, err
+	}
+	sep := ", "
+	if multiline {
+		sep = ",\n" + indent
+	}
+	return jsonEdit{Start: last.ValEnd, End: last.ValEnd, Text: append([]byte(sep+`"users": `), b...)}, nil
+}
+
+// applySingbox 汇总所有节点的允许列表，重写 sing-box 配置并触发重载
+// 多个节点共用一份配置文件，因此每次都按全部节点（已落盘的 allowed-uuids.json）整体渲染。
+func applySingbox(ctx context.Context, cfg config) error {
+	byTag := make(map[string][]string)
+	var fallback []string
+	lists := make(map[int][]string)
+
+	for _, nodeID := range cfg.NodeIDs {
+		nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
+		uuids, err := loadAllowedUUIDsFile(filepath.Join(nodeDir, "allowed-uuids.json"))
+		if err != nil {
+			// 该节点还没成功拉取过：不参与渲染，对应 inbound 保持原样
+			continue
+		}
+		lists[nodeID] = uuids
+		if tag := cfg.SingboxTagMap[nodeID]; tag != "" {
+			byTag[tag] = unionStrings(byTag[tag], uuids)
+		} else {
+			// 未映射的节点：列表下发到所有未映射的 inbound（兼容 sync.sh 的“一份列表喂所有协议”）
+			fallback = unionStrings(fallback, uuids)
+			if fallback == nil {
+				fallback = []string{}
+			}
+		}
+	}
+
+	raw, err := os.ReadFile(cfg.SingboxConfigPath)
+	if err != nil {
+		return err
+	}
+	rendered, err := renderSingboxConfig(raw, byTag, fallback, cfg.XrayVlessFlow)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(raw, rendered) {
+		if err := writeFileAtomic(cfg.SingboxConfigPath, rendered, 0o644); err != nil {
+			return fmt.Errorf("write sing-box config failed: %w", err)
+		}
+		if strings.TrimSpace(cfg.SingboxReloadCmd) != "" {
+			cmd := strings.ReplaceAll(cfg.SingboxReloadCmd, "{config}", cfg.SingboxConfigPath)
+			if err := runShellCommand(ctx, cmd); err != nil {
+				return fmt.Errorf("sing-box reload failed: %w", err)
+			}
+		}
+		fmt.Printf("[INFO] sing-box config updated and reloaded (existing connections on this host are dropped): %s\n", cfg.SingboxConfigPath)
+	}
+
+	for nodeID, uuids := range lists {
+		appliedPath := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json")
+		if err := saveAppliedState(appliedPath, nodeID, uuids); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d save applied state failed: %v\n", nodeID, err)
+		}
+	}
+	return nil
+}
+
+// unionStrings 合并两个列表（去重、排序）
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	var out []string
+	for _, list := range [][]string{a, b} {
+		for _, u := range list {
+			if _, ok := seen[u]; ok {
+				continue
+			}
+			seen[u] = struct{}{}
+			out = append(out, u)
+		}
+	}
+	sortStrings(out)
+	return out
+}
+
+// 以下是只替换 JSON 中个别值所需的最小扫描（输入已经过 json.Valid 校验）
+
+// jsonMember 对象中的一个键值对，Val* 为值的字节范围 [ValStart, ValEnd)
+type jsonMember struct {
+	Key      string
+	KeyStart int
+	ValStart int
+	ValEnd   int
+}
+
+// jsonEdit 把 [Start, End) 替换为 Text
+type jsonEdit struct {
+	Start, End int
+	Text       []byte
+}
+
+func jsonSkipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// jsonValueEnd 返回从 i 开始的一个值之后的位置
+func jsonValueEnd(b []byte, i int) (int, error) {
+	if i >= len(b) {
+		return 0, errors.New("unexpected end of JSON")
+	}
+	switch b[i] {
+	case '"':
+		for j := i + 1; j < len(b); j++ {
+			switch b[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1, nil
+			}
+		}
+		return 0, errors.New("unterminated string")
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(b); j++ {
+			switch b[j] {
+			case '"':
+				end, err := jsonValueEnd(b, j)
+				if err != nil {
+					return 0, err
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1, nil
+				}
+			}
+		}
+		return 0, errors.New("unterminated object or array")
+	default:
+		j := i
+		for j < len(b) && !strings.ContainsRune(" \t\r\n,]}", rune(b[j])) {
+			j++
+		}
+		return j, nil
+	}
+}
+
+// jsonObjectMembers 列出从 start（'{'）开始的对象的键值对，并返回对象结束后的位置
+func jsonObjectMembers(b []byte, start int) ([]jsonMember, int, error) {
+	if start >= len(b) || b[start] != '{' {
+		return nil, 0, errors.New("expected object")
+	}
+	var out []jsonMember
+	i := jsonSkipSpace(b, start+1)
+	for i < len(b) && b[i] != '}' {
+		keyEnd, err := jsonValueEnd(b, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		var key string
+		if err := json.Unmarshal(b[i:keyEnd], &key); err != nil {
+			return nil, 0, err
+		}
+		j := jsonSkipSpace(b, keyEnd)
+		if j >= len(b) || b[j] != ':' {
+			return nil, 0, errors.New("expected colon")
+		}
+		valStart := jsonSkipSpace(b, j+1)
+		valEnd, err := jsonValueEnd(b, valStart)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, jsonMember{Key: key, KeyStart: i, ValStart: valStart, ValEnd: valEnd})
+		i = jsonSkipSpace(b, valEnd)
+		if i < len(b) && b[i] == ',' {
+			i = jsonSkipSpace(b, i+1)
+		}
+	}
+	if i >= len(b) {
+		return nil, 0, errors.New("unterminated object")
+	}
+	return out, i + 1, nil
+}
+
+// jsonArrayElements 列出从 start（'['）开始的数组各元素的字节范围
+func jsonArrayElements(b []byte, start int) ([][2]int, error) {
+	var out [][2]int
+	i := jsonSkipSpace(b, start+1)
+	for i < len(b) && b[i] != ']' {
+		end, err := jsonValueEnd(b, i)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, [2]int{i, end})
+		i = jsonSkipSpace(b, end)
+		if i < len(b) && b[i] == ',' {
+			i = jsonSkipSpace(b, i+1)
+		}
+	}
+	return out, nil
+}
+
+// lineIndent pos 所在行行首到 pos 的空白（pos 前有其它内容时为空）
+func lineIndent(b []byte, pos int) string {
+	i := pos
+	for i > 0 && (b[i-1] == ' ' || b[i-1] == '\t') {
+		i--
+	}
+	if i > 0 && b[i-1] != '\n' {
+		return ""
+	}
+	return string(b[i:pos])
+}
+
+// applyJSONEdits 按位置应用互不重叠的修改
+func applyJSONEdits(raw []byte, edits []jsonEdit) []byte {
+	out := make([]byte, 0, len(raw))
+	pos := 0
+	for _, e := range edits {
+		out = append(out, raw[pos:e.Start]...)
+		out = append(out, e.Text...)
+		pos = e.End
+	}
+	return append(out, raw[pos:]...)
+}
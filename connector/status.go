@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 信号：
+// - SIGINT / SIGTERM：取消进行中的 RPC / HTTP 请求，主循环退出后在 SHUTDOWN_TIMEOUT_SECONDS 内
+//   做最后一轮流量采集并补报（补报不完的留在 outbox，下次启动继续），删除踢下线规则后退出；再收到一次立即退出
+// - SIGHUP：有配置文件时先重新加载（见 config_file.go），然后忽略 hash，立即对所有节点全量同步一次
+// - SIGUSR1：把当前状态输出到日志
+
+// dumpStatus 输出当前状态（SIGUSR1）；节点可能正在并发同步，读 syncState 一律持锁
+func dumpStatus(cfg config, st *syncState, started time.Time) {
+	fmt.Printf("[INFO] status: version=%s mode=%s nodes=%v uptime=%s\n", version, cfg.ApplyMode, cfg.NodeIDs, time.Since(started).Truncate(time.Second))
+	if cfg.HostID != "" {
+		assigned := make([]int, 0, len(cfg.HostNodes))
+		for _, n := range cfg.HostNodes {
+			assigned = append(assigned, n.NodeID)
+		}
+		fmt.Printf("[INFO] status: host=%s panel_assigned=%v\n", cfg.HostID, assigned)
+	}
+	for _, nodeID := range cfg.NodeIDs {
+		nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
+		h := health.snapshot(nodeID)
+
+		allowed, listVersion := -1, int64(0)
+		if al := st.allowedFor(nodeID); al != nil {
+			allowed, listVersion = len(al.sorted), al.Version
+		}
+		applied := -1
+		if list, err := loadAppliedState(filepath.Join(nodeDir, "applied.json")); err == nil {
+			applied = len(list)
+		}
+		pending := 0
+		if ob, err := loadOutbox(outboxPath(cfg, nodeID)); err == nil {
+			pending = len(ob.Entries)
+		}
+		hash := st.hashFor(nodeID)
+		if hash == "" {
+			hash = "-"
+		} else if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		st.mu.Lock()
+		lastGood := st.lastGood[nodeID]
+		offline := st.offlineErr[nodeID] != nil
+		st.mu.Unlock()
+
+		fmt.Printf("[INFO] status node %d: allowed=%d version=%d applied=%d sha=%s offline=%v last_good=%s last_sync=%s sync_error=%q last_report=%s report_error=%q outbox=%d\n",
+			nodeID, allowed, listVersion, applied, hash, offline, formatStatusTime(lastGood),
+			formatStatusUnix(h.LastSyncAt), h.LastSyncError, formatStatusUnix(h.LastReportAt), h.LastReportError, pending)
+		if err := st.massRemovalErr(nodeID); err != nil {
+			fmt.Printf("[INFO] status node %d: %v\n", nodeID, err)
+		}
+	}
+	fmt.Printf("[INFO] status: device_suspended=%d quota_exhausted=%d kicked=%d\n", st.suspendedCount(), st.quota.exhaustedCount(), kicks.count())
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatStatusUnix(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+// shutdown 主循环退出后的收尾：最后一轮流量采集与补报、删除踢下线规则
+func shutdown(cfg config, st *syncState) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if cfg.EnableTrafficReport && cfg.ApplyMode == "xray-grpc" {
+		if err := reportTrafficAll(ctx, cfg, st.quota); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] final traffic report failed: %v\n", err)
+		}
+	}
+	kicks.releaseAll(ctx, cfg)
+	fmt.Printf("[INFO] connector stopped\n")
+}
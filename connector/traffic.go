@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// trafficCounter 单个用户的上下行字节数（Xray 计数器读数或增量）
+type trafficCounter struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// trafficStateEntry traffic-state.json 中每个用户的记录
+// Epoch 为读数所属的 Xray 进程启动时间（unix 秒，= 当前时间 - Uptime），用于识别计数器重置；
+// 旧版本文件没有该字段（0），此时只能靠“读数变小”判断
+// TS 为读数时间（unix 秒），作为下一段增量的窗口起点，参与生成上报 ID
+type trafficStateEntry struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Epoch    int64 `json:"epoch,omitempty"`
+	TS       int64 `json:"ts,omitempty"`
+}
+
+// epochTolerance Uptime 只有秒级精度且与本机时钟有误差，启动时间相差在此范围内视为同一进程
+const epochTolerance = 5
+
+func sameEpoch(a, b int64) bool {
+	if a == 0 || b == 0 {
+		return true
+	}
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return d <= epochTolerance
+}
+
+// counterDelta 计算本次增量：
+// - 同一个 epoch 且读数没有变小：正常做差
+// - epoch 变了（Xray 重启过，哪怕重启后读数已经超过旧值）或读数变小：计数器被清零过，当前读数即为重启以来的增量
+func counterDelta(cur trafficCounter, curEpoch int64, prev trafficStateEntry) (delta trafficCounter, reset bool) {
+	if !sameEpoch(curEpoch, prev.Epoch) || cur.Upload < prev.Upload || cur.Download < prev.Download {
+		return cur, true
+	}
+	return trafficCounter{Upload: cur.Upload - prev.Upload, Download: cur.Download - prev.Download}, false
+}
+
+// panelError 面板返回的非成功响应（HTTP 状态码或 body 中的 code）
+type panelError struct {
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *panelError) Error() string {
+	if e.Status != 200 {
+		return fmt.Sprintf("panel status=%d body=%s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("panel code=%d message=%s", e.Code, e.Message)
+}
+
+// isPermanentPanelErr 面板明确拒绝（4xx，超时/限流除外），重试也不会成功
+func isPermanentPanelErr(err error) bool {
+	var pe *panelError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	status := pe.Status
+	if status == 200 {
+		status = pe.Code
+	}
+	return status >= 400 && status < 500 && status != 408 && status != 429
+}
+
+// reportTraffic 上报流量到面板（ts 为增量产生时间，面板据此写入对应分钟；reportID 为幂等键）
+func reportTraffic(ctx context.Context, cfg config, nodeID int, reportID string, uuid string, upload int64, download int64, ts int64) error {
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/report-traffic"
+	payload := map[string]interface{}{
+		"report_id": reportID,
+		"uuid":      uuid,
+		"node_id":   nodeID,
+		"upload":    upload,
+		"download":  download,
+		"ts":        ts,
+	}
+	bodyBytes, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return &panelError{Status: resp.StatusCode, Message: string(body)}
+	}
+
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &result); err == nil && result.Code != 200 {
+		return &panelError{Status: 200, Code: result.Code, Message: result.Message}
+	}
+
+	return nil
+}
+
+// errBulkUnsupported 面板没有批量上报接口（旧版本后端），调用方应退回逐条上报
+var errBulkUnsupported = errors.New("panel does not support bulk traffic report")
+
+// bulkReportUnsupported 一旦探测到面板不支持批量接口，本进程内不再尝试
+var bulkReportUnsupported atomic.Bool
+
+type bulkReportItem struct {
+	ReportID string `json:"report_id"`
+	UUID     string `json:"uuid"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	TS       int64  `json:"ts"`
+}
+
+type bulkReportRejected struct {
+	UUID    string `json:"uuid"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type bulkReportResult struct {
+	ReportID   string               `json:"report_id"`
+	Accepted   int                  `json:"accepted"`
+	Duplicates int                  `json:"duplicates"` // accepted 中面板已记过账的条数（重试）
+	Rejected   []bulkReportRejected `json:"rejected"`
+}
+
+// reportTrafficBulk 一次请求上报一个节点一个时间窗口内的全部增量（POST /api/internal/report-traffic/bulk）
+// 面板返回 404/405 时视为不支持批量接口，返回 errBulkUnsupported
+func reportTrafficBulk(ctx context.Context, cfg config, nodeID int, reportID string, windowStart, windowEnd int64, items []bulkReportItem) (*bulkReportResult, error) {
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/report-traffic/bulk"
+	payload := map[string]interface{}{
+		"report_id":    reportID,
+		"node_id":      nodeID,
+		"window_start": windowStart,
+		"window_end":   windowEnd,
+		"items":        items,
+	}
+	bodyBytes, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errBulkUnsupported
+	}
+	if resp.StatusCode != 200 {
+		return nil, &panelError{Status: resp.StatusCode, Message: string(body)}
+	}
+
+	var result struct {
+		Code    int              `json:"code"`
+		Message string           `json:"message"`
+		Data    bulkReportResult `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decode json failed: %w; body=%s", err, string(body))
+	}
+	if result.Code != 200 {
+		return nil, &panelError{Status: 200, Code: result.Code, Message: result.Message}
+	}
+	return &result.Data, nil
+}
+
+type onlineReportIP struct {
+	IP       string `json:"ip"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+type onlineReportUser struct {
+	UUID string           `json:"uuid"`
+	IPs  []onlineReportIP `json:"ips"`
+}
+
+// reportOnline 上报一个节点当前在线的用户及来源 IP（POST /api/internal/report-online，全量快照）
+func reportOnline(ctx context.Context, cfg config, nodeID int, ts int64, users []onlineReportUser) error {
+	url := strings.TrimRight(cfg.PanelBaseURL, "/") + "/api/internal/report-online"
+	payload := map[string]interface{}{
+		"node_id": nodeID,
+		"ts":      ts,
+		"users":   users,
+	}
+	bodyBytes, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-internal-token", cfg.InternalToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return &panelError{Status: resp.StatusCode, Message: string(body)}
+	}
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &result); err == nil && result.Code != 200 {
+		return &panelError{Status: 200, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
+
+// reportOnlineAll 读取 Xray 在线用户与 IP，按节点上报
+// 在线统计按 email（UUID）全局计数、不区分 inbound，与流量一样只记到 NODE_IDS 中第一个包含该 UUID 的节点；
+// 节点在不同的 Xray 上（配置文件按节点指定 API 地址）时，每个 Xray 各查一次、分别归属
+func reportOnlineAll(ctx context.Context, cfg config) error {
+	type xrayOnline struct {
+		online  map[string]map[string]int64
+		err     error
+		claimed map[string]struct{}
+	}
+	byAddr := make(map[string]*xrayOnline)
+	var queryErr error
+
+	now := time.Now().Unix()
+	for _, nodeID := range cfg.NodeIDs {
+		addr := xrayAddrForNode(cfg, nodeID)
+		xo, ok := byAddr[addr]
+		if !ok {
+			xo = &xrayOnline{claimed: make(map[string]struct{})}
+			xo.online, xo.err = xrayClientForNode(cfg, nodeID).onlineUserIPs(ctx)
+			byAddr[addr] = xo
+		}
+		if xo.err != nil {
+			queryErr = xo.err
+			continue
+		}
+		online, claimed := xo.online, xo.claimed
+
+		applied, err := loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json"))
+		if err != nil {
+			// 还没下发过列表：没有可归属的用户，跳过（不能上报空快照，否则会把面板上的会话全部关闭）
+			continue
+		}
+		users := make([]onlineReportUser, 0)
+		for _, uuid := range applied {
+			if _, ok := claimed[uuid]; ok {
+				continue
+			}
+			claimed[uuid] = struct{}{}
+			ips, ok := online[uuid]
+			if !ok {
+				continue
+			}
+			u := onlineReportUser{UUID: uuid}
+			for _, ip := range ipList(ips) {
+				u.IPs = append(u.IPs, onlineReportIP{IP: ip, LastSeen: ips[ip]})
+			}
+			users = append(users, u)
+		}
+		if err := reportOnline(ctx, cfg, nodeID, now, users); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d online report failed: %v\n", nodeID, err)
+		}
+	}
+	if queryErr != nil {
+		return fmt.Errorf("query online ips failed: %w", queryErr)
+	}
+	return nil
+}
+
+// loadTrafficState 加载上次流量状态（用于计算增量）
+func loadTrafficState(path string) (map[string]trafficStateEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return make(map[string]trafficStateEntry), nil // 文件不存在时返回空 map
+	}
+
+	var state map[string]trafficStateEntry
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = make(map[string]trafficStateEntry)
+	}
+	return state, nil
+}
+
+// saveTrafficState 保存流量状态
+func saveTrafficState(path string, state map[string]trafficStateEntry) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o644)
+}
+
+// reportTrafficAll 上报一轮流量：一次 QueryStats 读出所有用户计数器，再按节点分发上报
+// 同一个 UUID 出现在多个节点时，只记到 NODE_IDS 中第一个包含它的节点，避免重复计费；
+// 节点在不同的 Xray 上（配置文件按节点指定 API 地址）时，每个 Xray 各读一次计数器、分别归属
+// quota 非 nil 时同时累计本地用量，用完额度的用户在本轮结束后立即从 Xray 移除
+func reportTrafficAll(ctx context.Context, cfg config, quota *quotaTracker) error {
+	type xrayCounters struct {
+		counters map[string]trafficCounter
+		epoch    int64
+		err      error
+		claimed  map[string]struct{}
+	}
+	byAddr := make(map[string]*xrayCounters)
+	var queryErr error
+	addrNodes := make(map[string][]int)
+	for _, nodeID := range cfg.NodeIDs {
+		addr := xrayAddrForNode(cfg, nodeID)
+		addrNodes[addr] = append(addrNodes[addr], nodeID)
+	}
+
+	for _, nodeID := range cfg.NodeIDs {
+		addr := xrayAddrForNode(cfg, nodeID)
+		xc, ok := byAddr[addr]
+		if !ok {
+			x := xrayClientForNode(cfg, nodeID)
+			xc = &xrayCounters{claimed: make(map[string]struct{})}
+			// 先取 Uptime 再读计数器：若两次调用之间 Xray 恰好重启，读数会被判为新 epoch 的值，只会少计不会重复计
+			if uptime, err := x.uptime(ctx); err == nil {
+				xc.epoch = time.Now().Unix() - int64(uptime)
+			}
+			if cfg.TrafficResetStats {
+				xc.counters, xc.err = resetModeCounters(ctx, cfg, x, addrNodes[addr])
+			} else {
+				xc.counters, xc.err = x.queryUserTraffic(ctx, false)
+			}
+			byAddr[addr] = xc
+		}
+		if xc.err != nil {
+			// 读不到 Xray 计数器时，仍然补报 outbox 里积压的增量
+			queryErr = xc.err
+			nodeFlushOutbox(ctx, cfg, nodeID)
+			health.reportResult(nodeID, fmt.Errorf("query xray stats failed: %w", xc.err))
+			continue
+		}
+		if err := reportTrafficOnce(ctx, cfg, nodeID, xc.counters, xc.epoch, xc.claimed, quota); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d traffic report failed: %v\n", nodeID, err)
+			health.reportResult(nodeID, err)
+		}
+	}
+	if quota != nil {
+		enforceQuota(ctx, cfg, quota)
+	}
+	if queryErr != nil {
+		return fmt.Errorf("query xray stats failed: %w", queryErr)
+	}
+	return nil
+}
+
+// resetModeCounters 重置模式下读取一个 Xray 的计数器：清零前先确认用到它的节点 outbox 都能读，
+// 读不了就本轮不清零（计数器留在 Xray 里，修好后下一轮一并上报）；
+// 只清零这些节点 applied 列表中的用户，不属于任何节点的用户留在 Xray 里，不会清零后被丢掉
+func resetModeCounters(ctx context.Context, cfg config, x *xrayClient, nodeIDs []int) (map[string]trafficCounter, error) {
+	users := make(map[string]struct{})
+	for _, nodeID := range nodeIDs {
+		if _, err := loadOutbox(outboxPath(cfg, nodeID)); err != nil {
+			return nil, fmt.Errorf("node %d traffic outbox unreadable, stats not reset this round: %w", nodeID, err)
+		}
+		applied, _ := loadAppliedState(filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID), "applied.json"))
+		for _, uuid := range applied {
+			users[uuid] = struct{}{}
+		}
+	}
+	current, err := x.queryUserTraffic(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	for email, tc := range current {
+		if _, ok := users[email]; ok && (tc.Upload > 0 || tc.Download > 0) {
+			emails = append(emails, email)
+		}
+	}
+	sortStrings(emails)
+	counters, err := x.resetUserTraffic(ctx, emails)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] xray stats reset incomplete (%d/%d users), the rest is reported next round: %v\n", len(counters), len(emails), err)
+	}
+	return counters, nil
+}
+
+// nodeFlushOutbox 只补报 outbox，不采集新增量
+func nodeFlushOutbox(ctx context.Context, cfg config, nodeID int) {
+	path := outboxPath(cfg, nodeID)
+	ob, err := loadOutbox(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d load traffic outbox failed: %v\n", nodeID, err)
+		return
+	}
+	if len(ob.Entries) == 0 {
+		return
+	}
+	flushOutbox(ctx, cfg, nodeID, ob)
+	recordOutboxHealth(nodeID, ob)
+	if err := saveOutbox(path, ob); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d save traffic outbox failed: %v\n", nodeID, err)
+	}
+}
+
+// reportTrafficOnce 上报一个节点的流量增量
+// - 累计模式：counters 是 Xray 计数器当前值，与 traffic-state.json 中上次的值做差（计数器重置见 counterDelta）
+// - 重置模式（XRAY_STATS_RESET=true）：counters 是 resetModeCounters 清零前的读数，本身就是增量，不再依赖 traffic-state.json
+func reportTrafficOnce(ctx context.Context, cfg config, nodeID int, counters map[string]trafficCounter, epoch int64, claimed map[string]struct{}, quota *quotaTracker) error {
+	// 加载 applied.json 获取当前活跃的 UUID 列表
+	nodeDir := filepath.Join(cfg.OutputDir, fmt.Sprintf("node-%d", nodeID))
+	appliedPath := filepath.Join(nodeDir, "applied.json")
+	trafficStatePath := filepath.Join(nodeDir, "traffic-state.json")
+
+	appliedState, err := loadAppliedState(appliedPath)
+	if err != nil || len(appliedState) == 0 {
+		// applied.json 不存在或为空：没有新增量可采集，只补报积压
+		nodeFlushOutbox(ctx, cfg, nodeID)
+		return nil
+	}
+
+	obPath := outboxPath(cfg, nodeID)
+	ob, err := loadOutbox(obPath)
+	if err != nil {
+		// outbox 损坏时不能继续：否则新增量写不进去、计数器状态却前进了，流量会丢
+		return fmt.Errorf("load traffic outbox failed: %w", err)
+	}
+
+	// 加载上次流量状态（仅累计模式需要）
+	prevTraffic := make(map[string]trafficStateEntry)
+	if !cfg.TrafficResetStats {
+		prevTraffic, err = loadTrafficState(trafficStatePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d load traffic state failed: %v\n", nodeID, err)
+			prevTraffic = make(map[string]trafficStateEntry)
+		}
+		// traffic-state.json 落后于 outbox（上一轮写完 outbox 后进程退出）：以 outbox 记下的读数为基准
+		rebased := 0
+		for uuid, b := range ob.Baseline {
+			if b.TS > prevTraffic[uuid].TS {
+				prevTraffic[uuid] = b
+				rebased++
+			}
+		}
+		if rebased > 0 {
+			fmt.Printf("[INFO] node %d traffic state behind outbox, rebased %d users on outbox baseline\n", nodeID, rebased)
+		}
+	}
+
+	// 新的流量状态
+	newTraffic := make(map[string]trafficStateEntry, len(appliedState))
+	now := time.Now().Unix()
+	added := 0
+
+	for _, uuid := range appliedState {
+		if _, ok := claimed[uuid]; ok {
+			continue
+		}
+		claimed[uuid] = struct{}{}
+
+		// 没有计数器说明该用户还没产生过流量
+		cur := counters[uuid]
+		newTraffic[uuid] = trafficStateEntry{Upload: cur.Upload, Download: cur.Download, Epoch: epoch, TS: now}
+
+		// 计算增量（窗口起点为上次读数时间，未知时为 0）
+		delta := cur
+		var windowStart int64
+		if prev, ok := prevTraffic[uuid]; ok && !cfg.TrafficResetStats {
+			windowStart = prev.TS
+			var reset bool
+			if delta, reset = counterDelta(cur, epoch, prev); reset {
+				fmt.Printf("[INFO] node %d uuid %s counter reset detected (epoch %d -> %d), counting current value as delta\n", nodeID, uuid, prev.Epoch, epoch)
+			}
+		}
+
+		// 只记录增量 > 0 的流量
+		if delta.Upload > 0 || delta.Download > 0 {
+			ob.add(nodeID, uuid, delta, windowStart, now)
+			if !cfg.TrafficResetStats {
+				if ob.Baseline == nil {
+					ob.Baseline = make(map[string]trafficStateEntry)
+				}
+				ob.Baseline[uuid] = newTraffic[uuid]
+			}
+			added++
+			if quota != nil && quota.consume(uuid, delta.Upload+delta.Download) {
+				fmt.Printf("[INFO] node %d uuid %s used up remaining quota locally\n", nodeID, uuid)
+			}
+		}
+	}
+
+	// 先把增量（连同对应读数 Baseline）写进 outbox，再推进计数器状态：
+	// 两步之间进程被杀时，下一轮按 Baseline 接着算，既不丢也不重复
+	if added > 0 {
+		if err := saveOutbox(obPath, ob); err != nil {
+			return fmt.Errorf("save traffic outbox failed: %w", err)
+		}
+	}
+	if !cfg.TrafficResetStats {
+		if err := saveTrafficState(trafficStatePath, newTraffic); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] node %d save traffic state failed: %v\n", nodeID, err)
+		} else {
+			ob.Baseline = nil
+		}
+	}
+
+	flushOutbox(ctx, cfg, nodeID, ob)
+	recordOutboxHealth(nodeID, ob)
+	if err := saveOutbox(obPath, ob); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] node %d save traffic outbox failed: %v\n", nodeID, err)
+	}
+	return nil
+}
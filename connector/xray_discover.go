@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
+)
+
+// Xray inbound 发现（xray-grpc）：
+// 不再只靠 tag 名猜协议，而是读取本机 Xray 配置（XRAY_CONFIG，加上 XRAY_CONFDIR 目录下的片段），
+// 读不到时通过 HandlerService.ListInbounds 查询运行中的内核，得到每个 inbound 的 tag、协议、vless flow 与传输方式。
+// 节点指定了其它 API 地址（配置文件 nodes[].xray_api_addr）时，该地址只查询内核。
+// 启动时校验 XRAY_TAG_MAP / nodes[].xray_tag：tag 不存在、协议不能下发用户、与配置的 protocol 不一致都直接退出；
+// 运行中（配置重新加载、Xray 重启后）重新发现，问题只打 WARN。两种来源都不可用时退回按 tag 猜测。
+
+// xrayInbound 发现到的一个 inbound
+type xrayInbound struct {
+	Tag      string
+	Protocol string // vless / vmess / trojan / shadowsocks；其它协议（socks、dokodemo-door 等）原样保留
+	Flow     string // vless 用户的 flow：配置中用户带的 flow，传输不支持 vision 时为 "none"，空表示未知
+	Network  string // raw(tcp) / ws / grpc / xhttp ...
+	Security string // none / tls / reality
+	Port     int
+	SSMethod string // shadowsocks：inbound 的加密方式
+}
+
+func (in xrayInbound) String() string {
+	s := fmt.Sprintf("%s(%s", in.Tag, in.Protocol)
+	if in.Network != "" {
+		s += "/" + in.Network
+	}
+	if in.Security != "" && in.Security != "none" {
+		s += "/" + in.Security
+	}
+	if in.Flow != "" {
+		s += " flow=" + in.Flow
+	}
+	return s + ")"
+}
+
+// xrayConfigInbound Xray JSON 配置中一个 inbound 用到的部分（发现与节点注册共用）
+type xrayConfigInbound struct {
+	Tag      string          `json:"tag"`
+	Protocol string          `json:"protocol"`
+	Port     json.RawMessage `json:"port"`
+	Settings struct {
+		Clients []struct {
+			Flow   string `json:"flow"`
+			Method string `json:"method"`
+		} `json:"clients"`
+		Method   string `json:"method"`
+		Password string `json:"password"`
+	} `json:"settings"`
+	StreamSettings struct {
+		Network         string `json:"network"`
+		Security        string `json:"security"`
+		RealitySettings struct {
+			ServerNames []string `json:"serverNames"`
+			PrivateKey  string   `json:"privateKey"`
+			ShortIDs    []string `json:"shortIds"`
+		} `json:"realitySettings"`
+		TLSSettings struct {
+			ServerName string `json:"serverName"`
+		} `json:"tlsSettings"`
+		WSSettings struct {
+			Path    string            `json:"path"`
+			Host    string            `json:"host"`
+			Headers map[string]string `json:"headers"`
+		} `json:"wsSettings"`
+		GRPCSettings struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"grpcSettings"`
+	} `json:"streamSettings"`
+}
+
+// readXrayConfigInbounds 读取 Xray 配置文件与 confdir 片段（按文件名顺序）中带 tag 的 inbound，
+// 同 tag 的 inbound 后者覆盖前者，顺序按首次出现
+func readXrayConfigInbounds(path, confDir string) ([]xrayConfigInbound, []string, error) {
+	var files []string
+	if path != "" {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		} else if confDir == "" {
+			return nil, nil, err
+		}
+	}
+	if confDir != "" {
+		matches, err := filepath.Glob(filepath.Join(confDir, "*.json"))
+		if err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no xray config found: %w", os.ErrNotExist)
+	}
+
+	var out []xrayConfigInbound
+	index := make(map[string]int)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, files, err
+		}
+		var doc struct {
+			Inbounds []xrayConfigInbound `json:"inbounds"`
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, files, fmt.Errorf("%s: %w", f, err)
+		}
+		for _, in := range doc.Inbounds {
+			if in.Tag == "" {
+				// 没有 tag 的 inbound 无法通过 API 管理用户
+				continue
+			}
+			if i, ok := index[in.Tag]; ok {
+				out[i] = in
+				continue
+			}
+			index[in.Tag] = len(out)
+			out = append(out, in)
+		}
+	}
+	return out, files, nil
+}
+
+// loadXrayConfigInbounds 从 Xray 配置文件得到 inbound 发现结果
+func loadXrayConfigInbounds(path, confDir string) (map[string]xrayInbound, []string, error) {
+	inbounds, files, err := readXrayConfigInbounds(path, confDir)
+	if err != nil {
+		return nil, files, err
+	}
+	out := make(map[string]xrayInbound, len(inbounds))
+	for _, in := range inbounds {
+		var flows []string
+		ssMethod := in.Settings.Method
+		for _, c := range in.Settings.Clients {
+			flows = append(flows, c.Flow)
+			if ssMethod == "" {
+				// 旧版 shadowsocks 可以只在 clients 里写 method
+				ssMethod = c.Method
+			}
+		}
+		protoName := strings.ToLower(in.Protocol)
+		network := strings.ToLower(in.StreamSettings.Network)
+		security := strings.ToLower(in.StreamSettings.Security)
+		if security == "" {
+			security = "none"
+		}
+		out[in.Tag] = xrayInbound{
+			Tag:      in.Tag,
+			Protocol: protoName,
+			Flow:     inboundFlow(protoName, network, flows, true),
+			Network:  network,
+			Security: security,
+			Port:     configPort(in.Port),
+			SSMethod: ssMethod,
+		}
+	}
+	return out, files, nil
+}
+
+// configPort inbound 的 port 可以是数字、"443" 或 "1000-2000"，取第一个端口
+func configPort(raw json.RawMessage) int {
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		n, _ = strconv.Atoi(strings.TrimSpace(strings.SplitN(s, "-", 2)[0]))
+	}
+	return n
+}
+
+// inboundFlow 推断 vless 用户应带的 flow：以配置中已有用户为准；没有用户时，
+// 非 raw(tcp) 传输不支持 xtls-rprx-vision，返回 "none"；其余情况未知（用 XRAY_VLESS_FLOW）
+func inboundFlow(protoName, network string, clientFlows []string, fromConfig bool) string {
+	if protoName != "vless" {
+		return ""
+	}
+	for _, f := range clientFlows {
+		if f != "" {
+			return f
+		}
+	}
+	if fromConfig && len(clientFlows) > 0 {
+		// 配置里写了用户但都不带 flow
+		return "none"
+	}
+	switch network {
+	case "", "tcp", "raw":
+		return ""
+	default:
+		return "none"
+	}
+}
+
+// queryXrayInbounds 通过 HandlerService.ListInbounds 查询运行中内核的 inbound（不含用户，因此没有配置中的 flow）
+func queryXrayInbounds(ctx context.Context, x *xrayClient) (map[string]xrayInbound, error) {
+	list, err := x.listInbounds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]xrayInbound, len(list))
+	for _, h := range list {
+		if h.GetTag() == "" {
+			continue
+		}
+		in := xrayInbound{Tag: h.GetTag(), Protocol: typedMessageProtocol(h.GetProxySettings().GetType())}
+		if inst, err := h.GetReceiverSettings().GetInstance(); err == nil {
+			if rc, ok := inst.(*proxyman.ReceiverConfig); ok {
+				ss := rc.GetStreamSettings()
+				in.Network = strings.ToLower(ss.GetProtocolName())
+				in.Security = typedMessageProtocol(ss.GetSecurityType())
+				if ranges := rc.GetPortList().GetRange(); len(ranges) > 0 {
+					in.Port = int(ranges[0].GetFrom())
+				}
+			}
+		}
+		if in.Security == "" {
+			in.Security = "none"
+		}
+		in.Flow = inboundFlow(in.Protocol, in.Network, nil, false)
+		if in.Protocol == "shadowsocks" {
+			in.SSMethod = proxySSMethod(h.GetProxySettings())
+		}
+		out[in.Tag] = in
+	}
+	return out, nil
+}
+
+// proxySSMethod 运行中 shadowsocks inbound 的加密方式：2022 取 inbound 的 method，
+// 旧版各用户自带 cipher，取第一个用户的；取不到时为空（退回 XRAY_SS_METHOD）
+func proxySSMethod(settings *serial.TypedMessage) string {
+	inst, err := settings.GetInstance()
+	if err != nil {
+		return ""
+	}
+	switch c := inst.(type) {
+	case *shadowsocks_2022.MultiUserServerConfig:
+		return c.GetMethod()
+	case *shadowsocks_2022.ServerConfig:
+		return c.GetMethod()
+	case *shadowsocks.ServerConfig:
+		for _, u := range c.GetUsers() {
+			acct, err := u.GetAccount().GetInstance()
+			if err != nil {
+				continue
+			}
+			if a, ok := acct.(*shadowsocks.Account); ok {
+				return ssMethodName(a.GetCipherType())
+			}
+		}
+	}
+	return ""
+}
+
+// typedMessageProtocol 从 TypedMessage 类型名取协议名：
+// xray.proxy.vless.inbound.Config -> vless，xray.transport.internet.reality.Config -> reality
+func typedMessageProtocol(typ string) string {
+	parts := strings.Split(typ, ".")
+	if len(parts) < 3 {
+		return ""
+	}
+	name := parts[len(parts)-2]
+	if parts[1] == "proxy" {
+		name = parts[2]
+	}
+	if name == "shadowsocks_2022" {
+		name = "shadowsocks"
+	}
+	return name
+}
+
+// discoverXrayInbounds 按 API 地址发现 inbound：全局地址先读配置文件，读不到或其它地址查询运行中的内核。
+// 某个地址这次发现失败时保留 prev 中的结果
+func discoverXrayInbounds(ctx context.Context, cfg config, prev map[string]map[string]xrayInbound) map[string]map[string]xrayInbound {
+	out := make(map[string]map[string]xrayInbound)
+	for _, addr := range xrayAPIAddrs(cfg) {
+		if addr == cfg.XrayAPIAddr {
+			inbounds, files, err := loadXrayConfigInbounds(cfg.XrayConfigPath, cfg.XrayConfDir)
+			if err == nil {
+				out[addr] = inbounds
+				fmt.Printf("[INFO] xray inbounds from %s: %s\n", strings.Join(files, ", "), formatXrayInbounds(inbounds))
+				continue
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "[WARN] read xray config failed, querying running core instead: %v\n", err)
+			}
+		}
+		x := newXrayClient(addr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow, cfg.XraySSMethod)
+		inbounds, err := queryXrayInbounds(ctx, x)
+		if err != nil {
+			if old, ok := prev[addr]; ok {
+				out[addr] = old
+			}
+			fmt.Fprintf(os.Stderr, "[WARN] xray %s list inbounds failed, protocols fall back to tag guessing: %v\n", addr, err)
+			continue
+		}
+		out[addr] = inbounds
+		fmt.Printf("[INFO] xray inbounds from core %s: %s\n", addr, formatXrayInbounds(inbounds))
+	}
+	return out
+}
+
+// xrayDiscoveryIncomplete 是否还有节点用到的 API 地址没有发现结果（启动时 Xray 未就绪等）
+func xrayDiscoveryIncomplete(cfg config) bool {
+	for _, addr := range xrayAPIAddrs(cfg) {
+		if _, ok := cfg.XrayInbounds[addr]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func formatXrayInbounds(inbounds map[string]xrayInbound) string {
+	tags := make([]string, 0, len(inbounds))
+	for tag := range inbounds {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	parts := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		parts = append(parts, inbounds[tag].String())
+	}
+	if len(parts) == 0 {
+		return "(none)"
+	}
+	return strings.Join(parts, " ")
+}
+
+// userInboundTags 能下发面板用户的 inbound tag（排序）
+func userInboundTags(inbounds map[string]xrayInbound) []string {
+	var tags []string
+	for tag, in := range inbounds {
+		if containsString(xrayProtocols, in.Protocol) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// xrayInboundForNode 节点 inbound 的发现结果（没有发现结果或 tag 不存在时 ok=false）
+func xrayInboundForNode(cfg config, nodeID int) (xrayInbound, bool) {
+	in, ok := cfg.XrayInbounds[xrayAddrForNode(cfg, nodeID)][xrayTagForNode(cfg, nodeID)]
+	return in, ok
+}
+
+// checkXrayTags 用发现结果校验各节点的 tag 与协议，并拒绝多个节点映射到同一个 inbound
+func checkXrayTags(cfg config) []error {
+	var errs []error
+	owners := make(map[string]int)
+	for _, nodeID := range cfg.NodeIDs {
+		if err := checkXrayTag(cfg, nodeID); err != nil {
+			errs = append(errs, err)
+		}
+		if err := claimXrayTag(cfg, owners, nodeID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// claimXrayTag 登记节点使用的 inbound（API 地址 + tag）。同步时以 inbound 里的实际用户做 diff，
+// 不在本节点列表里的用户都会被移除：两个节点共用一个 inbound 会互相删掉对方的用户
+func claimXrayTag(cfg config, owners map[string]int, nodeID int) error {
+	addr, tag := xrayAddrForNode(cfg, nodeID), xrayTagForNode(cfg, nodeID)
+	key := addr + "/" + tag
+	if other, ok := owners[key]; ok && other != nodeID {
+		return fmt.Errorf("node %d: inbound %q (%s) is already used by node %d; each inbound can only be synced by one node", nodeID, tag, addr, other)
+	}
+	owners[key] = nodeID
+	return nil
+}
+
+// checkXrayTag 校验单个节点（该节点的 API 地址还没有发现结果时不校验）
+func checkXrayTag(cfg config, nodeID int) error {
+	inbounds, ok := cfg.XrayInbounds[xrayAddrForNode(cfg, nodeID)]
+	if !ok {
+		return nil
+	}
+	available := userInboundTags(inbounds)
+	tag := cfg.XrayTagMap[nodeID]
+	if tag == "" && len(available) != 1 {
+		// 与之前一样退回默认 tag（一键脚本的主机加了第二个 inbound 也不受影响），默认 tag 也不存在时才报错
+		if _, ok := inbounds[defaultXrayTag]; !ok {
+			return fmt.Errorf("node %d: no inbound tag mapped, xray has %d user inbounds %v and no %q; set XRAY_TAG_MAP or nodes[].xray_tag", nodeID, len(available), available, defaultXrayTag)
+		}
+	}
+	tag = xrayTagForNode(cfg, nodeID)
+	in, ok := inbounds[tag]
+	if !ok {
+		return fmt.Errorf("node %d: inbound tag %q not found in xray (user inbounds: %v)", nodeID, tag, available)
+	}
+	if !containsString(xrayProtocols, in.Protocol) {
+		return fmt.Errorf("node %d: inbound %q is %s, panel users cannot be added to it", nodeID, tag, in.Protocol)
+	}
+	if p := cfg.Nodes[nodeID].Protocol; p != "" && p != in.Protocol {
+		return fmt.Errorf("node %d: protocol %s configured but inbound %q is %s", nodeID, p, tag, in.Protocol)
+	}
+	return nil
+}
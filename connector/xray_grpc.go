@@ -7,12 +7,20 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	command "github.com/xtls/xray-core/app/proxyman/command"
+	"github.com/xtls/xray-core/app/router"
+	routercmd "github.com/xtls/xray-core/app/router/command"
 	stats "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
+	"github.com/xtls/xray-core/proxy/trojan"
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 )
@@ -21,6 +29,7 @@ type xrayClient struct {
 	addr      string
 	timeout   time.Duration
 	vlessFlow string
+	ssMethod  string // shadowsocks inbound 的加密方式（2022 系列走每用户密钥）
 }
 
 func isXrayAlreadyExistsErr(err error) bool {
@@ -43,7 +52,22 @@ func isXrayNotFoundErr(err error) bool {
 		strings.Contains(msg, "no such user")
 }
 
-func newXrayClient(addr string, timeout time.Duration, vlessFlow string) *xrayClient {
+// isXrayUnsupportedErr 内核不支持该接口（老版本没有 GetInboundUsers 等），调用方应退回兜底逻辑
+func isXrayUnsupportedErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if status.Code(err) == codes.Unimplemented {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown method") ||
+		strings.Contains(msg, "not implemented") ||
+		strings.Contains(msg, "not a usermanager") ||
+		strings.Contains(msg, "not support")
+}
+
+func newXrayClient(addr string, timeout time.Duration, vlessFlow string, ssMethod string) *xrayClient {
 	if strings.TrimSpace(addr) == "" {
 		addr = "127.0.0.1:10085"
 	}
@@ -52,8 +76,14 @@ func newXrayClient(addr string, timeout time.Duration, vlessFlow string) *xrayCl
 	}
 	if strings.TrimSpace(vlessFlow) == "" {
 		vlessFlow = "xtls-rprx-vision"
+	} else if vlessFlow == "none" {
+		// 显式关闭 flow（非 Reality/TLS 的 vless inbound）
+		vlessFlow = ""
 	}
-	return &xrayClient{addr: addr, timeout: timeout, vlessFlow: vlessFlow}
+	if strings.TrimSpace(ssMethod) == "" {
+		ssMethod = "2022-blake3-aes-128-gcm"
+	}
+	return &xrayClient{addr: addr, timeout: timeout, vlessFlow: vlessFlow, ssMethod: ssMethod}
 }
 
 func (c *xrayClient) dial(ctx context.Context) (*grpc.ClientConn, error) {
@@ -107,6 +137,62 @@ func (c *xrayClient) removeUser(ctx context.Context, inboundTag string, email st
 	return err
 }
 
+// listInboundUsers 读取 inbound 当前实际生效的用户 email 列表（HandlerService.GetInboundUsers）
+// 没有 email 的用户（配置文件里静态写死的 clients）无法按 email 增删，直接忽略
+func (c *xrayClient) listInboundUsers(ctx context.Context, inboundTag string) ([]string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := command.NewHandlerServiceClient(conn)
+	resp, err := client.GetInboundUsers(ctx, &command.GetInboundUserRequest{Tag: inboundTag})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(resp.Users))
+	for _, u := range resp.Users {
+		if u.GetEmail() == "" {
+			continue
+		}
+		out = append(out, u.GetEmail())
+	}
+	return out, nil
+}
+
+// listInbounds 列出运行中内核的所有 inbound（HandlerService.ListInbounds），用于发现 tag 与协议
+func (c *xrayClient) listInbounds(ctx context.Context) ([]*core.InboundHandlerConfig, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := command.NewHandlerServiceClient(conn)
+	resp, err := client.ListInbounds(ctx, &command.ListInboundsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetInbounds(), nil
+}
+
+// countInboundUsers 读取 inbound 当前用户数（HandlerService.GetInboundUsersCount），用于廉价校验
+func (c *xrayClient) countInboundUsers(ctx context.Context, inboundTag string) (int64, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	client := command.NewHandlerServiceClient(conn)
+	resp, err := client.GetInboundUsersCount(ctx, &command.GetInboundUserRequest{Tag: inboundTag})
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetCount(), nil
+}
+
 func (c *xrayClient) buildUser(uuid string, protoName string) (*protocol.User, error) {
 	protoName = strings.ToLower(strings.TrimSpace(protoName))
 	email := uuid // 用 uuid 作为稳定 email，便于 RemoveUser
@@ -132,53 +218,283 @@ func (c *xrayClient) buildUser(uuid string, protoName string) (*protocol.User, e
 			Email:   email,
 			Account: serial.ToTypedMessage(acc),
 		}, nil
+	case "trojan":
+		// 与订阅侧一致：trojan 密码即 UUID
+		acc := &trojan.Account{
+			Password: uuid,
+		}
+		return &protocol.User{
+			Level:   0,
+			Email:   email,
+			Account: serial.ToTypedMessage(acc),
+		}, nil
+	case "shadowsocks":
+		if isSS2022Method(c.ssMethod) {
+			// 2022 多用户：inbound 级别配置 method + 服务端 key，用户只带自己的 key
+			acc := &shadowsocks_2022.Account{
+				Key: ss2022UserKey(uuid, c.ssMethod),
+			}
+			return &protocol.User{
+				Level:   0,
+				Email:   email,
+				Account: serial.ToTypedMessage(acc),
+			}, nil
+		}
+		cipher, err := ssCipherType(c.ssMethod)
+		if err != nil {
+			return nil, err
+		}
+		acc := &shadowsocks.Account{
+			Password:   uuid,
+			CipherType: cipher,
+		}
+		return &protocol.User{
+			Level:   0,
+			Email:   email,
+			Account: serial.ToTypedMessage(acc),
+		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported proto for grpc add/remove: %s", protoName)
 	}
 }
 
-// getUserTraffic 查询指定用户的流量（通过 email/UUID）
-// 返回 upload, download（字节数）
-func (c *xrayClient) getUserTraffic(ctx context.Context, email string) (upload int64, download int64, err error) {
+// ssCipherType 把 Xray 配置里的 method 字符串转为旧版 shadowsocks 的 CipherType
+func ssCipherType(method string) (shadowsocks.CipherType, error) {
+	switch strings.ToLower(strings.TrimSpace(method)) {
+	case "aes-128-gcm", "aead_aes_128_gcm":
+		return shadowsocks.CipherType_AES_128_GCM, nil
+	case "aes-256-gcm", "aead_aes_256_gcm":
+		return shadowsocks.CipherType_AES_256_GCM, nil
+	case "chacha20-poly1305", "chacha20-ietf-poly1305", "aead_chacha20_poly1305":
+		return shadowsocks.CipherType_CHACHA20_POLY1305, nil
+	case "xchacha20-poly1305", "xchacha20-ietf-poly1305", "aead_xchacha20_poly1305":
+		return shadowsocks.CipherType_XCHACHA20_POLY1305, nil
+	case "none", "plain":
+		return shadowsocks.CipherType_NONE, nil
+	default:
+		return shadowsocks.CipherType_UNKNOWN, fmt.Errorf("unsupported shadowsocks method: %s", method)
+	}
+}
+
+// ssMethodName ssCipherType 的反向映射，未知时返回空
+func ssMethodName(t shadowsocks.CipherType) string {
+	switch t {
+	case shadowsocks.CipherType_AES_128_GCM:
+		return "aes-128-gcm"
+	case shadowsocks.CipherType_AES_256_GCM:
+		return "aes-256-gcm"
+	case shadowsocks.CipherType_CHACHA20_POLY1305:
+		return "chacha20-poly1305"
+	case shadowsocks.CipherType_XCHACHA20_POLY1305:
+		return "xchacha20-poly1305"
+	case shadowsocks.CipherType_NONE:
+		return "none"
+	default:
+		return ""
+	}
+}
+
+// uptime 读取 Xray 进程运行时长（秒），用于检测重启（StatsService.GetSysStats）
+func (c *xrayClient) uptime(ctx context.Context) (uint32, error) {
+	resp, err := c.sysStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetUptime(), nil
+}
+
+// sysStats 读取 Xray 进程运行状态（Uptime、内存、goroutine 数等）
+func (c *xrayClient) sysStats(ctx context.Context) (*stats.SysStatsResponse, error) {
 	conn, err := c.dial(ctx)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	defer conn.Close()
 
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
 	client := stats.NewStatsServiceClient(conn)
+	return client.GetSysStats(ctx, &stats.SysStatsRequest{})
+}
 
-	// 查询 uplink 流量：Xray 官方格式为 user>>>email>>>traffic>>>uplink
-	uplinkResp, err := client.QueryStats(ctx, &stats.QueryStatsRequest{
-		Pattern: fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email),
-		Reset_:   false, // 不重置，只查询
-	})
+// queryUserTraffic 一次 QueryStats（pattern=user>>>）读出所有用户的上下行计数器
+// 计数器名格式：user>>>{email}>>>traffic>>>uplink / downlink（email 即 UUID）
+// reset=true 时 Xray 读数后清零，返回值即为自上次查询以来的增量
+func (c *xrayClient) queryUserTraffic(ctx context.Context, reset bool) (map[string]trafficCounter, error) {
+	conn, err := c.dial(ctx)
 	if err != nil {
-		return 0, 0, fmt.Errorf("query uplink failed: %w", err)
+		return nil, err
 	}
+	defer conn.Close()
 
-	// 查询 downlink 流量：user>>>email>>>traffic>>>downlink
-	downlinkResp, err := client.QueryStats(ctx, &stats.QueryStatsRequest{
-		Pattern: fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email),
-		Reset_:  false, // 不重置，只查询
+	client := stats.NewStatsServiceClient(conn)
+	resp, err := client.QueryStats(ctx, &stats.QueryStatsRequest{
+		Pattern: "user>>>",
+		Reset_:  reset,
 	})
 	if err != nil {
-		return 0, 0, fmt.Errorf("query downlink failed: %w", err)
+		return nil, err
+	}
+
+	out := make(map[string]trafficCounter)
+	for _, st := range resp.GetStat() {
+		parts := strings.Split(st.GetName(), ">>>")
+		if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+			continue
+		}
+		email := parts[1]
+		tc := out[email]
+		switch parts[3] {
+		case "uplink":
+			tc.Upload = st.GetValue()
+		case "downlink":
+			tc.Download = st.GetValue()
+		default:
+			continue
+		}
+		out[email] = tc
+	}
+	return out, nil
+}
+
+// resetUserTraffic 逐个读取并清零指定用户的流量计数器（一用户一次 QueryStats reset，共用一个连接），
+// 返回清零前的读数；其它用户的计数器不动
+func (c *xrayClient) resetUserTraffic(ctx context.Context, emails []string) (map[string]trafficCounter, error) {
+	out := make(map[string]trafficCounter, len(emails))
+	if len(emails) == 0 {
+		return out, nil
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := stats.NewStatsServiceClient(conn)
+	for _, email := range emails {
+		resp, err := client.QueryStats(ctx, &stats.QueryStatsRequest{
+			Pattern: "user>>>" + email + ">>>traffic>>>",
+			Reset_:  true,
+		})
+		if err != nil {
+			// 已清零的用户读数照常返回，避免丢掉；没处理到的用户留到下一轮
+			return out, fmt.Errorf("reset stats of %s: %w", email, err)
+		}
+		var tc trafficCounter
+		for _, st := range resp.GetStat() {
+			switch {
+			case strings.HasSuffix(st.GetName(), ">>>uplink"):
+				tc.Upload = st.GetValue()
+			case strings.HasSuffix(st.GetName(), ">>>downlink"):
+				tc.Download = st.GetValue()
+			}
+		}
+		out[email] = tc
+	}
+	return out, nil
+}
+
+// onlineUserIPs 读取所有在线用户及其来源 IP（StatsService.GetAllOnlineUsers + GetStatsOnlineIpList）
+// 需要 policy 中开启 statsUserOnline；返回 email -> (ip -> 最近活跃时间 unix 秒)
+// Xray 只保留最近 20 秒内有新连接的 IP
+func (c *xrayClient) onlineUserIPs(ctx context.Context) (map[string]map[string]int64, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := stats.NewStatsServiceClient(conn)
+	resp, err := client.GetAllOnlineUsers(ctx, &stats.GetAllOnlineUsersRequest{})
+	if err != nil {
+		return nil, err
 	}
 
-	upload = int64(0)
-	download = int64(0)
+	out := make(map[string]map[string]int64)
+	for _, name := range resp.GetUsers() {
+		// 名称格式：user>>>{email}>>>online
+		parts := strings.Split(name, ">>>")
+		if len(parts) != 3 || parts[0] != "user" || parts[2] != "online" {
+			continue
+		}
+		ipResp, err := client.GetStatsOnlineIpList(ctx, &stats.GetStatsRequest{Name: name})
+		if err != nil {
+			if isXrayNotFoundErr(err) {
+				// 两次调用之间该用户已下线
+				continue
+			}
+			return nil, err
+		}
+		if len(ipResp.GetIps()) > 0 {
+			out[parts[1]] = ipResp.GetIps()
+		}
+	}
+	return out, nil
+}
 
-	// 解析 uplink 响应
-	if len(uplinkResp.Stat) > 0 {
-		upload = uplinkResp.Stat[0].Value
+// userTrafficTotal 读取某用户上下行计数器之和（不清零）；计数器不存在时返回 0
+func (c *xrayClient) userTrafficTotal(ctx context.Context, email string) (int64, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	// 解析 downlink 响应
-	if len(downlinkResp.Stat) > 0 {
-		download = downlinkResp.Stat[0].Value
+	client := stats.NewStatsServiceClient(conn)
+	var total int64
+	for _, dir := range []string{"uplink", "downlink"} {
+		resp, err := client.GetStats(ctx, &stats.GetStatsRequest{Name: fmt.Sprintf("user>>>%s>>>traffic>>>%s", email, dir)})
+		if err != nil {
+			if isXrayNotFoundErr(err) {
+				continue
+			}
+			return 0, err
+		}
+		total += resp.GetStat().GetValue()
+	}
+	return total, nil
+}
+
+// addUserBlockRule 通过 RoutingService 追加一条规则：该 inbound 上该用户的流量全部走 outboundTag（黑洞）
+// Xray 允许重复的 ruleTag，先按 tag 删除一次保证幂等
+func (c *xrayClient) addUserBlockRule(ctx context.Context, ruleTag string, inboundTag string, email string, outboundTag string) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	return upload, download, nil
+	client := routercmd.NewRoutingServiceClient(conn)
+	if _, err := client.RemoveRule(ctx, &routercmd.RemoveRuleRequest{RuleTag: ruleTag}); err != nil {
+		return err
+	}
+	cfg := &router.Config{
+		Rule: []*router.RoutingRule{{
+			RuleTag:    ruleTag,
+			InboundTag: []string{inboundTag},
+			UserEmail:  []string{email},
+			TargetTag:  &router.RoutingRule_Tag{Tag: outboundTag},
+		}},
+	}
+	_, err = client.AddRule(ctx, &routercmd.AddRuleRequest{
+		Config:       serial.ToTypedMessage(cfg),
+		ShouldAppend: true,
+	})
+	return err
 }
 
+// removeRule 按 ruleTag 删除路由规则（不存在也视为成功）
+func (c *xrayClient) removeRule(ctx context.Context, ruleTag string) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := routercmd.NewRoutingServiceClient(conn)
+	_, err = client.RemoveRule(ctx, &routercmd.RemoveRuleRequest{RuleTag: ruleTag})
+	if err != nil && isXrayNotFoundErr(err) {
+		return nil
+	}
+	return err
+}
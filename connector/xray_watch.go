@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Xray 重启检测：
+// 通过 StatsService.GetSysStats 读取 Xray 的 Uptime，Uptime 变小说明进程重启过；
+// API 从不可达恢复为可达也视为（可能）重启。两种情况都要立刻把所有节点的允许列表重新下发，
+// 因为动态 AddUser 的用户只存在于 Xray 内存里，重启后全部丢失。
+// 未开启 StatsService 的内核（GetSysStats 返回 Unimplemented）只能依赖“可达性变化”判断。
+// 节点可以各自指定 xray_api_addr：每个 API 地址单独探测，某个 Xray 重启只重新下发用它的节点。
+
+type xrayWatch struct {
+	seen       bool   // 是否至少成功探测过一次
+	up         bool   // 上次探测时 API 是否可达
+	lastUptime uint32 // 上次探测到的 Uptime（秒）
+}
+
+// check 探测一次 Xray 状态，返回是否检测到重启 / API 恢复
+func (w *xrayWatch) check(ctx context.Context, x *xrayClient) (restarted bool, reason string) {
+	uptime, err := x.uptime(ctx)
+	reachable := err == nil || isXrayUnsupportedErr(err)
+	if !reachable {
+		if w.up {
+			fmt.Fprintf(os.Stderr, "[WARN] xray api unreachable: %v\n", err)
+		}
+		w.up = false
+		return false, ""
+	}
+
+	switch {
+	case !w.seen:
+		// 首次探测：启动时首轮同步本来就会全量对账，这里不重复触发
+	case !w.up:
+		restarted, reason = true, "api back online"
+	case err == nil && uptime < w.lastUptime:
+		restarted, reason = true, fmt.Sprintf("uptime %ds -> %ds", w.lastUptime, uptime)
+	}
+
+	w.seen = true
+	w.up = true
+	if err == nil {
+		w.lastUptime = uptime
+	}
+	return restarted, reason
+}
+
+// waitXrayReady 等待 Xray API 可用（替代固定 sleep），超时或 ctx 结束时返回错误
+func waitXrayReady(ctx context.Context, x *xrayClient, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := x.uptime(ctx)
+		if err == nil || isXrayUnsupportedErr(err) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("xray api not ready after %s: %w", timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitXrayReadyAll 并行等待所有节点用到的 Xray API 就绪，返回就绪的地址数与未就绪地址的错误
+func waitXrayReadyAll(ctx context.Context, cfg config, timeout time.Duration) (int, error) {
+	addrs := xrayAPIAddrs(cfg)
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			x := newXrayClient(addr, cfg.XrayRPCTimeout, cfg.XrayVlessFlow, cfg.XraySSMethod)
+			if err := waitXrayReady(ctx, x, timeout); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", addr, err)
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+	ready := 0
+	for _, err := range errs {
+		if err == nil {
+			ready++
+		}
+	}
+	return ready, errors.Join(errs...)
+}
@@ -20,6 +20,7 @@ SET FOREIGN_KEY_CHECKS = 0;
 -- -----------------------------------------------------------------------------
 DROP TABLE IF EXISTS `node_connections`;
 DROP TABLE IF EXISTS `node_traffic`;
+DROP TABLE IF EXISTS `node_status`;
 DROP TABLE IF EXISTS `plan_nodes`;
 DROP TABLE IF EXISTS `ticket_replies`;
 DROP TABLE IF EXISTS `tickets`;
@@ -29,6 +30,7 @@ DROP TABLE IF EXISTS `subscriptions`;
 DROP TABLE IF EXISTS `user_clients`;
 DROP TABLE IF EXISTS `user_signins`;
 DROP TABLE IF EXISTS `user_traffic_minute`;
+DROP TABLE IF EXISTS `traffic_reports`;
 DROP TABLE IF EXISTS `plans`;
 DROP TABLE IF EXISTS `nodes`;
 DROP TABLE IF EXISTS `plan_groups`;
@@ -300,6 +302,33 @@ CREATE TABLE `node_traffic` (
   CONSTRAINT `fk_nt_node` FOREIGN KEY (`node_id`) REFERENCES `nodes` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='节点日流量统计';
 
+-- -----------------------------------------------------------------------------
+-- 7.1 节点运行状态 node_status（connector 心跳，internal heartbeat）
+-- -----------------------------------------------------------------------------
+CREATE TABLE `node_status` (
+  `node_id` INT NOT NULL COMMENT '节点ID',
+  `connector_version` VARCHAR(50) DEFAULT NULL COMMENT 'connector 版本',
+  `apply_mode` VARCHAR(20) DEFAULT NULL COMMENT 'connector 下发模式',
+  `xray_version` VARCHAR(50) DEFAULT NULL COMMENT 'Xray 内核版本',
+  `xray_uptime` INT DEFAULT NULL COMMENT 'Xray 运行时长（秒）',
+  `xray_mem_bytes` BIGINT DEFAULT NULL COMMENT 'Xray 内存占用（Go runtime Sys，字节）',
+  `load1` DECIMAL(8,2) DEFAULT NULL COMMENT '主机 1 分钟负载',
+  `cpu_percent` DECIMAL(5,2) DEFAULT NULL COMMENT '主机 CPU 使用率（%）',
+  `mem_total` BIGINT DEFAULT NULL COMMENT '主机内存总量（字节）',
+  `mem_available` BIGINT DEFAULT NULL COMMENT '主机可用内存（字节）',
+  `net_rx_bytes` BIGINT DEFAULT NULL COMMENT '网卡累计接收（字节）',
+  `net_tx_bytes` BIGINT DEFAULT NULL COMMENT '网卡累计发送（字节）',
+  `applied_users` INT NOT NULL DEFAULT 0 COMMENT '已下发用户数',
+  `last_sync_at` DATETIME DEFAULT NULL COMMENT '最近一次同步时间',
+  `last_sync_error` VARCHAR(500) DEFAULT NULL COMMENT '最近一次同步错误（成功为空）',
+  `last_report_error` VARCHAR(500) DEFAULT NULL COMMENT '最近一次流量上报错误（成功为空）',
+  `detail` TEXT DEFAULT NULL COMMENT '心跳原始内容（JSON 文本）',
+  `last_heartbeat_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '最近一次心跳时间',
+  PRIMARY KEY (`node_id`),
+  KEY `idx_ns_heartbeat` (`last_heartbeat_at`),
+  CONSTRAINT `fk_ns_node` FOREIGN KEY (`node_id`) REFERENCES `nodes` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='节点运行状态（每节点一行，心跳覆盖写）';
+
 -- -----------------------------------------------------------------------------
 -- 8. 用户分钟级流量 user_traffic_minute（反向自库）
 -- -----------------------------------------------------------------------------
@@ -318,6 +347,22 @@ CREATE TABLE `user_traffic_minute` (
   CONSTRAINT `fk_utm_user` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='用户分钟级流量统计表';
 
+-- -----------------------------------------------------------------------------
+-- 8.1 流量上报去重 traffic_reports（internal report-traffic 幂等）
+-- 保留期：31 天（上报 ts 最多补报 30 天前的流量，再留 1 天余量）；后端登记时每小时最多一次
+-- 按 idx_tr_created 分批删除更早的记录，表大小约为 每用户每节点每分钟一行 × 31 天
+-- -----------------------------------------------------------------------------
+CREATE TABLE `traffic_reports` (
+  `report_id` VARCHAR(191) NOT NULL COMMENT '上报ID（节点:UUID:窗口起止，由 connector 生成）',
+  `node_id` INT NOT NULL COMMENT '节点ID',
+  `user_id` INT NOT NULL COMMENT '用户ID',
+  `upload` BIGINT NOT NULL DEFAULT 0 COMMENT '本次上报上传流量（字节）',
+  `download` BIGINT NOT NULL DEFAULT 0 COMMENT '本次上报下载流量（字节）',
+  `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '记账时间',
+  PRIMARY KEY (`report_id`),
+  KEY `idx_tr_created` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='流量上报去重表（同一 report_id 只记账一次）';
+
 -- -----------------------------------------------------------------------------
 -- 9. 订阅表 subscriptions（反向自库）
 -- -----------------------------------------------------------------------------
@@ -92,6 +92,10 @@ export function deleteAdminNode(id) {
   return http.delete(`/admin/nodes/${id}`);
 }
 
+export function getAdminNodeOnline(id) {
+  return http.get(`/admin/nodes/${id}/online`);
+}
+
 // node-agent（一键绑定节点）
 export function postAdminNodeAgentImport(data) {
   return http.post('/admin/node-agent/import', data);
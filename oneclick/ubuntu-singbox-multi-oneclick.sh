@@ -420,6 +420,8 @@ ${COMPOSE_CMD} up -d
 
 echo "[6/7] 节点注册..."
 
+# 说明：不带 merge，已有节点（address+port+protocol 相同）会被覆盖名称与 config（后台手工修改的也会被覆盖）；
+# connector register 带 merge: true，保留后台改过的名称与手工补充的 config 字段
 register_node() {
   local name="$1"
   local protocol="$2"
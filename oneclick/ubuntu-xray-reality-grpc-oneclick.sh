@@ -380,20 +380,23 @@ fi
 SHORT_ID="$(head -c 8 /dev/urandom | xxd -p)"
 
 echo "[xray] 写入配置：/etc/xray/config.json"
+# 说明：业务流量不写兜底路由规则，默认走第一个 outbound（direct）；
+# connector 踢下线时通过 RoutingService 追加「用户 -> block」规则，追加在末尾，前面有兜底规则会匹配不到
 mkdir -p /etc/xray
 cat > /etc/xray/config.json <<EOF
 {
   "log": { "loglevel": "warning" },
   "api": {
     "tag": "api",
-    "services": ["HandlerService", "StatsService"]
+    "services": ["HandlerService", "StatsService", "RoutingService"]
   },
   "stats": {},
   "policy": {
     "levels": {
       "0": {
         "statsUserUplink": true,
-        "statsUserDownlink": true
+        "statsUserDownlink": true,
+        "statsUserOnline": true
       }
     }
   },
@@ -436,16 +439,12 @@ cat > /etc/xray/config.json <<EOF
         "type": "field",
         "inboundTag": ["api-in"],
         "outboundTag": "api"
-      },
-      {
-        "type": "field",
-        "inboundTag": ["in-vless-reality"],
-        "outboundTag": "direct"
       }
     ]
   },
   "outbounds": [
-    { "protocol": "freedom", "tag": "direct" }
+    { "protocol": "freedom", "tag": "direct" },
+    { "protocol": "blackhole", "tag": "block" }
   ]
 }
 EOF
@@ -459,9 +458,7 @@ Wants=network-online.target
 
 [Service]
 Type=simple
-# 【重要】Xray 重启时清除 applied.json，确保 connector 重新添加所有用户
-# 因为 Xray 重启后内存中的用户列表会被清空，但 applied.json 还保留旧状态
-ExecStartPre=/bin/bash -c 'rm -f ${INSTALL_DIR}/out/node-*/applied.json 2>/dev/null || true'
+# Xray 重启后内存中的用户会被清空：connector 会通过 GetSysStats 的 Uptime 自动检测并重新下发全部用户
 ExecStart=${XRAY_BIN} run -config /etc/xray/config.json
 Restart=always
 RestartSec=3
@@ -503,6 +500,8 @@ REGISTER_PAYLOAD="$(jq -nc \
   '{name:$name,address:$address,port:$port,protocol:$protocol,config:$cfg,status:1,sort_order:0}' \
 )"
 
+# 说明：不带 merge，已有节点（address+port+protocol 相同）会被覆盖名称与 config（后台手工修改的也会被覆盖）；
+# connector register 带 merge: true，保留后台改过的名称与手工补充的 config 字段
 echo "[panel] 调用 /api/internal/register-node ..."
 REGISTER_URL="${PANEL_BASE_URL%/}/api/internal/register-node"
 tmp_hdr="$(mktemp)"
@@ -600,7 +599,8 @@ mkdir -p "${INSTALL_DIR}/bin" "${INSTALL_DIR}/out"
   cd "${CONNECTOR_DIR}"
   echo "[daemon] go mod tidy（生成 go.sum / 拉取依赖）..."
   go mod tidy
-  go build -o "${INSTALL_DIR}/bin/connector" .
+  CONNECTOR_VERSION="$(cat "${SRC_DIR}/VERSION" 2>/dev/null || echo dev)"
+  go build -ldflags "-X main.version=${CONNECTOR_VERSION}" -o "${INSTALL_DIR}/bin/connector" .
 )
 
 cat > "${INSTALL_DIR}/daemon.env" <<EOF
@@ -618,6 +618,19 @@ XRAY_RPC_TIMEOUT_SECONDS=5
 # 流量统计（通过 Xray Stats API 每分钟上报一次）
 ENABLE_TRAFFIC_REPORT=true
 TRAFFIC_REPORT_INTERVAL_SECONDS=60
+# 心跳（上报版本/负载/同步状态，后台「节点管理」可见）
+HEARTBEAT_INTERVAL_SECONDS=30
+XRAY_BIN=${XRAY_BIN}
+# 推送接口（可选，兼容 node-agent.py：面板「推送 UUID」立即生效），开启需放行端口
+# AGENT_LISTEN=0.0.0.0:1085
+# AGENT_TOKEN=自定义随机字符串
+AGENT_NODE_INFO_FILE=${INSTALL_DIR}/node.json
+# 踢下线：用户被封禁/到期/超额后，通过路由规则把其新请求导向 block，并按流量计数器确认已断开；
+# 路由规则不会断开已建立的连接；仍有流量时可按来源 IP 强制断开现有 TCP 连接（可选，
+# 同一来源 IP（NAT / 共享出口）上其他用户的连接也会被断开，确认后再开启）
+KICK_MODE=route
+KICK_OUTBOUND_TAG=block
+# KICK_BOUNCE_COMMAND=for ip in {ips}; do ss -K dst \$ip sport = :{port}; done
 EOF
 
 cat > /etc/systemd/system/panel-xray-daemon.service <<EOF
@@ -630,6 +643,9 @@ Wants=network-online.target
 Type=simple
 EnvironmentFile=${INSTALL_DIR}/daemon.env
 ExecStart=${INSTALL_DIR}/bin/connector
+# systemctl reload 触发立即全量同步；停止时留出最后一轮流量上报的时间
+ExecReload=/bin/kill -HUP \$MAINPID
+TimeoutStopSec=30
 Restart=always
 RestartSec=3
 